@@ -2,12 +2,45 @@ package cache
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"nearby-friends/types"
+	"time"
 
 	"go.uber.org/zap"
 )
 
+// UserLocationTTL is how long a cached user location is considered live
+// before it expires out of the cache.
+const UserLocationTTL = 10 * time.Minute
+
+// ErrNearbyUnsupported is returned by FindNearby on flavors that don't index
+// locations. Callers should fall back to GetUserLocations.
+var ErrNearbyUnsupported = errors.New("cache flavor does not support nearby queries")
+
+// userLocationChannel is the pubsub channel a user's location updates are
+// published to.
+func userLocationChannel(userID int) string {
+	return fmt.Sprintf("user_location:%v", userID)
+}
+
+// userEventChannelPrefix starts the pubsub channels events about a user are
+// published to. Subscribing to a user subscribes to both their channels.
+const userEventChannelPrefix = "user_event:"
+
+func userEventChannel(userID int) string {
+	return fmt.Sprintf("%v%v", userEventChannelPrefix, userID)
+}
+
+// userChannels are the channels a subscription to the users listens on
+func userChannels(userIDs ...int) []string {
+	channels := make([]string, 0, 2*len(userIDs))
+	for _, userID := range userIDs {
+		channels = append(channels, userLocationChannel(userID), userEventChannel(userID))
+	}
+	return channels
+}
+
 type ConnInfo struct {
 	Host     string
 	Port     string
@@ -24,25 +57,71 @@ type CacheFlavor int
 
 const (
 	RedisCache CacheFlavor = iota
+	InMemoryCache
+	RedisGeoCache
 )
 
 type PubSubFlavor int
 
 const (
 	RedisPubSub PubSubFlavor = iota
+	InMemoryPubSub
 )
 
 type CacheHandlerable interface {
 	SetUserLocation(context.Context, types.UserLocation) error
 	GetUserLocations(context.Context, []types.User) ([]types.UserLocation, error)
+	// FindNearby returns the cached locations of every other user within
+	// radius miles of the location, nearest first
+	FindNearby(ctx context.Context, location types.UserLocation, radius float64) ([]types.UserLocation, error)
+	// RemoveUserLocation drops the user's cached location so they stop
+	// showing up before it would expire
+	RemoveUserLocation(ctx context.Context, userID int) error
+	// Close releases the connection to the backend
+	Close() error
 }
 
 type PubSubHandlerable interface {
 	BroadcastLocation(context.Context, types.UserLocation) error
-	SubscribeToFriends(context.Context, []types.User, func(types.UserLocation)) error
+	// BroadcastEvent publishes the event to the subscriptions to its user
+	BroadcastEvent(context.Context, types.FriendEvent) error
+	// SubscribeToFriends starts a subscription to the friends location updates
+	// and events. The subscription lives until it is closed or the context
+	// is done.
+	SubscribeToFriends(
+		ctx context.Context,
+		friends []types.User,
+		onLocation func(types.UserLocation),
+		onEvent func(types.FriendEvent),
+	) (Subscription, error)
+	// Close releases the connection to the backend. Subscriptions still
+	// open stop receiving updates.
+	Close() error
+}
+
+// Subscription is the set of users whose location updates are delivered to a
+// single session. Users can be added and removed for the life of the session.
+// As with any pubsub, updates published while an Add is still being
+// acknowledged by the backend may be missed.
+type Subscription interface {
+	Add(ctx context.Context, userIDs ...int) error
+	// AddEvents subscribes to the users' events only, without their
+	// location updates
+	AddEvents(ctx context.Context, userIDs ...int) error
+	Remove(ctx context.Context, userIDs ...int) error
+	Close() error
 }
 
-func NewCacheHandler(ctx context.Context, flavor CacheFlavor, info ConnInfo, log *zap.Logger) (CacheHandlerable, error) {
+// NewCacheHandler connects to the cache of the flavor. The in-memory flavor
+// finds the users nearby by distance, the Redis flavors search with Redis'
+// own haversine distance.
+func NewCacheHandler(
+	ctx context.Context,
+	flavor CacheFlavor,
+	info ConnInfo,
+	distance types.DistanceFunc,
+	log *zap.Logger,
+) (CacheHandlerable, error) {
 	switch flavor {
 	case RedisCache:
 		handler, err := NewRedisCacheHandler(ctx, info, log)
@@ -50,6 +129,14 @@ func NewCacheHandler(ctx context.Context, flavor CacheFlavor, info ConnInfo, log
 			return nil, fmt.Errorf("error creating new cache handler for flavor %v: %v", flavor, err)
 		}
 		return handler, nil
+	case InMemoryCache:
+		return NewInMemoryCacheHandler(distance, log), nil
+	case RedisGeoCache:
+		handler, err := NewRedisGeoCacheHandler(ctx, info, log)
+		if err != nil {
+			return nil, fmt.Errorf("error creating new cache handler for flavor %v: %v", flavor, err)
+		}
+		return handler, nil
 	default:
 		return nil, fmt.Errorf("unhandled cache flavor %v", flavor)
 	}
@@ -63,6 +150,8 @@ func NewPubSubHandler(ctx context.Context, flavor PubSubFlavor, info ConnInfo, l
 			return nil, fmt.Errorf("error creating new cache handler for flavor %v: %v", flavor, err)
 		}
 		return &PubSubHandler{CacheHandler: handler.(*CacheHandler)}, nil
+	case InMemoryPubSub:
+		return NewInMemoryPubSubHandler(log), nil
 	default:
 		return nil, fmt.Errorf("unhandled cache flavor %v", flavor)
 	}
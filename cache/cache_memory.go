@@ -0,0 +1,159 @@
+package cache
+
+import (
+	"container/heap"
+	"context"
+	"nearby-friends/geo"
+	"nearby-friends/types"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+type cachedUserLocation struct {
+	location  types.UserLocation
+	expiresAt time.Time
+	// index is the entry's position in the expiry heap
+	index int
+}
+
+// expiryHeap orders cached locations soonest to expire first
+type expiryHeap []*cachedUserLocation
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].expiresAt.Before(h[j].expiresAt) }
+
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *expiryHeap) Push(x any) {
+	cached := x.(*cachedUserLocation)
+	cached.index = len(*h)
+	*h = append(*h, cached)
+}
+
+func (h *expiryHeap) Pop() any {
+	old := *h
+	cached := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return cached
+}
+
+// InMemoryCacheHandler is a process local cache used for local runs and tests
+// where a Redis instance is not available.
+type InMemoryCacheHandler struct {
+	mu        sync.RWMutex
+	locations map[int]*cachedUserLocation
+	expiries  expiryHeap
+	index     *geo.Index
+	ttl       time.Duration
+	now       func() time.Time
+	log       *zap.Logger
+}
+
+var _ CacheHandlerable = &InMemoryCacheHandler{}
+
+// NewInMemoryCacheHandler caches locations in memory, finding the users
+// nearby by distance
+func NewInMemoryCacheHandler(distance types.DistanceFunc, log *zap.Logger) CacheHandlerable {
+	return &InMemoryCacheHandler{
+		locations: make(map[int]*cachedUserLocation),
+		index:     geo.NewIndex(geo.PrecisionFor(types.MaxDistanceBetweenUsers), distance),
+		ttl:       UserLocationTTL,
+		now:       time.Now,
+		log:       log,
+	}
+}
+
+func (ch *InMemoryCacheHandler) SetUserLocation(
+	ctx context.Context,
+	userLocation types.UserLocation,
+) error {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	now := ch.now()
+	ch.sweep(now)
+
+	if cached, ok := ch.locations[userLocation.ID]; ok {
+		cached.location = userLocation
+		cached.expiresAt = now.Add(ch.ttl)
+		heap.Fix(&ch.expiries, cached.index)
+	} else {
+		cached := &cachedUserLocation{location: userLocation, expiresAt: now.Add(ch.ttl)}
+		ch.locations[userLocation.ID] = cached
+		heap.Push(&ch.expiries, cached)
+	}
+	ch.index.Insert(userLocation)
+	return nil
+}
+
+// sweep drops the locations that have expired by now, so the cache doesn't
+// grow with users that have gone away. Only expired entries are visited.
+func (ch *InMemoryCacheHandler) sweep(now time.Time) {
+	for len(ch.expiries) > 0 && !now.Before(ch.expiries[0].expiresAt) {
+		cached := heap.Pop(&ch.expiries).(*cachedUserLocation)
+		delete(ch.locations, cached.location.ID)
+		ch.index.Remove(cached.location.ID)
+	}
+}
+
+func (ch *InMemoryCacheHandler) GetUserLocations(
+	ctx context.Context,
+	users []types.User,
+) ([]types.UserLocation, error) {
+	ch.mu.RLock()
+	defer ch.mu.RUnlock()
+
+	now := ch.now()
+	var locations []types.UserLocation
+	for _, user := range users {
+		cached, ok := ch.locations[user.ID]
+		if !ok || !now.Before(cached.expiresAt) {
+			continue
+		}
+		locations = append(locations, cached.location)
+	}
+	return locations, nil
+}
+
+func (ch *InMemoryCacheHandler) FindNearby(
+	ctx context.Context,
+	location types.UserLocation,
+	radius float64,
+) ([]types.UserLocation, error) {
+	ch.mu.RLock()
+	defer ch.mu.RUnlock()
+
+	now := ch.now()
+	var nearby []types.UserLocation
+	for _, candidate := range ch.index.Within(location, radius) {
+		cached, ok := ch.locations[candidate.ID]
+		if candidate.ID == location.ID || !ok || !now.Before(cached.expiresAt) {
+			continue
+		}
+		nearby = append(nearby, candidate)
+	}
+	return nearby, nil
+}
+
+func (ch *InMemoryCacheHandler) RemoveUserLocation(ctx context.Context, userID int) error {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	if cached, ok := ch.locations[userID]; ok {
+		heap.Remove(&ch.expiries, cached.index)
+		delete(ch.locations, userID)
+	}
+	ch.index.Remove(userID)
+	return nil
+}
+
+// Close is a no-op, the cache holds no connections
+func (ch *InMemoryCacheHandler) Close() error {
+	return nil
+}
@@ -0,0 +1,215 @@
+package cache
+
+import (
+	"context"
+	"nearby-friends/types"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// subscriberBufferSize bounds how many undelivered messages a single
+// in-memory subscription can hold before new messages are dropped.
+const subscriberBufferSize = 64
+
+// inMemoryMessage is either a location update or an event
+type inMemoryMessage struct {
+	channel  string
+	location types.UserLocation
+	event    *types.FriendEvent
+}
+
+// inMemorySubscription receives every channel a session listens on through a
+// single buffered queue
+type inMemorySubscription struct {
+	handler    *InMemoryPubSubHandler
+	onLocation func(types.UserLocation)
+	onEvent    func(types.FriendEvent)
+	messages   chan inMemoryMessage
+
+	mu       sync.RWMutex
+	channels map[string]struct{}
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+var _ Subscription = &inMemorySubscription{}
+
+// InMemoryPubSubHandler fans location updates out to subscribers within the
+// current process. Channels are keyed the same way as the Redis pubsub.
+type InMemoryPubSubHandler struct {
+	mu          sync.RWMutex
+	subscribers map[string]map[*inMemorySubscription]struct{}
+	log         *zap.Logger
+}
+
+var _ PubSubHandlerable = &InMemoryPubSubHandler{}
+
+func NewInMemoryPubSubHandler(log *zap.Logger) PubSubHandlerable {
+	return &InMemoryPubSubHandler{
+		subscribers: make(map[string]map[*inMemorySubscription]struct{}),
+		log:         log,
+	}
+}
+
+func (ph *InMemoryPubSubHandler) SubscribeToFriends(
+	ctx context.Context,
+	friends []types.User,
+	onLocation func(types.UserLocation),
+	onEvent func(types.FriendEvent),
+) (Subscription, error) {
+	sub := &inMemorySubscription{
+		handler:    ph,
+		onLocation: onLocation,
+		onEvent:    onEvent,
+		messages:   make(chan inMemoryMessage, subscriberBufferSize),
+		channels:   make(map[string]struct{}),
+		done:       make(chan struct{}),
+	}
+
+	friendIDs := []int{}
+	for _, friend := range friends {
+		friendIDs = append(friendIDs, friend.ID)
+	}
+	if err := sub.Add(ctx, friendIDs...); err != nil {
+		return nil, err
+	}
+
+	go sub.listenForUpdates(ctx)
+	return sub, nil
+}
+
+func (ph *InMemoryPubSubHandler) BroadcastLocation(ctx context.Context, userLocation types.UserLocation) error {
+	channel := userLocationChannel(userLocation.ID)
+	ph.publish(inMemoryMessage{channel: channel, location: userLocation})
+	return nil
+}
+
+func (ph *InMemoryPubSubHandler) BroadcastEvent(ctx context.Context, event types.FriendEvent) error {
+	channel := userEventChannel(event.UserID)
+	ph.publish(inMemoryMessage{channel: channel, event: &event})
+	return nil
+}
+
+func (ph *InMemoryPubSubHandler) publish(msg inMemoryMessage) {
+	ph.mu.RLock()
+	defer ph.mu.RUnlock()
+	for sub := range ph.subscribers[msg.channel] {
+		select {
+		case sub.messages <- msg:
+		default:
+			ph.log.Sugar().Warnf("dropping message for slow subscriber on channel %v", msg.channel)
+		}
+	}
+}
+
+func (s *inMemorySubscription) Add(ctx context.Context, userIDs ...int) error {
+	s.add(userChannels(userIDs...)...)
+	return nil
+}
+
+func (s *inMemorySubscription) AddEvents(ctx context.Context, userIDs ...int) error {
+	channels := make([]string, 0, len(userIDs))
+	for _, userID := range userIDs {
+		channels = append(channels, userEventChannel(userID))
+	}
+	s.add(channels...)
+	return nil
+}
+
+func (s *inMemorySubscription) add(channels ...string) {
+	s.handler.mu.Lock()
+	defer s.handler.mu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, channel := range channels {
+		if _, ok := s.handler.subscribers[channel]; !ok {
+			s.handler.subscribers[channel] = make(map[*inMemorySubscription]struct{})
+		}
+		s.handler.subscribers[channel][s] = struct{}{}
+		s.channels[channel] = struct{}{}
+	}
+}
+
+func (s *inMemorySubscription) Remove(ctx context.Context, userIDs ...int) error {
+	s.remove(userChannels(userIDs...)...)
+	return nil
+}
+
+func (s *inMemorySubscription) remove(channels ...string) {
+	s.handler.mu.Lock()
+	defer s.handler.mu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, channel := range channels {
+		delete(s.handler.subscribers[channel], s)
+		if len(s.handler.subscribers[channel]) == 0 {
+			delete(s.handler.subscribers, channel)
+		}
+		delete(s.channels, channel)
+	}
+}
+
+// Close closes every subscription still open
+func (ph *InMemoryPubSubHandler) Close() error {
+	ph.mu.RLock()
+	subscriptions := make(map[*inMemorySubscription]struct{})
+	for _, subscribers := range ph.subscribers {
+		for sub := range subscribers {
+			subscriptions[sub] = struct{}{}
+		}
+	}
+	ph.mu.RUnlock()
+
+	for sub := range subscriptions {
+		sub.Close()
+	}
+	return nil
+}
+
+func (s *inMemorySubscription) Close() error {
+	s.closeOnce.Do(func() {
+		s.mu.RLock()
+		channels := []string{}
+		for channel := range s.channels {
+			channels = append(channels, channel)
+		}
+		s.mu.RUnlock()
+
+		s.remove(channels...)
+		close(s.done)
+	})
+	return nil
+}
+
+func (s *inMemorySubscription) subscribed(channel string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.channels[channel]
+	return ok
+}
+
+func (s *inMemorySubscription) listenForUpdates(ctx context.Context) {
+	defer s.Close()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.done:
+			return
+		case msg := <-s.messages:
+			// Messages queued before a Remove are dropped
+			if !s.subscribed(msg.channel) {
+				continue
+			}
+			if msg.event != nil {
+				s.onEvent(*msg.event)
+				continue
+			}
+			s.onLocation(msg.location)
+		}
+	}
+}
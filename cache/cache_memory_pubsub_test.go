@@ -0,0 +1,202 @@
+package cache
+
+import (
+	"context"
+	"nearby-friends/types"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// receiver collects what a subscription delivers
+type receiver struct {
+	locations chan types.UserLocation
+	events    chan types.FriendEvent
+}
+
+func newReceiver() receiver {
+	return receiver{
+		locations: make(chan types.UserLocation, 8),
+		events:    make(chan types.FriendEvent, 8),
+	}
+}
+
+func (r receiver) onLocation(location types.UserLocation) {
+	r.locations <- location
+}
+
+func (r receiver) onEvent(event types.FriendEvent) {
+	r.events <- event
+}
+
+func (r receiver) expect(t *testing.T, userID int) {
+	t.Helper()
+	select {
+	case location := <-r.locations:
+		if location.ID != userID {
+			t.Fatalf("got update from user %v, want %v", location.ID, userID)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no update from user %v", userID)
+	}
+}
+
+func (r receiver) expectNothing(t *testing.T) {
+	t.Helper()
+	select {
+	case location := <-r.locations:
+		t.Fatalf("got unexpected update from user %v", location.ID)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestInMemoryPubSubDeliversToSubscribedFriends(t *testing.T) {
+	ctx := context.Background()
+	ph := NewInMemoryPubSubHandler(zap.NewNop())
+	defer ph.Close()
+
+	alice, bob := newReceiver(), newReceiver()
+	if _, err := ph.SubscribeToFriends(ctx, users(2, 3), alice.onLocation, alice.onEvent); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ph.SubscribeToFriends(ctx, users(3), bob.onLocation, bob.onEvent); err != nil {
+		t.Fatal(err)
+	}
+
+	ph.BroadcastLocation(ctx, testLocation(2, 40, -74))
+	alice.expect(t, 2)
+	bob.expectNothing(t)
+
+	ph.BroadcastLocation(ctx, testLocation(3, 40, -74))
+	alice.expect(t, 3)
+	bob.expect(t, 3)
+}
+
+func TestInMemoryPubSubAddRemove(t *testing.T) {
+	ctx := context.Background()
+	ph := NewInMemoryPubSubHandler(zap.NewNop())
+	defer ph.Close()
+
+	r := newReceiver()
+	sub, err := ph.SubscribeToFriends(ctx, users(2), r.onLocation, r.onEvent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sub.Add(ctx, 3)
+	ph.BroadcastLocation(ctx, testLocation(3, 40, -74))
+	r.expect(t, 3)
+
+	sub.Remove(ctx, 2)
+	ph.BroadcastLocation(ctx, testLocation(2, 40, -74))
+	r.expectNothing(t)
+}
+
+func TestInMemoryPubSubEvents(t *testing.T) {
+	ctx := context.Background()
+	ph := NewInMemoryPubSubHandler(zap.NewNop())
+	defer ph.Close()
+
+	r := newReceiver()
+	sub, err := ph.SubscribeToFriends(ctx, users(2), r.onLocation, r.onEvent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sent := types.FriendEvent{UserID: 2, Kind: types.FriendEventUnfriended, Viewers: []int{1}}
+	ph.BroadcastEvent(ctx, sent)
+	select {
+	case event := <-r.events:
+		if event.UserID != 2 || event.Kind != sent.Kind || !event.For(1) || event.For(3) {
+			t.Fatalf("got event %+v, want %+v", event, sent)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no event from user 2")
+	}
+	r.expectNothing(t)
+
+	// Events stop with the rest of the user's updates
+	sub.Remove(ctx, 2)
+	ph.BroadcastEvent(ctx, sent)
+	select {
+	case event := <-r.events:
+		t.Fatalf("got event %+v after unsubscribing", event)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestInMemoryPubSubAddEvents(t *testing.T) {
+	ctx := context.Background()
+	ph := NewInMemoryPubSubHandler(zap.NewNop())
+	defer ph.Close()
+
+	r := newReceiver()
+	sub, err := ph.SubscribeToFriends(ctx, nil, r.onLocation, r.onEvent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub.AddEvents(ctx, 1)
+
+	ph.BroadcastEvent(ctx, types.FriendEvent{UserID: 1, Kind: types.FriendEventFriended, FriendID: 2})
+	select {
+	case event := <-r.events:
+		if event.UserID != 1 || event.FriendID != 2 {
+			t.Fatalf("got event %+v, want user 1 friended 2", event)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no event from user 1")
+	}
+	ph.BroadcastLocation(ctx, testLocation(1, 40, -74))
+	r.expectNothing(t)
+}
+
+func TestInMemoryPubSubClose(t *testing.T) {
+	ctx := context.Background()
+	ph := NewInMemoryPubSubHandler(zap.NewNop()).(*InMemoryPubSubHandler)
+
+	r := newReceiver()
+	sub, err := ph.SubscribeToFriends(ctx, users(2), r.onLocation, r.onEvent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := newReceiver()
+	if _, err := ph.SubscribeToFriends(ctx, users(2), other.onLocation, other.onEvent); err != nil {
+		t.Fatal(err)
+	}
+
+	sub.Close()
+	ph.BroadcastLocation(ctx, testLocation(2, 40, -74))
+	r.expectNothing(t)
+	other.expect(t, 2)
+
+	ph.Close()
+	if len(ph.subscribers) != 0 {
+		t.Fatalf("%v channels still subscribed after closing", len(ph.subscribers))
+	}
+}
+
+func TestInMemoryPubSubSubscriptionEndsWithContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	ph := NewInMemoryPubSubHandler(zap.NewNop()).(*InMemoryPubSubHandler)
+
+	r := newReceiver()
+	if _, err := ph.SubscribeToFriends(ctx, users(2), r.onLocation, r.onEvent); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		ph.mu.RLock()
+		subscribed := len(ph.subscribers)
+		ph.mu.RUnlock()
+		if subscribed == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("subscription still open after its context was done")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
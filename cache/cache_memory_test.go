@@ -0,0 +1,185 @@
+package cache
+
+import (
+	"context"
+	"nearby-friends/types"
+	"sort"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func newTestCache() (*InMemoryCacheHandler, *time.Time) {
+	clock := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	ch := NewInMemoryCacheHandler(types.Haversine, zap.NewNop()).(*InMemoryCacheHandler)
+	ch.now = func() time.Time { return clock }
+	return ch, &clock
+}
+
+func testLocation(id int, lat, lon float64) types.UserLocation {
+	return types.UserLocation{
+		User:      &types.User{ID: id, Name: "user"},
+		Latitude:  lat,
+		Longitude: lon,
+	}
+}
+
+func users(ids ...int) []types.User {
+	var users []types.User
+	for _, id := range ids {
+		users = append(users, types.User{ID: id})
+	}
+	return users
+}
+
+func locationIDs(locations []types.UserLocation) []int {
+	ids := []int{}
+	for _, location := range locations {
+		ids = append(ids, location.ID)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+func equalIDs(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestInMemoryCacheGetUserLocations(t *testing.T) {
+	ctx := context.Background()
+	ch, _ := newTestCache()
+
+	ch.SetUserLocation(ctx, testLocation(1, 40, -74))
+	ch.SetUserLocation(ctx, testLocation(2, 41, -74))
+	ch.SetUserLocation(ctx, testLocation(1, 42, -74))
+
+	locations, err := ch.GetUserLocations(ctx, users(1, 2, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := locationIDs(locations); !equalIDs(got, []int{1, 2}) {
+		t.Fatalf("got users %v, want [1 2]", got)
+	}
+	for _, location := range locations {
+		if location.ID == 1 && location.Latitude != 42 {
+			t.Errorf("user 1 at latitude %v, want the latest update 42", location.Latitude)
+		}
+	}
+}
+
+func TestInMemoryCacheExpiry(t *testing.T) {
+	ctx := context.Background()
+	ch, clock := newTestCache()
+
+	ch.SetUserLocation(ctx, testLocation(1, 40, -74))
+	*clock = clock.Add(ch.ttl / 2)
+	ch.SetUserLocation(ctx, testLocation(2, 40, -74))
+	*clock = clock.Add(ch.ttl / 2)
+
+	locations, _ := ch.GetUserLocations(ctx, users(1, 2))
+	if got := locationIDs(locations); !equalIDs(got, []int{2}) {
+		t.Fatalf("got users %v after the first expired, want [2]", got)
+	}
+	nearby, _ := ch.FindNearby(ctx, testLocation(3, 40, -74), 10)
+	if got := locationIDs(nearby); !equalIDs(got, []int{2}) {
+		t.Fatalf("got nearby users %v after the first expired, want [2]", got)
+	}
+}
+
+func TestInMemoryCacheRefreshExtendsExpiry(t *testing.T) {
+	ctx := context.Background()
+	ch, clock := newTestCache()
+
+	ch.SetUserLocation(ctx, testLocation(1, 40, -74))
+	ch.SetUserLocation(ctx, testLocation(2, 40, -74))
+	*clock = clock.Add(ch.ttl - time.Second)
+	ch.SetUserLocation(ctx, testLocation(1, 40, -74))
+	*clock = clock.Add(2 * time.Second)
+	// Writing sweeps what has expired
+	ch.SetUserLocation(ctx, testLocation(3, 40, -74))
+
+	if _, ok := ch.locations[2]; ok {
+		t.Error("expired user 2 wasn't swept on write")
+	}
+	if _, ok := ch.index.Get(2); ok {
+		t.Error("expired user 2 wasn't swept from the index")
+	}
+	locations, _ := ch.GetUserLocations(ctx, users(1, 2, 3))
+	if got := locationIDs(locations); !equalIDs(got, []int{1, 3}) {
+		t.Fatalf("got users %v, want the refreshed [1 3]", got)
+	}
+	if len(ch.expiries) != len(ch.locations) {
+		t.Fatalf("%v expiries tracked for %v locations", len(ch.expiries), len(ch.locations))
+	}
+}
+
+func TestInMemoryCacheRemoveUserLocation(t *testing.T) {
+	ctx := context.Background()
+	ch, clock := newTestCache()
+
+	for id := 1; id <= 3; id++ {
+		ch.SetUserLocation(ctx, testLocation(id, 40, -74))
+	}
+	if err := ch.RemoveUserLocation(ctx, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.RemoveUserLocation(ctx, 4); err != nil {
+		t.Fatalf("removing an uncached user: %v", err)
+	}
+
+	locations, _ := ch.GetUserLocations(ctx, users(1, 2, 3))
+	if got := locationIDs(locations); !equalIDs(got, []int{1, 3}) {
+		t.Fatalf("got users %v, want [1 3]", got)
+	}
+	nearby, _ := ch.FindNearby(ctx, testLocation(4, 40, -74), 10)
+	if got := locationIDs(nearby); !equalIDs(got, []int{1, 3}) {
+		t.Fatalf("got nearby users %v, want [1 3]", got)
+	}
+
+	*clock = clock.Add(ch.ttl)
+	ch.SetUserLocation(ctx, testLocation(5, 40, -74))
+	if len(ch.locations) != 1 || len(ch.expiries) != 1 || ch.index.Len() != 1 {
+		t.Fatalf("got %v locations, %v expiries and %v indexed after the rest expired, want 1",
+			len(ch.locations), len(ch.expiries), ch.index.Len())
+	}
+}
+
+func TestInMemoryCacheFindNearby(t *testing.T) {
+	ctx := context.Background()
+	ch, _ := newTestCache()
+
+	ch.SetUserLocation(ctx, testLocation(1, 40.7128, -74.0060))  // New York
+	ch.SetUserLocation(ctx, testLocation(2, 40.7306, -73.9352))  // Brooklyn
+	ch.SetUserLocation(ctx, testLocation(3, 34.0522, -118.2437)) // Los Angeles
+
+	nearby, err := ch.FindNearby(ctx, testLocation(1, 40.7128, -74.0060), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := locationIDs(nearby); !equalIDs(got, []int{2}) {
+		t.Fatalf("got nearby users %v, want [2] without the user themself", got)
+	}
+}
+
+func BenchmarkInMemoryCacheSetUserLocation(b *testing.B) {
+	ctx := context.Background()
+	ch, _ := newTestCache()
+	for id := 0; id < 100000; id++ {
+		ch.SetUserLocation(ctx, testLocation(id, float64(id%180)-90, float64(id%360)-180))
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		id := i % 100000
+		ch.SetUserLocation(ctx, testLocation(id, float64(id%180)-90, float64(id%360)-180))
+	}
+}
@@ -6,7 +6,6 @@ import (
 	"fmt"
 	"nearby-friends/types"
 	"strconv"
-	"time"
 
 	"github.com/go-redis/redis/v8"
 	"go.uber.org/zap"
@@ -21,6 +20,14 @@ type CacheHandler struct {
 var _ CacheHandlerable = &CacheHandler{}
 
 func NewRedisCacheHandler(ctx context.Context, info ConnInfo, log *zap.Logger) (CacheHandlerable, error) {
+	client, err := newRedisClient(ctx, info, log)
+	if err != nil {
+		return nil, err
+	}
+	return &CacheHandler{Client: client, connInfo: info, log: log}, nil
+}
+
+func newRedisClient(ctx context.Context, info ConnInfo, log *zap.Logger) (*redis.Client, error) {
 	// Initialize Redis client
 	client := redis.NewClient(&redis.Options{
 		Addr: info.Addr(),
@@ -35,16 +42,20 @@ func NewRedisCacheHandler(ctx context.Context, info ConnInfo, log *zap.Logger) (
 		return nil, err
 	}
 	log.Info("Connected to Redis")
-
-	return &CacheHandler{Client: client, connInfo: info, log: log}, nil
+	return client, nil
 }
 
 func (ch *CacheHandler) SetUserLocation(
 	ctx context.Context,
 	userLocation types.UserLocation,
 ) error {
+	message, err := json.Marshal(userLocation)
+	if err != nil {
+		return fmt.Errorf("error marshaling user location to JSON: %v", err)
+	}
+
 	// Store the data in the cache with an expiration time of 10 minutes
-	err := ch.Set(ctx, strconv.Itoa(userLocation.ID), userLocation, 10*time.Minute).Err()
+	err = ch.Set(ctx, strconv.Itoa(userLocation.ID), message, UserLocationTTL).Err()
 	if err != nil {
 		return fmt.Errorf("error caching user location for user %v: %v", userLocation.ID, err)
 	}
@@ -55,6 +66,10 @@ func (ch *CacheHandler) GetUserLocations(
 	ctx context.Context,
 	users []types.User,
 ) ([]types.UserLocation, error) {
+	if len(users) == 0 {
+		return nil, nil
+	}
+
 	userIDs := []string{}
 	for _, user := range users {
 		userIDs = append(userIDs, strconv.Itoa(user.ID))
@@ -65,10 +80,36 @@ func (ch *CacheHandler) GetUserLocations(
 		return nil, fmt.Errorf("error getting user locations for the set of user IDs provided: %v", err)
 	}
 
+	// Users without a live location come back as nil
 	var locations []types.UserLocation
-	if err := json.Unmarshal([]byte(fmt.Sprintf("%v", result)), &locations); err != nil {
-		return nil, fmt.Errorf("error unmarshalling mget response for a set of users: %v", err)
+	for i, value := range result {
+		message, ok := value.(string)
+		if !ok {
+			continue
+		}
+		var location types.UserLocation
+		if err := json.Unmarshal([]byte(message), &location); err != nil {
+			return nil, fmt.Errorf("error unmarshalling cached location for user %v: %v", userIDs[i], err)
+		}
+		locations = append(locations, location)
 	}
 
 	return locations, nil
 }
+
+func (ch *CacheHandler) RemoveUserLocation(ctx context.Context, userID int) error {
+	if err := ch.Del(ctx, strconv.Itoa(userID)).Err(); err != nil {
+		return fmt.Errorf("error removing cached location for user %v: %v", userID, err)
+	}
+	return nil
+}
+
+// FindNearby is not supported since locations are only keyed by user. Use
+// the RedisGeoCache flavor for radius queries.
+func (ch *CacheHandler) FindNearby(
+	ctx context.Context,
+	location types.UserLocation,
+	radius float64,
+) ([]types.UserLocation, error) {
+	return nil, ErrNearbyUnsupported
+}
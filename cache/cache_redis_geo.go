@@ -0,0 +1,229 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"nearby-friends/types"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"go.uber.org/zap"
+)
+
+// userLocationsGeoKey is the geo set every user's last location is indexed in
+const userLocationsGeoKey = "user_locations"
+
+// userLocationKeyPrefix prefixes the hash holding a user's location
+// metadata. It expires with the location.
+const userLocationKeyPrefix = "user_location_meta:"
+
+// geoMaxLatitude is the furthest from the equator Redis can index a point.
+// Redis rejects anything past it even though the location is valid.
+const geoMaxLatitude = 85.05112878
+
+// geoPolarSlack is how far, in miles, clamping a location to geoMaxLatitude
+// can move it
+const geoPolarSlack = (90 - geoMaxLatitude) * math.Pi / 180 * types.EarthRadiusMiles
+
+// geoLatitude is where in the geo set a location at latitude is indexed.
+// Locations closer to a pole are indexed on the edge Redis can index, their
+// metadata keeps where they really are.
+func geoLatitude(latitude float64) float64 {
+	return max(-geoMaxLatitude, min(geoMaxLatitude, latitude))
+}
+
+// geoSearchRadius is the radius to search the geo set with for locations
+// within radius miles of location. A search reaching past the edge has to
+// make up for the query and the members found both having been moved onto
+// it, so it reports that its results need filtering by their real distance.
+func geoSearchRadius(location types.UserLocation, radius float64) (float64, bool) {
+	reach := radius / types.EarthRadiusMiles * 180 / math.Pi
+	if math.Abs(location.Latitude)+reach <= geoMaxLatitude {
+		return radius, false
+	}
+	return radius + 2*geoPolarSlack, true
+}
+
+func userLocationKey(userID int) string {
+	return userLocationKeyPrefix + strconv.Itoa(userID)
+}
+
+// findNearbyScript searches the geo set and fetches the metadata of every
+// member found in the same round trip. Members whose metadata expired are
+// pruned from the geo set.
+//
+// KEYS[1] geo set, ARGV[1] longitude, ARGV[2] latitude, ARGV[3] radius in
+// miles, ARGV[4] metadata key prefix
+var findNearbyScript = redis.NewScript(`
+local members = redis.call('GEOSEARCH', KEYS[1], 'FROMLONLAT', ARGV[1], ARGV[2], 'BYRADIUS', ARGV[3], 'mi', 'ASC')
+local found = {}
+for _, member in ipairs(members) do
+	local fields = redis.call('HGETALL', ARGV[4] .. member)
+	if #fields == 0 then
+		redis.call('ZREM', KEYS[1], member)
+	else
+		table.insert(found, {member, fields})
+	end
+end
+return found
+`)
+
+// GeoCacheHandler indexes user locations in a Redis geo set so nearby users
+// can be found with a single radius query. Geo set members can't expire, so
+// the metadata hash of each user carries the TTL and stale members are
+// dropped when a search comes across them.
+type GeoCacheHandler struct {
+	*redis.Client
+	connInfo ConnInfo
+	log      *zap.Logger
+}
+
+var _ CacheHandlerable = &GeoCacheHandler{}
+
+func NewRedisGeoCacheHandler(ctx context.Context, info ConnInfo, log *zap.Logger) (CacheHandlerable, error) {
+	client, err := newRedisClient(ctx, info, log)
+	if err != nil {
+		return nil, err
+	}
+	return &GeoCacheHandler{Client: client, connInfo: info, log: log}, nil
+}
+
+func (ch *GeoCacheHandler) SetUserLocation(
+	ctx context.Context,
+	userLocation types.UserLocation,
+) error {
+	key := userLocationKey(userLocation.ID)
+	_, err := ch.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.GeoAdd(ctx, userLocationsGeoKey, &redis.GeoLocation{
+			Name:      strconv.Itoa(userLocation.ID),
+			Longitude: userLocation.Longitude,
+			Latitude:  geoLatitude(userLocation.Latitude),
+		})
+		pipe.HSet(ctx, key,
+			"name", userLocation.Name,
+			"longitude", userLocation.Longitude,
+			"latitude", userLocation.Latitude,
+			"lastUpdateTime", userLocation.LastUpdateTime.Format(time.RFC3339Nano),
+		)
+		pipe.Expire(ctx, key, UserLocationTTL)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error caching user location for user %v: %v", userLocation.ID, err)
+	}
+	return nil
+}
+
+func (ch *GeoCacheHandler) GetUserLocations(
+	ctx context.Context,
+	users []types.User,
+) ([]types.UserLocation, error) {
+	cmds := make([]*redis.StringStringMapCmd, len(users))
+	_, err := ch.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, user := range users {
+			cmds[i] = pipe.HGetAll(ctx, userLocationKey(user.ID))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error getting user locations for the set of user IDs provided: %v", err)
+	}
+
+	var locations []types.UserLocation
+	for i, cmd := range cmds {
+		fields := cmd.Val()
+		if len(fields) == 0 {
+			continue
+		}
+		location, err := userLocationFromHash(users[i].ID, fields)
+		if err != nil {
+			return nil, err
+		}
+		locations = append(locations, location)
+	}
+	return locations, nil
+}
+
+func (ch *GeoCacheHandler) FindNearby(
+	ctx context.Context,
+	location types.UserLocation,
+	radius float64,
+) ([]types.UserLocation, error) {
+	searchRadius, polar := geoSearchRadius(location, radius)
+	result, err := findNearbyScript.Run(ctx, ch.Client,
+		[]string{userLocationsGeoKey},
+		location.Longitude, geoLatitude(location.Latitude), searchRadius, userLocationKeyPrefix,
+	).Slice()
+	if err != nil {
+		return nil, fmt.Errorf("error finding users within %v miles of user %v: %v", radius, location.ID, err)
+	}
+
+	var nearby []types.UserLocation
+	for _, entry := range result {
+		pair, ok := entry.([]interface{})
+		if !ok || len(pair) != 2 {
+			return nil, fmt.Errorf("unexpected nearby search entry %v", entry)
+		}
+		member, _ := pair[0].(string)
+		userID, err := strconv.Atoi(member)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected member '%v' in %v: %v", member, userLocationsGeoKey, err)
+		}
+		if userID == location.ID {
+			continue
+		}
+
+		values, _ := pair[1].([]interface{})
+		fields := make(map[string]string, len(values)/2)
+		for i := 0; i+1 < len(values); i += 2 {
+			field, _ := values[i].(string)
+			value, _ := values[i+1].(string)
+			fields[field] = value
+		}
+		userLocation, err := userLocationFromHash(userID, fields)
+		if err != nil {
+			return nil, err
+		}
+		if polar && types.Haversine(location, userLocation) > radius {
+			continue
+		}
+		nearby = append(nearby, userLocation)
+	}
+	if polar {
+		// The geo set ordered them by where they are indexed
+		sort.SliceStable(nearby, func(i, j int) bool {
+			return types.Haversine(location, nearby[i]) < types.Haversine(location, nearby[j])
+		})
+	}
+	return nearby, nil
+}
+
+func (ch *GeoCacheHandler) RemoveUserLocation(ctx context.Context, userID int) error {
+	_, err := ch.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZRem(ctx, userLocationsGeoKey, strconv.Itoa(userID))
+		pipe.Del(ctx, userLocationKey(userID))
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error removing cached location for user %v: %v", userID, err)
+	}
+	return nil
+}
+
+func userLocationFromHash(userID int, fields map[string]string) (types.UserLocation, error) {
+	location := types.UserLocation{User: &types.User{ID: userID, Name: fields["name"]}}
+	var err error
+	if location.Longitude, err = strconv.ParseFloat(fields["longitude"], 64); err != nil {
+		return location, fmt.Errorf("error parsing cached longitude for user %v: %v", userID, err)
+	}
+	if location.Latitude, err = strconv.ParseFloat(fields["latitude"], 64); err != nil {
+		return location, fmt.Errorf("error parsing cached latitude for user %v: %v", userID, err)
+	}
+	if location.LastUpdateTime, err = time.Parse(time.RFC3339Nano, fields["lastUpdateTime"]); err != nil {
+		return location, fmt.Errorf("error parsing cached update time for user %v: %v", userID, err)
+	}
+	return location, nil
+}
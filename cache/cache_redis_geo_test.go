@@ -0,0 +1,48 @@
+package cache
+
+import (
+	"nearby-friends/types"
+	"testing"
+)
+
+func TestGeoLatitudeStaysIndexable(t *testing.T) {
+	for _, tc := range []struct {
+		latitude, want float64
+	}{
+		{0, 0},
+		{40.7128, 40.7128},
+		{geoMaxLatitude, geoMaxLatitude},
+		{89.9, geoMaxLatitude},
+		{90, geoMaxLatitude},
+		{-90, -geoMaxLatitude},
+	} {
+		if got := geoLatitude(tc.latitude); got != tc.want {
+			t.Errorf("indexed latitude %v at %v, want %v", tc.latitude, got, tc.want)
+		}
+	}
+}
+
+func TestGeoSearchRadiusCoversPolarLocations(t *testing.T) {
+	radius := 50.0
+	if got, polar := geoSearchRadius(testLocation(1, 40, -74), radius); got != radius || polar {
+		t.Fatalf("searching %v, %v away from the poles, want %v", got, polar, radius)
+	}
+
+	// Two users across the north pole from each other are indexed on the
+	// edge, on opposite sides of it, much further apart than they really are
+	query, friend := testLocation(1, 89.7, 0), testLocation(2, 89.7, 180)
+	if distance := types.Haversine(query, friend); distance > radius {
+		t.Fatalf("test users are %v miles apart, want them within %v", distance, radius)
+	}
+	indexed := func(location types.UserLocation) types.UserLocation {
+		location.Latitude = geoLatitude(location.Latitude)
+		return location
+	}
+	got, polar := geoSearchRadius(query, radius)
+	if !polar {
+		t.Fatal("search next to the pole isn't filtered by real distance")
+	}
+	if apart := types.Haversine(indexed(query), indexed(friend)); apart > got {
+		t.Fatalf("searching %v miles misses a friend indexed %v miles away", got, apart)
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"nearby-friends/types"
+	"strings"
+	"sync"
 
 	"github.com/go-redis/redis/v8"
 )
@@ -13,25 +15,47 @@ type PubSubHandler struct {
 	*CacheHandler
 }
 
+// redisSubscription multiplexes every channel a session listens on over a
+// single redis.PubSub connection
+type redisSubscription struct {
+	pubsub     *redis.PubSub
+	onLocation func(types.UserLocation)
+	onEvent    func(types.FriendEvent)
+
+	mu       sync.RWMutex
+	channels map[string]struct{}
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+var _ Subscription = &redisSubscription{}
+
 func (ch *PubSubHandler) SubscribeToFriends(
 	ctx context.Context,
 	friends []types.User,
-	callback func(types.UserLocation),
-) error {
-	pubSubs := []*redis.PubSub{}
-	for _, friend := range friends {
-		pubSub, err := ch.subscribeToChannel(ctx, friend.ID)
-		if err != nil {
-			return err
-		}
-		pubSubs = append(pubSubs, pubSub)
+	onLocation func(types.UserLocation),
+	onEvent func(types.FriendEvent),
+) (Subscription, error) {
+	sub := &redisSubscription{
+		pubsub:     ch.Subscribe(ctx),
+		onLocation: onLocation,
+		onEvent:    onEvent,
+		channels:   make(map[string]struct{}),
+		done:       make(chan struct{}),
 	}
 
-	for _, pubsub := range pubSubs {
-		go ch.listenForUpdates(ctx, pubsub, callback)
+	friendIDs := []int{}
+	for _, friend := range friends {
+		friendIDs = append(friendIDs, friend.ID)
+	}
+	if err := sub.Add(ctx, friendIDs...); err != nil {
+		sub.Close()
+		return nil, err
 	}
 
-	return nil
+	go sub.listenForUpdates(ctx)
+	return sub, nil
 }
 
 func (ch *PubSubHandler) BroadcastLocation(ctx context.Context, userLocation types.UserLocation) error {
@@ -40,36 +64,125 @@ func (ch *PubSubHandler) BroadcastLocation(ctx context.Context, userLocation typ
 		return fmt.Errorf("error marshaling user location to JSON: %v", err)
 	}
 
-	channel := fmt.Sprintf("user_location:%v", userLocation.ID)
+	channel := userLocationChannel(userLocation.ID)
 	if err := ch.Publish(ctx, channel, message).Err(); err != nil {
 		return fmt.Errorf("error publishing user location to channel %v: %v", channel, err)
 	}
 	return nil
 }
 
-func (ch *PubSubHandler) subscribeToChannel(ctx context.Context, userID int) (*redis.PubSub, error) {
-	channel := fmt.Sprintf("user_location:%v", userID)
-	pubsub := ch.Subscribe(ctx, channel)
-	_, err := pubsub.Receive(ctx)
+func (ch *PubSubHandler) BroadcastEvent(ctx context.Context, event types.FriendEvent) error {
+	message, err := json.Marshal(event)
 	if err != nil {
-		return nil, fmt.Errorf("error subscribing to channel '%v': %v", channel, err)
+		return fmt.Errorf("error marshaling friend event to JSON: %v", err)
 	}
-	return pubsub, nil
+
+	channel := userEventChannel(event.UserID)
+	if err := ch.Publish(ctx, channel, message).Err(); err != nil {
+		return fmt.Errorf("error publishing friend event to channel %v: %v", channel, err)
+	}
+	return nil
+}
+
+func (s *redisSubscription) Add(ctx context.Context, userIDs ...int) error {
+	return s.subscribe(ctx, userChannels(userIDs...)...)
 }
 
-func (ch *PubSubHandler) listenForUpdates(ctx context.Context, pubsub *redis.PubSub, callback func(types.UserLocation)) {
+func (s *redisSubscription) AddEvents(ctx context.Context, userIDs ...int) error {
+	channels := make([]string, 0, len(userIDs))
+	for _, userID := range userIDs {
+		channels = append(channels, userEventChannel(userID))
+	}
+	return s.subscribe(ctx, channels...)
+}
+
+func (s *redisSubscription) subscribe(ctx context.Context, channels ...string) error {
+	if len(channels) == 0 {
+		return nil
+	}
+
+	if err := s.pubsub.Subscribe(ctx, channels...); err != nil {
+		return fmt.Errorf("error subscribing to channels '%v': %v", channels, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, channel := range channels {
+		s.channels[channel] = struct{}{}
+	}
+	return nil
+}
+
+func (s *redisSubscription) Remove(ctx context.Context, userIDs ...int) error {
+	if len(userIDs) == 0 {
+		return nil
+	}
+
+	// Stop delivering before unsubscribing so messages already in flight on
+	// the connection are dropped
+	channels := userChannels(userIDs...)
+	s.mu.Lock()
+	for _, channel := range channels {
+		delete(s.channels, channel)
+	}
+	s.mu.Unlock()
+
+	if err := s.pubsub.Unsubscribe(ctx, channels...); err != nil {
+		return fmt.Errorf("error unsubscribing from channels '%v': %v", channels, err)
+	}
+	return nil
+}
+
+func (s *redisSubscription) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.done)
+		err = s.pubsub.Close()
+	})
+	return err
+}
+
+func (s *redisSubscription) subscribed(channel string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.channels[channel]
+	return ok
+}
+
+func (s *redisSubscription) listenForUpdates(ctx context.Context) {
+	defer s.Close()
+	messages := s.pubsub.Channel()
 	for {
-		msg, err := pubsub.ReceiveMessage(ctx)
-		if err != nil {
-			fmt.Println("Error receiving message:", err)
+		select {
+		case <-ctx.Done():
 			return
-		}
-		var userLocationUpdate types.UserLocation
-		if err := json.Unmarshal([]byte(msg.Payload), &userLocationUpdate); err != nil {
-			fmt.Printf("error unmarshalling message payload '%v' recieved from pubsub: '%v'\n", msg.Payload, err)
-			continue
-		}
+		case <-s.done:
+			return
+		case msg, ok := <-messages:
+			if !ok {
+				return
+			}
+			if !s.subscribed(msg.Channel) {
+				continue
+			}
+
+			if strings.HasPrefix(msg.Channel, userEventChannelPrefix) {
+				var event types.FriendEvent
+				if err := json.Unmarshal([]byte(msg.Payload), &event); err != nil {
+					fmt.Printf("error unmarshalling message payload '%v' recieved from pubsub: '%v'\n", msg.Payload, err)
+					continue
+				}
+				s.onEvent(event)
+				continue
+			}
 
-		callback(userLocationUpdate)
+			var userLocationUpdate types.UserLocation
+			if err := json.Unmarshal([]byte(msg.Payload), &userLocationUpdate); err != nil {
+				fmt.Printf("error unmarshalling message payload '%v' recieved from pubsub: '%v'\n", msg.Payload, err)
+				continue
+			}
+
+			s.onLocation(userLocationUpdate)
+		}
 	}
 }
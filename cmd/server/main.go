@@ -2,17 +2,31 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
+	"fmt"
+	"nearby-friends/auth"
 	"nearby-friends/cache"
 	"nearby-friends/db"
+	"nearby-friends/export"
 	"nearby-friends/server"
-	//"nearby-friends/types"
+	"nearby-friends/types"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
 
 	"go.uber.org/zap"
 )
 
 var debug bool
+var cacheBackend string
+var dbBackend string
+var authSecret string
+var tokenTTL time.Duration
+var shutdownTimeout time.Duration
 
 func main() {
 	serverInfo := server.Info{}
@@ -23,13 +37,57 @@ func main() {
 	flag.StringVar(&serverInfo.CAKeyPath, "caKey", "", "Path to the CA Key file")
 	flag.StringVar(&serverInfo.Host, "srvhost", "", "Server host")
 	flag.StringVar(&serverInfo.Port, "srvport", "8080", "Server port")
+	flag.DurationVar(&shutdownTimeout, "shutdowntimeout", 30*time.Second,
+		"How long open connections are given to drain when the server is stopped")
 
+	flag.StringVar(&authSecret, "authsecret", os.Getenv("NEARBY_FRIENDS_AUTH_SECRET"),
+		"Secret used to sign bearer tokens. A random one is generated when empty")
+	flag.DurationVar(&tokenTTL, "tokenttl", 24*time.Hour, "How long issued bearer tokens are valid for")
+
+	options := server.DefaultOptions()
+	flag.Float64Var(&options.ApproximateGrid, "approxgrid", options.ApproximateGrid,
+		"Size in miles of the grid locations are snapped to for friends with approximate access")
+	flag.Func("distance", "Algorithm distances between users are computed with (haversine|vincenty|equirectangular|cosines, default haversine)",
+		func(value string) error {
+			distance, err := types.ParseDistanceFunc(value)
+			if err != nil {
+				return err
+			}
+			options.Distance = distance
+			return nil
+		})
+	flag.IntVar(&options.OutboundQueueSize, "outboundqueue", options.OutboundQueueSize,
+		"How many messages each websocket queues for a slow client")
+	flag.Func("droppolicy", "What to do when a websocket queue is full (drop-oldest|coalesce|disconnect, default coalesce)",
+		func(value string) error {
+			policy := server.DropPolicy(value)
+			if !policy.Valid() {
+				return fmt.Errorf("unknown drop policy '%v'", value)
+			}
+			options.DropPolicy = policy
+			return nil
+		})
+	flag.DurationVar(&options.PingInterval, "pinginterval", options.PingInterval,
+		"How often websocket clients are pinged, never when 0")
+	flag.DurationVar(&options.PongTimeout, "pongtimeout", options.PongTimeout,
+		"How long a silent websocket client is kept before it is disconnected, forever when 0")
+	flag.DurationVar(&options.WriteTimeout, "writetimeout", options.WriteTimeout,
+		"How long a single websocket write may take, forever when 0")
+	flag.DurationVar(&options.ResumeWindow, "resumewindow", options.ResumeWindow,
+		"How long a disconnected websocket session is kept for its client to resume, never when 0")
+	flag.BoolVar(&options.History, "history", options.History, "Record accepted locations so users can query their history")
+	flag.DurationVar(&options.HistoryRetention, "historyretention", options.HistoryRetention,
+		"How long recorded locations are kept, forever when 0")
+
+	flag.StringVar(&dbBackend, "db", "mysql", "Database backend (mysql|sqlite)")
 	dbInfo := db.ConnInfo{}
 	flag.StringVar(&dbInfo.Hostname, "dbhost", "mysql", "Database host")
 	flag.StringVar(&dbInfo.Username, "dbuser", "root", "Database username")
 	flag.StringVar(&dbInfo.Password, "dbpassword", "admin", "Database password")
 	flag.StringVar(&dbInfo.DBName, "dbname", "user", "Database name")
+	flag.StringVar(&dbInfo.Path, "dbpath", "nearby-friends.db", "Database file path for the sqlite backend")
 
+	flag.StringVar(&cacheBackend, "cache", "redis", "Cache and pubsub backend (redis|redis-geo|memory)")
 	cacheInfo := cache.ConnInfo{}
 	flag.StringVar(&cacheInfo.Host, "cachehost", "redis", "Cache host")
 	flag.StringVar(&cacheInfo.Port, "cacheport", "6379", "Cache port")
@@ -56,30 +114,239 @@ func main() {
 	defer log.Sync() // flushes buffer, if any
 
 	slog := log.Sugar()
-	db, err := db.NewDBHandler(db.MySQL, dbInfo, log)
+	dbFlavor := db.MySQL
+	switch dbBackend {
+	case "mysql":
+	case "sqlite":
+		dbFlavor = db.SQLite
+	default:
+		slog.Fatalf("unknown db backend '%v'", dbBackend)
+	}
+	if options.PongTimeout > 0 && options.PongTimeout <= options.PingInterval {
+		slog.Fatalf("pong timeout %v must be longer than the ping interval %v", options.PongTimeout, options.PingInterval)
+	}
+
+	if flag.Arg(0) == "migrate" {
+		if err := runMigrate(dbFlavor, dbInfo, flag.Args()[1:], log); err != nil {
+			slog.Fatalf("error running migrations: %v", err)
+		}
+		return
+	}
+
+	db, err := db.NewDBHandler(dbFlavor, dbInfo, log)
 	if err != nil {
 		slog.Fatalf("error creating new DB handler: %v", err)
 	}
 
-	userCache, err := cache.NewCacheHandler(background, cache.RedisCache, cacheInfo, log)
+	if flag.Arg(0) == "role" {
+		if flag.NArg() != 3 {
+			slog.Fatal("usage: role <username> <user|admin>")
+		}
+		name, role := flag.Arg(1), types.Role(flag.Arg(2))
+		if role != types.RoleUser && role != types.RoleAdmin {
+			slog.Fatalf("unknown role '%v'", role)
+		}
+		if err := db.SetUserRole(name, role); err != nil {
+			slog.Fatalf("error setting role: %v", err)
+		}
+		fmt.Printf("user %v is now %v\n", name, role)
+		return
+	}
+
+	if flag.Arg(0) == "export" {
+		if err := runExport(db, flag.Args()[1:]); err != nil {
+			slog.Fatalf("error exporting location history: %v", err)
+		}
+		return
+	}
+
+	cacheFlavor, pubSubFlavor := cache.RedisCache, cache.RedisPubSub
+	switch cacheBackend {
+	case "redis":
+	case "redis-geo":
+		cacheFlavor = cache.RedisGeoCache
+	case "memory":
+		cacheFlavor, pubSubFlavor = cache.InMemoryCache, cache.InMemoryPubSub
+	default:
+		slog.Fatalf("unknown cache backend '%v'", cacheBackend)
+	}
+
+	userCache, err := cache.NewCacheHandler(background, cacheFlavor, cacheInfo, options.Distance, log)
 	if err != nil {
 		slog.Fatalf("error creating new cache handler: %v", err)
 	}
 
-	userPubSub, err := cache.NewPubSubHandler(background, cache.RedisPubSub, pubSubInfo, log)
+	userPubSub, err := cache.NewPubSubHandler(background, pubSubFlavor, pubSubInfo, log)
 	if err != nil {
 		slog.Fatalf("error creating new pubsub handler: %v", err)
 	}
 
-	slog.Infof("Server to run on %v", serverInfo.Addr())
-	handler := server.NewRequestHandler(background, db, userCache, userPubSub, log)
-	if serverInfo.CACertPath != "" && serverInfo.CAKeyPath != "" {
-		if err := http.ListenAndServeTLS(serverInfo.Addr(), serverInfo.CACertPath, serverInfo.CAKeyPath, handler.WithMiddleware()); err != nil {
+	secret := []byte(authSecret)
+	if len(secret) == 0 {
+		slog.Warn("no auth secret configured, generating one. Tokens will not survive a restart")
+		if secret, err = auth.NewRandomSecret(); err != nil {
 			slog.Fatal(err)
 		}
-	} else {
-		if err := http.ListenAndServe(serverInfo.Addr(), handler.WithMiddleware()); err != nil {
-			slog.Fatal(err)
+	}
+	tokens := auth.NewTokenIssuer(secret, tokenTTL)
+
+	slog.Infof("Server to run on %v", serverInfo.Addr())
+	handler := server.NewRequestHandler(background, db, userCache, userPubSub, tokens, options, log)
+	srv := &http.Server{Addr: serverInfo.Addr(), Handler: handler.WithMiddleware()}
+	serveErr := make(chan error, 1)
+	go func() {
+		if serverInfo.CACertPath != "" && serverInfo.CAKeyPath != "" {
+			serveErr <- srv.ListenAndServeTLS(serverInfo.CACertPath, serverInfo.CAKeyPath)
+		} else {
+			serveErr <- srv.ListenAndServe()
 		}
+	}()
+
+	signals, stop := signal.NotifyContext(background, os.Interrupt, syscall.SIGTERM)
+	select {
+	case err := <-serveErr:
+		slog.Fatal(err)
+	case <-signals.Done():
+	}
+	// A second signal stops the server without waiting
+	stop()
+	slog.Infof("Shutting down, draining connections for up to %v", shutdownTimeout)
+
+	if err := shutdown(srv, handler, db, userCache, userPubSub); err != nil {
+		slog.Fatalf("error shutting down: %v", err)
+	}
+	slog.Info("Server stopped")
+}
+
+// shutdown stops the server in order: no new connections are accepted,
+// requests in flight finish, sessions are drained, and only then are the
+// backends they use closed.
+func shutdown(
+	srv *http.Server,
+	handler *server.RequestHandler,
+	userDBHandler db.DBHandler,
+	userCache cache.CacheHandlerable,
+	userPubSub cache.PubSubHandlerable,
+) error {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	var errs []error
+	if err := srv.Shutdown(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("error stopping http server: %v", err))
+	}
+	if err := handler.Shutdown(ctx); err != nil {
+		errs = append(errs, err)
+	}
+	if err := userPubSub.Close(); err != nil {
+		errs = append(errs, fmt.Errorf("error closing pubsub handler: %v", err))
+	}
+	if err := userCache.Close(); err != nil {
+		errs = append(errs, fmt.Errorf("error closing cache handler: %v", err))
+	}
+	if err := userDBHandler.Close(); err != nil {
+		errs = append(errs, fmt.Errorf("error closing db handler: %v", err))
+	}
+	return errors.Join(errs...)
+}
+
+// runExport handles the export subcommand, writing a user's location
+// history to stdout:
+//
+//	export <userID> <gpx|geojson> [from] [to]
+func runExport(userDBHandler db.DBHandler, args []string) error {
+	if len(args) < 2 || len(args) > 4 {
+		return fmt.Errorf("usage: export <userID> <gpx|geojson> [from] [to]")
+	}
+	userID, err := strconv.Atoi(args[0])
+	if err != nil {
+		return fmt.Errorf("invalid user id '%v': %v", args[0], err)
+	}
+	format := args[1]
+	if format != "gpx" && format != "geojson" {
+		return fmt.Errorf("unknown export format '%v'", format)
+	}
+	var from, to string
+	if len(args) > 2 {
+		from = args[2]
+	}
+	if len(args) > 3 {
+		to = args[3]
+	}
+	start, end, err := server.HistoryRange(from, to)
+	if err != nil {
+		return err
+	}
+
+	track, err := server.LocationTrack(userDBHandler, userID, start, end)
+	if err != nil {
+		return err
+	}
+	if track.Truncated {
+		fmt.Fprintf(os.Stderr, "track truncated to %v points, narrow the range to export the rest\n", len(track.Points))
+	}
+
+	if format == "gpx" {
+		return export.WriteGPX(os.Stdout, track)
+	}
+	return export.WriteGeoJSON(os.Stdout, export.TrackFeature(track))
+}
+
+// runMigrate handles the migrate subcommand:
+//
+//	migrate status
+//	migrate up
+//	migrate down [steps]
+//	migrate to <version>
+func runMigrate(dbFlavor db.Flavor, dbInfo db.ConnInfo, args []string, log *zap.Logger) error {
+	conn, err := db.Open(dbFlavor, dbInfo)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	migrator, err := db.NewMigrator(conn, dbFlavor, log)
+	if err != nil {
+		return err
+	}
+
+	command := "status"
+	if len(args) > 0 {
+		command = args[0]
+	}
+
+	switch command {
+	case "status":
+	case "up":
+		err = migrator.Up()
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			if steps, err = strconv.Atoi(args[1]); err != nil {
+				return fmt.Errorf("invalid number of steps '%v': %v", args[1], err)
+			}
+		}
+		err = migrator.Down(steps)
+	case "to":
+		if len(args) < 2 {
+			return fmt.Errorf("migrate to requires a target version")
+		}
+		target, convErr := strconv.Atoi(args[1])
+		if convErr != nil {
+			return fmt.Errorf("invalid target version '%v': %v", args[1], convErr)
+		}
+		err = migrator.MigrateTo(target)
+	default:
+		return fmt.Errorf("unknown migrate command '%v'", command)
+	}
+	if err != nil {
+		return err
+	}
+
+	version, err := migrator.Version()
+	if err != nil {
+		return err
 	}
+	fmt.Printf("schema version %v (latest %v)\n", version, migrator.Latest())
+	return nil
 }
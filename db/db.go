@@ -1,8 +1,11 @@
 package db
 
 import (
+	"database/sql"
+	"errors"
 	"fmt"
 	"nearby-friends/types"
+	"time"
 
 	"go.uber.org/zap"
 )
@@ -12,33 +15,116 @@ type ConnInfo struct {
 	Username string
 	Password string
 	DBName   string
+	// Path is the database file used by file backed flavors like SQLite.
+	Path string
 }
 
 type Flavor int
 
 const (
 	MySQL Flavor = iota
+	SQLite
 )
 
+func (f Flavor) String() string {
+	switch f {
+	case MySQL:
+		return "mysql"
+	case SQLite:
+		return "sqlite"
+	default:
+		return fmt.Sprintf("Flavor(%d)", int(f))
+	}
+}
+
 type DBHandler interface {
 	// User mgmt
-	Login(name string) (*types.User, error)
-	CreateUser(user *types.User) error
+	Login(name, password string) (*types.User, error)
+	CreateUser(user *types.User, password string) error
+	SetUserRole(name string, role types.Role) error
+	GetUserRole(userID int) (types.Role, error)
+
+	// Settings
+	GetUserSettings(userID int) (*types.UserSettings, error)
+	UpdateUserSettings(userID int, settings types.UserSettings) error
+	ListFriendSharing(userID int) ([]types.FriendSharing, error)
+	SetFriendSharing(userID, friendID int, level types.SharingLevel) error
+	RemoveFriendSharing(userID, friendID int) error
+
+	// Location shares
+	CreateLocationShares(userID int, friends []types.User, level types.SharingLevel, expiresAt time.Time) ([]types.LocationShare, error)
+	ListLocationShares(userID int) ([]types.LocationShare, error)
+	ListIncomingLocationShares(userID int) ([]types.LocationShare, error)
+	EndLocationShare(userID, shareID int) (*types.LocationShare, error)
+
+	// Location history
+	AppendLocationHistory(locations []types.UserLocation) error
+	ListLocationHistory(userID int, from, to time.Time, limit int) ([]types.LocationPoint, error)
+	PruneLocationHistory(before time.Time) (int64, error)
 
 	// Friendships
 	ListUserFriends(userID int) ([]types.User, error)
 	ListPossibleFriends(userID int) ([]types.User, error)
-	EstablishFriendship(request types.FriendRequest) error
+	RemoveFriendship(userID, friendID int) error
+
+	// Blocking
+	BlockUser(userID, blockedID int) error
+	UnblockUser(userID, blockedID int) error
+
+	// Friend requests
+	SendFriendRequest(request *types.FriendRequest) error
+	ListIncomingFriendRequests(userID int) ([]types.FriendRequest, error)
+	ListOutgoingFriendRequests(userID int) ([]types.FriendRequest, error)
+	AcceptFriendRequest(userID, requestID int) (*types.FriendRequest, error)
+	DeclineFriendRequest(userID, requestID int) (*types.FriendRequest, error)
+	CancelFriendRequest(userID, requestID int) (*types.FriendRequest, error)
+
+	// Close releases the db connections
+	Close() error
+}
+
+var (
+	ErrInvalidCredentials      = errors.New("invalid username or password")
+	ErrUserExists              = errors.New("username is already taken")
+	ErrUserNotFound            = errors.New("user not found")
+	ErrInvalidFriendRequest    = errors.New("invalid friend request")
+	ErrAlreadyFriends          = errors.New("users are already friends")
+	ErrFriendRequestExists     = errors.New("a pending friend request already exists between these users")
+	ErrFriendRequestNotFound   = errors.New("friend request not found")
+	ErrFriendRequestNotPending = errors.New("friend request is no longer pending")
+	ErrNotFriends              = errors.New("users are not friends")
+	ErrUserBlocked             = errors.New("user is blocked")
+	ErrNotBlocked              = errors.New("user is not blocked")
+	ErrInvalidSettings         = errors.New("invalid settings")
+	ErrSharingRuleNotFound     = errors.New("no sharing level is set for this friend")
+	ErrInvalidLocationShare    = errors.New("invalid location share")
+	ErrLocationShareNotFound   = errors.New("location share not found or already expired")
+)
+
+// Open connects to the database for the given flavor without touching its
+// schema
+func Open(dbFlavor Flavor, dbInfo ConnInfo) (*sql.DB, error) {
+	switch dbFlavor {
+	case MySQL:
+		return NewMySQLDB(dbInfo.Hostname, dbInfo.Username, dbInfo.Password, dbInfo.DBName)
+	case SQLite:
+		return NewSQLiteDB(dbInfo.Path)
+	default:
+		return nil, fmt.Errorf("unhandled db flavor: %v", dbFlavor)
+	}
 }
 
 func NewDBHandler(dbFlavor Flavor, dbInfo ConnInfo, log *zap.Logger) (DBHandler, error) {
+	db, err := Open(dbFlavor, dbInfo)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to db for flavor '%v': %v", dbFlavor, err)
+	}
+
 	switch dbFlavor {
 	case MySQL:
-		db, err := NewMySQLDB(dbInfo.Hostname, dbInfo.Username, dbInfo.Password, dbInfo.DBName)
-		if err != nil {
-			return nil, fmt.Errorf("error connecting to db for flavor '%v': %v", dbFlavor, err)
-		}
 		return NewMySQLDBHandler(db, log)
+	case SQLite:
+		return NewSQLiteDBHandler(db, log)
 	default:
 		return nil, fmt.Errorf("unhandled db flavor: %v", dbFlavor)
 	}
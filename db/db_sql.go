@@ -0,0 +1,938 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"nearby-friends/types"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// sqlStore holds the queries that are portable across the SQL flavors.
+// Flavor handlers embed it so its methods satisfy DBHandler for them.
+type sqlStore struct {
+	db *sql.DB
+	// isDuplicate reports whether err is the flavor's unique violation
+	isDuplicate func(err error) bool
+	log         *zap.Logger
+}
+
+// queryer is satisfied by both *sql.DB and *sql.Tx
+type queryer interface {
+	QueryRow(query string, args ...any) *sql.Row
+	Query(query string, args ...any) (*sql.Rows, error)
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+func now() time.Time {
+	return time.Now().UTC().Truncate(time.Second)
+}
+
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", fmt.Errorf("error hashing password: %v", err)
+	}
+	return string(hash), nil
+}
+
+// dummyPasswordHash is compared against when there is no hash to check the
+// password with, so unknown usernames take as long to reject as wrong
+// passwords and can't be told apart by timing. It is a bcrypt.DefaultCost
+// hash of a password no user has.
+const dummyPasswordHash = "$2a$10$KVzCqj52u/aQeSPPrIeFQeeIkrYMIyyzjxIvm8IHMSLSJhfxZXPfW"
+
+// Login checks the password against the one the user registered with.
+// Users registered before passwords were required cannot log in.
+func (s sqlStore) Login(name, password string) (*types.User, error) {
+	user := types.User{Name: name}
+	var hash sql.NullString
+	err := s.db.QueryRow("SELECT user_id, password_hash, role FROM users WHERE username = ?", name).
+		Scan(&user.ID, &hash, &user.Role)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("unable to get user id for name %v: %v", name, err)
+	}
+	if err != nil || !hash.Valid {
+		bcrypt.CompareHashAndPassword([]byte(dummyPasswordHash), []byte(password))
+		return nil, ErrInvalidCredentials
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(hash.String), []byte(password)); err != nil {
+		return nil, ErrInvalidCredentials
+	}
+	return &user, nil
+}
+
+// SetUserRole changes what the named user is allowed to do
+func (s sqlStore) SetUserRole(name string, role types.Role) error {
+	result, err := s.db.Exec("UPDATE users SET role = ? WHERE username = ?", role, name)
+	if err != nil {
+		return fmt.Errorf("error setting role %v for user %v: %v", role, name, err)
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return fmt.Errorf("%w: %v", ErrUserNotFound, name)
+	}
+	return nil
+}
+
+// GetUserRole reads what the user is currently allowed to do
+func (s sqlStore) GetUserRole(userID int) (types.Role, error) {
+	var role types.Role
+	err := s.db.QueryRow("SELECT role FROM users WHERE user_id = ?", userID).Scan(&role)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", fmt.Errorf("%w: %v", ErrUserNotFound, userID)
+	}
+	if err != nil {
+		return "", fmt.Errorf("error getting role for user %v: %v", userID, err)
+	}
+	return role, nil
+}
+
+// existingUser resolves a duplicate registration. Registering again with the
+// same credentials returns the existing user, otherwise the name is taken.
+func (s sqlStore) existingUser(user *types.User, password string) error {
+	existing, err := s.Login(user.Name, password)
+	if errors.Is(err, ErrInvalidCredentials) {
+		return ErrUserExists
+	}
+	if err != nil {
+		return err
+	}
+	user.ID, user.Role = existing.ID, existing.Role
+	return nil
+}
+
+// CreateUser is idempotent for the same credentials
+func (s sqlStore) CreateUser(user *types.User, password string) error {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	result, err := s.db.Exec("INSERT INTO users (username, password_hash) VALUES (?, ?)", user.Name, hash)
+	if err != nil {
+		if s.isDuplicate(err) {
+			s.log.Sugar().Debugf("user with name '%v' already exists", user.Name)
+			return s.existingUser(user, password)
+		}
+		return err
+	}
+
+	userID, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	user.ID, user.Role = int(userID), types.RoleUser
+	return nil
+}
+
+func (s sqlStore) GetUserIDByUsername(username string) (int, error) {
+	user := types.User{Name: username}
+	if err := resolveUserID(s.db, &user); err != nil {
+		return 0, err
+	}
+	return user.ID, nil
+}
+
+// ListPossibleFriends lists the users that are not this user, are not already
+// firends with this user and have not been blocked by or blocked this user
+func (s sqlStore) ListPossibleFriends(userID int) ([]types.User, error) {
+	query := `
+		SELECT u.user_id, u.username
+		FROM users u
+		WHERE u.user_id != ? AND u.user_id NOT IN (
+			SELECT f.friend
+			FROM friendships f
+			WHERE f.user = ?
+		) AND u.user_id NOT IN (
+			SELECT b.blocked
+			FROM blocks b
+			WHERE b.blocker = ?
+		) AND u.user_id NOT IN (
+			SELECT b.blocker
+			FROM blocks b
+			WHERE b.blocked = ?
+		)
+	`
+
+	rows, err := s.db.Query(query, userID, userID, userID, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []types.User
+	for rows.Next() {
+		var user types.User
+		err := rows.Scan(&user.ID, &user.Name)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+// UserCount return the number of users registered to the system
+// This is just a convinience for us to determine if a user is friends with all
+// other users in the system. Until we start to scale we can use this to determine
+// if a locust should stop running a task.
+func (s sqlStore) UserCount() (int, error) {
+	query := `SELECT COUNT(*) FROM users;`
+	var userCount int
+	if err := s.db.QueryRow(query).Scan(&userCount); err != nil {
+		return 0, err
+	}
+	return userCount, nil
+}
+
+// ListUserFriends queries to get friends of a specific user
+func (s sqlStore) ListUserFriends(userID int) ([]types.User, error) {
+	query := `
+		SELECT u.user_id, u.username
+		FROM friendships f
+		JOIN users u on f.friend = u.user_id
+		WHERE f.user = ?
+	`
+
+	rows, err := s.db.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var friends []types.User
+
+	for rows.Next() {
+		var friend types.User
+		err := rows.Scan(&friend.ID, &friend.Name)
+		if err != nil {
+			return nil, err
+		}
+		friends = append(friends, friend)
+	}
+
+	return friends, rows.Err()
+}
+
+// resolveUserID fills in the ID of a user only known by name
+func resolveUserID(q queryer, user *types.User) error {
+	if user.ID != 0 {
+		return nil
+	}
+	err := q.QueryRow("SELECT user_id FROM users WHERE username = ?", user.Name).Scan(&user.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("%w: %v", ErrUserNotFound, user.Name)
+	}
+	if err != nil {
+		return fmt.Errorf("error looking up userID for username %v: %v", user.Name, err)
+	}
+	return nil
+}
+
+func areFriends(q queryer, userID, friendID int) (bool, error) {
+	var exists int
+	err := q.QueryRow("SELECT 1 FROM friendships WHERE user = ? AND friend = ?", userID, friendID).Scan(&exists)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func isBlocked(q queryer, userID, otherID int) (bool, error) {
+	var exists int
+	err := q.QueryRow(`
+		SELECT 1
+		FROM blocks
+		WHERE (blocker = ? AND blocked = ?) OR (blocker = ? AND blocked = ?)
+	`, userID, otherID, otherID, userID).Scan(&exists)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+const friendRequestColumns = `
+	fr.request_id, fr.status, fr.created_at, fr.updated_at,
+	requester.user_id, requester.username,
+	recipient.user_id, recipient.username
+`
+
+const friendRequestJoins = `
+	JOIN users requester ON fr.requester = requester.user_id
+	JOIN users recipient ON fr.recipient = recipient.user_id
+`
+
+func scanFriendRequest(row interface{ Scan(...any) error }) (types.FriendRequest, error) {
+	var request types.FriendRequest
+	err := row.Scan(
+		&request.ID, &request.Status, &request.CreatedAt, &request.UpdatedAt,
+		&request.User.ID, &request.User.Name,
+		&request.Friend.ID, &request.Friend.Name,
+	)
+	return request, err
+}
+
+// SendFriendRequest records a pending request from request.User to
+// request.Friend. No friendship exists until the request is accepted.
+func (s sqlStore) SendFriendRequest(request *types.FriendRequest) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := resolveUserID(tx, &request.User); err != nil {
+		return err
+	}
+	if err := resolveUserID(tx, &request.Friend); err != nil {
+		return err
+	}
+	if request.User.ID == request.Friend.ID {
+		return fmt.Errorf("%w: user %v cannot befriend themselves", ErrInvalidFriendRequest, request.User.ID)
+	}
+
+	blocked, err := isBlocked(tx, request.User.ID, request.Friend.ID)
+	if err != nil {
+		return err
+	}
+	if blocked {
+		return ErrUserBlocked
+	}
+
+	friends, err := areFriends(tx, request.User.ID, request.Friend.ID)
+	if err != nil {
+		return err
+	}
+	if friends {
+		return ErrAlreadyFriends
+	}
+
+	// A pending request in either direction blocks a new one
+	var pendingID int
+	err = tx.QueryRow(`
+		SELECT request_id
+		FROM friend_requests
+		WHERE status = ? AND (
+			(requester = ? AND recipient = ?) OR (requester = ? AND recipient = ?)
+		)
+	`, types.FriendRequestPending,
+		request.User.ID, request.Friend.ID, request.Friend.ID, request.User.ID).Scan(&pendingID)
+	if err == nil {
+		return fmt.Errorf("%w: request %v", ErrFriendRequestExists, pendingID)
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	createdAt := now()
+	result, err := tx.Exec(`
+		INSERT INTO friend_requests (requester, recipient, status, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?)
+	`, request.User.ID, request.Friend.ID, types.FriendRequestPending, createdAt, createdAt)
+	if err != nil {
+		return fmt.Errorf("error creating friend request between users: [%v] -> [%v]: %v",
+			request.User, request.Friend, err)
+	}
+	requestID, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	created, err := scanFriendRequest(tx.QueryRow(`SELECT `+friendRequestColumns+`
+		FROM friend_requests fr `+friendRequestJoins+`
+		WHERE fr.request_id = ?
+	`, requestID))
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	*request = created
+	return nil
+}
+
+func (s sqlStore) listPendingFriendRequests(column string, userID int) ([]types.FriendRequest, error) {
+	query := `SELECT ` + friendRequestColumns + `
+		FROM friend_requests fr ` + friendRequestJoins + `
+		WHERE fr.` + column + ` = ? AND fr.status = ?
+		ORDER BY fr.created_at, fr.request_id
+	`
+
+	rows, err := s.db.Query(query, userID, types.FriendRequestPending)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var requests []types.FriendRequest
+	for rows.Next() {
+		request, err := scanFriendRequest(rows)
+		if err != nil {
+			return nil, err
+		}
+		requests = append(requests, request)
+	}
+	return requests, rows.Err()
+}
+
+// ListIncomingFriendRequests lists pending requests sent to this user
+func (s sqlStore) ListIncomingFriendRequests(userID int) ([]types.FriendRequest, error) {
+	return s.listPendingFriendRequests("recipient", userID)
+}
+
+// ListOutgoingFriendRequests lists pending requests this user has sent
+func (s sqlStore) ListOutgoingFriendRequests(userID int) ([]types.FriendRequest, error) {
+	return s.listPendingFriendRequests("requester", userID)
+}
+
+// AcceptFriendRequest accepts a pending request sent to userID and
+// establishes the bi-directional friendship.
+func (s sqlStore) AcceptFriendRequest(userID, requestID int) (*types.FriendRequest, error) {
+	return s.resolveFriendRequest(userID, requestID, types.FriendRequestAccepted)
+}
+
+// DeclineFriendRequest declines a pending request sent to userID
+func (s sqlStore) DeclineFriendRequest(userID, requestID int) (*types.FriendRequest, error) {
+	return s.resolveFriendRequest(userID, requestID, types.FriendRequestDeclined)
+}
+
+// CancelFriendRequest withdraws a pending request sent by userID
+func (s sqlStore) CancelFriendRequest(userID, requestID int) (*types.FriendRequest, error) {
+	return s.resolveFriendRequest(userID, requestID, types.FriendRequestCancelled)
+}
+
+func (s sqlStore) resolveFriendRequest(
+	userID, requestID int,
+	status types.FriendRequestStatus,
+) (*types.FriendRequest, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	request, err := scanFriendRequest(tx.QueryRow(`SELECT `+friendRequestColumns+`
+		FROM friend_requests fr `+friendRequestJoins+`
+		WHERE fr.request_id = ?
+	`, requestID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrFriendRequestNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Only the recipient can answer a request and only the requester can
+	// cancel it. Anyone else is told it doesn't exist.
+	actor := request.Friend.ID
+	if status == types.FriendRequestCancelled {
+		actor = request.User.ID
+	}
+	if actor != userID {
+		return nil, ErrFriendRequestNotFound
+	}
+	if request.Status != types.FriendRequestPending {
+		return nil, fmt.Errorf("%w: request %v is %v", ErrFriendRequestNotPending, request.ID, request.Status)
+	}
+
+	request.Status, request.UpdatedAt = status, now()
+	_, err = tx.Exec("UPDATE friend_requests SET status = ?, updated_at = ? WHERE request_id = ?",
+		request.Status, request.UpdatedAt, request.ID)
+	if err != nil {
+		return nil, fmt.Errorf("error updating friend request %v: %v", request.ID, err)
+	}
+
+	if status == types.FriendRequestAccepted {
+		if err := establishFriendship(tx, request.User, request.Friend); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &request, nil
+}
+
+// establishFriendship inserts the bi-directional friendship records, leaving
+// any that already exist in place
+func establishFriendship(q queryer, user, friend types.User) error {
+	for _, pair := range [][2]int{{user.ID, friend.ID}, {friend.ID, user.ID}} {
+		exists, err := areFriends(q, pair[0], pair[1])
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		if _, err := q.Exec("INSERT INTO friendships (user, friend) VALUES (?, ?)", pair[0], pair[1]); err != nil {
+			return fmt.Errorf("error creating a friendship between users: [%v] <-> [%v]: %v ",
+				user, friend, err)
+		}
+	}
+	return nil
+}
+
+// RemoveFriendship deletes the bi-directional friendship between the users
+func (s sqlStore) RemoveFriendship(userID, friendID int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		DELETE FROM friendships
+		WHERE (user = ? AND friend = ?) OR (user = ? AND friend = ?)
+	`, userID, friendID, friendID, userID)
+	if err != nil {
+		return fmt.Errorf("error removing friendship between users %v and %v: %v", userID, friendID, err)
+	}
+	removed, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if removed == 0 {
+		return ErrNotFriends
+	}
+	if err := removeFriendSharing(tx, userID, friendID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// BlockUser stops blockedID from interacting with userID. Any friendship
+// between them is removed and pending requests between them are closed out.
+// Blocking a user that is already blocked is a no-op.
+func (s sqlStore) BlockUser(userID, blockedID int) error {
+	if userID == blockedID {
+		return fmt.Errorf("%w: user %v cannot block themselves", ErrInvalidFriendRequest, userID)
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var exists int
+	err = tx.QueryRow("SELECT 1 FROM blocks WHERE blocker = ? AND blocked = ?", userID, blockedID).Scan(&exists)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		_, err = tx.Exec("INSERT INTO blocks (blocker, blocked, created_at) VALUES (?, ?, ?)",
+			userID, blockedID, now())
+		if err != nil {
+			return fmt.Errorf("error blocking user %v for user %v: %v", blockedID, userID, err)
+		}
+	case err != nil:
+		return err
+	}
+
+	_, err = tx.Exec(`
+		DELETE FROM friendships
+		WHERE (user = ? AND friend = ?) OR (user = ? AND friend = ?)
+	`, userID, blockedID, blockedID, userID)
+	if err != nil {
+		return fmt.Errorf("error removing friendship between users %v and %v: %v", userID, blockedID, err)
+	}
+	if err := removeFriendSharing(tx, userID, blockedID); err != nil {
+		return err
+	}
+
+	// Requests the blocker sent are cancelled, requests they received are declined
+	for _, update := range []struct {
+		status               types.FriendRequestStatus
+		requester, recipient int
+	}{
+		{types.FriendRequestCancelled, userID, blockedID},
+		{types.FriendRequestDeclined, blockedID, userID},
+	} {
+		_, err = tx.Exec(`
+			UPDATE friend_requests
+			SET status = ?, updated_at = ?
+			WHERE requester = ? AND recipient = ? AND status = ?
+		`, update.status, now(), update.requester, update.recipient, types.FriendRequestPending)
+		if err != nil {
+			return fmt.Errorf("error closing friend requests between users %v and %v: %v", userID, blockedID, err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// UnblockUser lifts a block userID placed on blockedID. The friendship is not
+// restored.
+func (s sqlStore) UnblockUser(userID, blockedID int) error {
+	result, err := s.db.Exec("DELETE FROM blocks WHERE blocker = ? AND blocked = ?", userID, blockedID)
+	if err != nil {
+		return fmt.Errorf("error unblocking user %v for user %v: %v", blockedID, userID, err)
+	}
+	removed, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if removed == 0 {
+		return ErrNotBlocked
+	}
+	return nil
+}
+
+// GetUserSettings returns the user's saved settings, or the defaults if they
+// never saved any
+func (s sqlStore) GetUserSettings(userID int) (*types.UserSettings, error) {
+	settings := types.DefaultUserSettings()
+	err := s.db.QueryRow(`
+		SELECT radius, unit, discoverable, sharing, ghost
+		FROM user_settings
+		WHERE user_id = ?
+	`, userID).Scan(&settings.Radius, &settings.Unit, &settings.Discoverable, &settings.Sharing, &settings.Ghost)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("error getting settings for user %v: %v", userID, err)
+	}
+	return &settings, nil
+}
+
+func validateSettings(settings types.UserSettings) error {
+	if !settings.Unit.Valid() {
+		return fmt.Errorf("%w: unknown unit '%v'", ErrInvalidSettings, settings.Unit)
+	}
+	if !(settings.Radius > 0) || math.IsInf(settings.Radius, 0) {
+		return fmt.Errorf("%w: radius must be a positive number", ErrInvalidSettings)
+	}
+	if !settings.Sharing.Valid() {
+		return fmt.Errorf("%w: unknown sharing level '%v'", ErrInvalidSettings, settings.Sharing)
+	}
+	return nil
+}
+
+// ListFriendSharing returns the friends the user overrode their default
+// sharing level for
+func (s sqlStore) ListFriendSharing(userID int) ([]types.FriendSharing, error) {
+	rows, err := s.db.Query(`
+		SELECT u.user_id, u.username, fs.level
+		FROM friend_sharing fs
+		JOIN users u ON fs.friend_id = u.user_id
+		WHERE fs.user_id = ?
+	`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("error listing friend sharing for user %v: %v", userID, err)
+	}
+	defer rows.Close()
+
+	rules := []types.FriendSharing{}
+	for rows.Next() {
+		var rule types.FriendSharing
+		if err := rows.Scan(&rule.Friend.ID, &rule.Friend.Name, &rule.Level); err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, rows.Err()
+}
+
+// SetFriendSharing overrides how much of the user's location the friend sees
+func (s sqlStore) SetFriendSharing(userID, friendID int, level types.SharingLevel) error {
+	if !level.Valid() {
+		return fmt.Errorf("%w: unknown sharing level '%v'", ErrInvalidSettings, level)
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	friends, err := areFriends(tx, userID, friendID)
+	if err != nil {
+		return err
+	}
+	if !friends {
+		return ErrNotFriends
+	}
+
+	if _, err := tx.Exec("DELETE FROM friend_sharing WHERE user_id = ? AND friend_id = ?", userID, friendID); err != nil {
+		return fmt.Errorf("error replacing sharing level of user %v for friend %v: %v", userID, friendID, err)
+	}
+	_, err = tx.Exec("INSERT INTO friend_sharing (user_id, friend_id, level) VALUES (?, ?, ?)",
+		userID, friendID, level)
+	if err != nil {
+		return fmt.Errorf("error setting sharing level of user %v for friend %v: %v", userID, friendID, err)
+	}
+	return tx.Commit()
+}
+
+// RemoveFriendSharing puts the friend back on the user's default sharing
+// level
+func (s sqlStore) RemoveFriendSharing(userID, friendID int) error {
+	result, err := s.db.Exec("DELETE FROM friend_sharing WHERE user_id = ? AND friend_id = ?", userID, friendID)
+	if err != nil {
+		return fmt.Errorf("error removing sharing level of user %v for friend %v: %v", userID, friendID, err)
+	}
+	removed, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if removed == 0 {
+		return ErrSharingRuleNotFound
+	}
+	return nil
+}
+
+// removeFriendSharing drops the sharing rules and location shares two users
+// hold on each other once they are no longer friends
+func removeFriendSharing(q queryer, userID, friendID int) error {
+	for _, table := range []string{"friend_sharing", "location_shares"} {
+		_, err := q.Exec(`
+			DELETE FROM `+table+`
+			WHERE (user_id = ? AND friend_id = ?) OR (user_id = ? AND friend_id = ?)
+		`, userID, friendID, friendID, userID)
+		if err != nil {
+			return fmt.Errorf("error removing %v between users %v and %v: %v", table, userID, friendID, err)
+		}
+	}
+	return nil
+}
+
+const locationShareColumns = `
+	ls.share_id, ls.level, ls.created_at, ls.expires_at,
+	sharer.user_id, sharer.username,
+	viewer.user_id, viewer.username
+`
+
+const locationShareJoins = `
+	JOIN users sharer ON ls.user_id = sharer.user_id
+	JOIN users viewer ON ls.friend_id = viewer.user_id
+`
+
+func scanLocationShare(row interface{ Scan(...any) error }) (types.LocationShare, error) {
+	var share types.LocationShare
+	err := row.Scan(
+		&share.ID, &share.Level, &share.CreatedAt, &share.ExpiresAt,
+		&share.User.ID, &share.User.Name,
+		&share.Friend.ID, &share.Friend.Name,
+	)
+	return share, err
+}
+
+// CreateLocationShares lets each of the friends see the user's location at
+// level until expiresAt. Either every share is created or none are.
+func (s sqlStore) CreateLocationShares(
+	userID int,
+	friends []types.User,
+	level types.SharingLevel,
+	expiresAt time.Time,
+) ([]types.LocationShare, error) {
+	if len(friends) == 0 {
+		return nil, fmt.Errorf("%w: no friends to share with", ErrInvalidLocationShare)
+	}
+	if level == "" {
+		level = types.SharingPrecise
+	}
+	if !level.Valid() || level == types.SharingOff {
+		return nil, fmt.Errorf("%w: cannot share at level '%v'", ErrInvalidLocationShare, level)
+	}
+	createdAt, expiresAt := now(), expiresAt.UTC()
+	if !expiresAt.After(createdAt) {
+		return nil, fmt.Errorf("%w: share would already be expired", ErrInvalidLocationShare)
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	shares := []types.LocationShare{}
+	for _, friend := range friends {
+		if err := resolveUserID(tx, &friend); err != nil {
+			return nil, err
+		}
+		isFriend, err := areFriends(tx, userID, friend.ID)
+		if err != nil {
+			return nil, err
+		}
+		if !isFriend {
+			return nil, fmt.Errorf("%w: user %v", ErrNotFriends, friend.ID)
+		}
+
+		result, err := tx.Exec(`
+			INSERT INTO location_shares (user_id, friend_id, level, created_at, expires_at)
+			VALUES (?, ?, ?, ?, ?)
+		`, userID, friend.ID, level, createdAt, expiresAt)
+		if err != nil {
+			return nil, fmt.Errorf("error sharing location of user %v with user %v: %v", userID, friend.ID, err)
+		}
+		shareID, err := result.LastInsertId()
+		if err != nil {
+			return nil, err
+		}
+
+		share, err := scanLocationShare(tx.QueryRow(`
+			SELECT `+locationShareColumns+`
+			FROM location_shares ls
+			`+locationShareJoins+`
+			WHERE ls.share_id = ?
+		`, shareID))
+		if err != nil {
+			return nil, fmt.Errorf("error reading back location share %v: %v", shareID, err)
+		}
+		shares = append(shares, share)
+	}
+	return shares, tx.Commit()
+}
+
+// ListLocationShares returns the user's active shares with friends
+func (s sqlStore) ListLocationShares(userID int) ([]types.LocationShare, error) {
+	return s.listActiveLocationShares("ls.user_id", userID)
+}
+
+// ListIncomingLocationShares returns the active shares friends hold with
+// the user
+func (s sqlStore) ListIncomingLocationShares(userID int) ([]types.LocationShare, error) {
+	return s.listActiveLocationShares("ls.friend_id", userID)
+}
+
+func (s sqlStore) listActiveLocationShares(column string, userID int) ([]types.LocationShare, error) {
+	rows, err := s.db.Query(`
+		SELECT `+locationShareColumns+`
+		FROM location_shares ls
+		`+locationShareJoins+`
+		WHERE `+column+` = ? AND ls.expires_at > ?
+		ORDER BY ls.expires_at
+	`, userID, now())
+	if err != nil {
+		return nil, fmt.Errorf("error listing location shares for user %v: %v", userID, err)
+	}
+	defer rows.Close()
+
+	shares := []types.LocationShare{}
+	for rows.Next() {
+		share, err := scanLocationShare(rows)
+		if err != nil {
+			return nil, err
+		}
+		shares = append(shares, share)
+	}
+	return shares, rows.Err()
+}
+
+// EndLocationShare expires one of the user's active shares early, returning
+// the ended share
+func (s sqlStore) EndLocationShare(userID, shareID int) (*types.LocationShare, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	endedAt := now()
+	result, err := tx.Exec(`
+		UPDATE location_shares
+		SET expires_at = ?
+		WHERE share_id = ? AND user_id = ? AND expires_at > ?
+	`, endedAt, shareID, userID, endedAt)
+	if err != nil {
+		return nil, fmt.Errorf("error ending location share %v for user %v: %v", shareID, userID, err)
+	}
+	ended, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if ended == 0 {
+		return nil, ErrLocationShareNotFound
+	}
+
+	share, err := scanLocationShare(tx.QueryRow(`
+		SELECT `+locationShareColumns+`
+		FROM location_shares ls
+		`+locationShareJoins+`
+		WHERE ls.share_id = ?
+	`, shareID))
+	if err != nil {
+		return nil, fmt.Errorf("error reading back location share %v: %v", shareID, err)
+	}
+	return &share, tx.Commit()
+}
+
+// AppendLocationHistory records the locations, stamped with their
+// LastUpdateTime, in one transaction
+func (s sqlStore) AppendLocationHistory(locations []types.UserLocation) error {
+	if len(locations) == 0 {
+		return nil
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`
+		INSERT INTO location_history (user_id, latitude, longitude, recorded_at)
+		VALUES (?, ?, ?, ?)
+	`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, location := range locations {
+		recordedAt := location.LastUpdateTime.UTC().Truncate(time.Millisecond)
+		if _, err := stmt.Exec(location.ID, location.Latitude, location.Longitude, recordedAt); err != nil {
+			return fmt.Errorf("error recording location history for user %v: %v", location.ID, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// ListLocationHistory returns up to limit of the user's locations recorded
+// in [from, to), oldest first
+func (s sqlStore) ListLocationHistory(userID int, from, to time.Time, limit int) ([]types.LocationPoint, error) {
+	rows, err := s.db.Query(`
+		SELECT latitude, longitude, recorded_at
+		FROM location_history
+		WHERE user_id = ? AND recorded_at >= ? AND recorded_at < ?
+		ORDER BY recorded_at, history_id
+		LIMIT ?
+	`, userID, from.UTC(), to.UTC(), limit)
+	if err != nil {
+		return nil, fmt.Errorf("error listing location history for user %v: %v", userID, err)
+	}
+	defer rows.Close()
+
+	points := []types.LocationPoint{}
+	for rows.Next() {
+		var point types.LocationPoint
+		if err := rows.Scan(&point.Latitude, &point.Longitude, &point.RecordedAt); err != nil {
+			return nil, err
+		}
+		points = append(points, point)
+	}
+	return points, rows.Err()
+}
+
+// PruneLocationHistory deletes every location recorded before the cutoff,
+// returning how many were deleted
+func (s sqlStore) PruneLocationHistory(before time.Time) (int64, error) {
+	result, err := s.db.Exec(`DELETE FROM location_history WHERE recorded_at < ?`, before.UTC())
+	if err != nil {
+		return 0, fmt.Errorf("error pruning location history: %v", err)
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,270 @@
+package db
+
+import (
+	"errors"
+	"nearby-friends/types"
+	"slices"
+	"testing"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// newTestDB runs the SQL store on an in-memory SQLite database migrated to
+// the latest schema
+func newTestDB(t *testing.T) DBHandler {
+	t.Helper()
+	dbHandler, err := NewDBHandler(SQLite, ConnInfo{Path: ":memory:"}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { dbHandler.Close() })
+	return dbHandler
+}
+
+func createTestUser(t *testing.T, dbHandler DBHandler, name string) types.User {
+	t.Helper()
+	user := types.User{Name: name}
+	if err := dbHandler.CreateUser(&user, "password"); err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+func befriendTestUsers(t *testing.T, dbHandler DBHandler, user, friend types.User) {
+	t.Helper()
+	request := types.FriendRequest{User: user, Friend: friend}
+	if err := dbHandler.SendFriendRequest(&request); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dbHandler.AcceptFriendRequest(friend.ID, request.ID); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func userIDs(users []types.User) []int {
+	ids := make([]int, 0, len(users))
+	for _, user := range users {
+		ids = append(ids, user.ID)
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+func TestCreateUser(t *testing.T) {
+	dbHandler := newTestDB(t)
+	alice := createTestUser(t, dbHandler, "alice")
+	if alice.ID == 0 || alice.Role != types.RoleUser {
+		t.Fatalf("created %+v, want an ID and the user role", alice)
+	}
+
+	// Registering again with the same credentials returns the same user
+	again := types.User{Name: "alice"}
+	if err := dbHandler.CreateUser(&again, "password"); err != nil {
+		t.Fatalf("registering again with the same credentials: %v", err)
+	}
+	if again.ID != alice.ID {
+		t.Fatalf("registering again returned user %v, want %v", again.ID, alice.ID)
+	}
+
+	taken := types.User{Name: "alice"}
+	if err := dbHandler.CreateUser(&taken, "other password"); !errors.Is(err, ErrUserExists) {
+		t.Fatalf("got %v registering a taken name, want %v", err, ErrUserExists)
+	}
+}
+
+func TestLogin(t *testing.T) {
+	dbHandler := newTestDB(t)
+	alice := createTestUser(t, dbHandler, "alice")
+
+	user, err := dbHandler.Login("alice", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.ID != alice.ID || user.Name != "alice" {
+		t.Fatalf("logged in as %+v, want %+v", user, alice)
+	}
+	for _, tc := range []struct{ name, password string }{
+		{"alice", "wrong"},
+		{"alice", ""},
+		{"nobody", "password"},
+	} {
+		if _, err := dbHandler.Login(tc.name, tc.password); !errors.Is(err, ErrInvalidCredentials) {
+			t.Errorf("got %v logging in as %q with %q, want %v", err, tc.name, tc.password, ErrInvalidCredentials)
+		}
+	}
+}
+
+func TestUnknownUserLoginCostsAsMuch(t *testing.T) {
+	// Unknown usernames are checked against the dummy hash, which has to
+	// be as expensive to compare as a registered password
+	cost, err := bcrypt.Cost([]byte(dummyPasswordHash))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := hashPassword("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	registered, err := bcrypt.Cost([]byte(hash))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cost != registered {
+		t.Fatalf("dummy hash has cost %v, registered passwords %v", cost, registered)
+	}
+	if bcrypt.CompareHashAndPassword([]byte(dummyPasswordHash), []byte("password")) == nil {
+		t.Fatal("the dummy hash matches a password")
+	}
+}
+
+func TestUserNotFound(t *testing.T) {
+	dbHandler := newTestDB(t)
+	alice := createTestUser(t, dbHandler, "alice")
+
+	if err := dbHandler.SetUserRole("nobody", types.RoleAdmin); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("got %v setting the role of an unknown user, want %v", err, ErrUserNotFound)
+	}
+	if _, err := dbHandler.GetUserRole(alice.ID + 100); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("got %v getting the role of an unknown user, want %v", err, ErrUserNotFound)
+	}
+	request := types.FriendRequest{User: alice, Friend: types.User{Name: "nobody"}}
+	if err := dbHandler.SendFriendRequest(&request); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("got %v befriending an unknown user, want %v", err, ErrUserNotFound)
+	}
+}
+
+func TestListFriends(t *testing.T) {
+	dbHandler := newTestDB(t)
+	alice := createTestUser(t, dbHandler, "alice")
+	bob := createTestUser(t, dbHandler, "bob")
+	carol := createTestUser(t, dbHandler, "carol")
+	dave := createTestUser(t, dbHandler, "dave")
+	befriendTestUsers(t, dbHandler, alice, bob)
+	befriendTestUsers(t, dbHandler, carol, alice)
+
+	friends, err := dbHandler.ListUserFriends(alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := userIDs(friends), userIDs([]types.User{bob, carol}); !slices.Equal(got, want) {
+		t.Fatalf("alice has friends %v, want %v", got, want)
+	}
+	friends, err = dbHandler.ListUserFriends(bob.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := userIDs(friends), userIDs([]types.User{alice}); !slices.Equal(got, want) {
+		t.Fatalf("bob has friends %v, want %v", got, want)
+	}
+
+	possible, err := dbHandler.ListPossibleFriends(alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := userIDs(possible), userIDs([]types.User{dave}); !slices.Equal(got, want) {
+		t.Fatalf("alice can befriend %v, want %v", got, want)
+	}
+	possible, err = dbHandler.ListPossibleFriends(bob.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := userIDs(possible), userIDs([]types.User{carol, dave}); !slices.Equal(got, want) {
+		t.Fatalf("bob can befriend %v, want %v", got, want)
+	}
+}
+
+func TestRemoveFriendship(t *testing.T) {
+	dbHandler := newTestDB(t)
+	alice := createTestUser(t, dbHandler, "alice")
+	bob := createTestUser(t, dbHandler, "bob")
+	befriendTestUsers(t, dbHandler, alice, bob)
+
+	if err := dbHandler.RemoveFriendship(bob.ID, alice.ID); err != nil {
+		t.Fatal(err)
+	}
+	for _, user := range []types.User{alice, bob} {
+		friends, err := dbHandler.ListUserFriends(user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(friends) != 0 {
+			t.Fatalf("user %v still has friends %v", user.ID, userIDs(friends))
+		}
+	}
+	if err := dbHandler.RemoveFriendship(alice.ID, bob.ID); !errors.Is(err, ErrNotFriends) {
+		t.Fatalf("got %v unfriending again, want %v", err, ErrNotFriends)
+	}
+}
+
+func TestBlockUser(t *testing.T) {
+	dbHandler := newTestDB(t)
+	alice := createTestUser(t, dbHandler, "alice")
+	bob := createTestUser(t, dbHandler, "bob")
+	carol := createTestUser(t, dbHandler, "carol")
+	befriendTestUsers(t, dbHandler, alice, bob)
+	pending := types.FriendRequest{User: carol, Friend: alice}
+	if err := dbHandler.SendFriendRequest(&pending); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := dbHandler.BlockUser(alice.ID, alice.ID); !errors.Is(err, ErrInvalidFriendRequest) {
+		t.Fatalf("got %v blocking oneself, want %v", err, ErrInvalidFriendRequest)
+	}
+	for _, blocked := range []types.User{bob, carol} {
+		if err := dbHandler.BlockUser(alice.ID, blocked.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Blocking again is a no-op
+	if err := dbHandler.BlockUser(alice.ID, bob.ID); err != nil {
+		t.Fatalf("blocking again: %v", err)
+	}
+
+	friends, err := dbHandler.ListUserFriends(bob.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(friends) != 0 {
+		t.Fatalf("bob is still friends with %v after being blocked", userIDs(friends))
+	}
+	incoming, err := dbHandler.ListIncomingFriendRequests(alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(incoming) != 0 {
+		t.Fatalf("alice still has %v pending requests from the user she blocked", len(incoming))
+	}
+	// Blocks hide users both ways and stop new requests both ways
+	for _, user := range []types.User{alice, bob} {
+		possible, err := dbHandler.ListPossibleFriends(user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if slices.Contains(userIDs(possible), alice.ID) || slices.Contains(userIDs(possible), bob.ID) {
+			t.Fatalf("user %v can still befriend %v across the block", user.ID, userIDs(possible))
+		}
+	}
+	request := types.FriendRequest{User: bob, Friend: alice}
+	if err := dbHandler.SendFriendRequest(&request); !errors.Is(err, ErrUserBlocked) {
+		t.Fatalf("got %v befriending the user that blocked bob, want %v", err, ErrUserBlocked)
+	}
+
+	if err := dbHandler.UnblockUser(alice.ID, bob.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := dbHandler.UnblockUser(alice.ID, bob.ID); !errors.Is(err, ErrNotBlocked) {
+		t.Fatalf("got %v unblocking again, want %v", err, ErrNotBlocked)
+	}
+	// The friendship isn't restored, but they can befriend each other again
+	friends, err = dbHandler.ListUserFriends(alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(friends) != 0 {
+		t.Fatalf("alice got friends %v back after unblocking", userIDs(friends))
+	}
+	if err := dbHandler.SendFriendRequest(&request); err != nil {
+		t.Fatalf("befriending after the block was lifted: %v", err)
+	}
+}
@@ -0,0 +1,66 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"nearby-friends/types"
+
+	"go.uber.org/zap"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+type sqliteDBHandler struct {
+	*sql.DB
+	sqlStore
+	log *zap.Logger
+}
+
+var _ DBHandler = &sqliteDBHandler{}
+
+// NewSQLiteDB opens the sqlite database at path. Use ":memory:" for a
+// database that only lives as long as the process.
+func NewSQLiteDB(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite", fmt.Sprintf("file:%v?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)", path))
+	if err != nil {
+		return nil, err
+	}
+	// sqlite only supports a single writer, and every connection to an
+	// in-memory database gets its own copy, so keep the pool to one.
+	db.SetMaxOpenConns(1)
+	return db, nil
+}
+
+func NewSQLiteDBHandler(db *sql.DB, log *zap.Logger) (DBHandler, error) {
+	if err := migrateOnStartup(db, SQLite, log); err != nil {
+		return nil, err
+	}
+
+	store := sqlStore{db: db, isDuplicate: isSQLiteDuplicate, log: log}
+	return &sqliteDBHandler{DB: db, sqlStore: store, log: log}, nil
+}
+
+// isSQLiteDuplicate reports whether err is a unique constraint violation
+func isSQLiteDuplicate(err error) bool {
+	var e *sqlite.Error
+	return errors.As(err, &e) && e.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE
+}
+
+// UpdateUserSettings saves the user's settings, replacing any saved before
+func (dh *sqliteDBHandler) UpdateUserSettings(userID int, settings types.UserSettings) error {
+	if err := validateSettings(settings); err != nil {
+		return err
+	}
+	_, err := dh.Exec(`
+		INSERT INTO user_settings (user_id, radius, unit, discoverable, sharing, ghost)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (user_id) DO UPDATE SET
+			radius = excluded.radius, unit = excluded.unit, discoverable = excluded.discoverable,
+			sharing = excluded.sharing, ghost = excluded.ghost
+	`, userID, settings.Radius, settings.Unit, settings.Discoverable, settings.Sharing, settings.Ghost)
+	if err != nil {
+		return fmt.Errorf("error saving settings for user %v: %v", userID, err)
+	}
+	return nil
+}
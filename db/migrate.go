@@ -0,0 +1,487 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Migrations live under migrations/<flavor>/ and are named
+// <version>_<name>.up.sql and <version>_<name>.down.sql. Versions must be
+// unique per flavor and are applied in ascending order.
+//
+//go:embed migrations
+var migrationFS embed.FS
+
+// ErrSchemaAhead is returned when the database has migrations applied that
+// this binary does not know about. Running against it could corrupt data a
+// newer release depends on.
+var ErrSchemaAhead = errors.New("database schema is ahead of this binary")
+
+type migration struct {
+	version int
+	name    string
+	up      string
+	down    string
+}
+
+// Migrator applies the embedded schema migrations for a single db flavor and
+// records what has been applied in the schema_migrations table.
+//
+// Runs are serialized across every process sharing the database, so
+// replicas starting together never apply the same migration twice.
+type Migrator struct {
+	db         *sql.DB
+	flavor     Flavor
+	migrations []migration
+	log        *zap.Logger
+}
+
+// migrationLockName is the MySQL named lock held while migrating
+const migrationLockName = "nearby_friends_schema_migrations"
+
+// migrationLockTimeout is how long a run waits for another to finish
+const migrationLockTimeout = time.Minute
+
+// migrationRun is a locked migration run. Everything it does goes through
+// conn, the connection holding the lock.
+type migrationRun struct {
+	conn *sql.Conn
+	// atomic runs are one transaction, migrations aren't given their own
+	atomic bool
+}
+
+// execQueryer is satisfied by *sql.DB, *sql.Conn and *sql.Tx
+type execQueryer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+func NewMigrator(db *sql.DB, flavor Flavor, log *zap.Logger) (*Migrator, error) {
+	migrations, err := loadMigrations(flavor)
+	if err != nil {
+		return nil, fmt.Errorf("error loading migrations for flavor '%v': %v", flavor, err)
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INT PRIMARY KEY,
+			name VARCHAR(255) NOT NULL,
+			applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("error creating schema_migrations table: %v", err)
+	}
+
+	return &Migrator{db: db, flavor: flavor, migrations: migrations, log: log}, nil
+}
+
+func loadMigrations(flavor Flavor) ([]migration, error) {
+	dir := path.Join("migrations", flavor.String())
+	entries, err := fs.ReadDir(migrationFS, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int]*migration{}
+	for _, entry := range entries {
+		fileName := entry.Name()
+		var direction string
+		switch {
+		case strings.HasSuffix(fileName, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(fileName, ".down.sql"):
+			direction = "down"
+		default:
+			continue
+		}
+
+		base := strings.TrimSuffix(fileName, "."+direction+".sql")
+		versionStr, name, ok := strings.Cut(base, "_")
+		if !ok {
+			return nil, fmt.Errorf("migration file %v is not named <version>_<name>", fileName)
+		}
+		version, err := strconv.Atoi(versionStr)
+		if err != nil {
+			return nil, fmt.Errorf("migration file %v has a non numeric version: %v", fileName, err)
+		}
+
+		contents, err := fs.ReadFile(migrationFS, path.Join(dir, fileName))
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &migration{version: version, name: name}
+			byVersion[version] = m
+		}
+		if m.name != name {
+			return nil, fmt.Errorf("migration version %v is used by both %v and %v", version, m.name, name)
+		}
+		if direction == "up" {
+			m.up = string(contents)
+		} else {
+			m.down = string(contents)
+		}
+	}
+
+	var migrations []migration
+	for _, m := range byVersion {
+		if m.up == "" {
+			return nil, fmt.Errorf("migration %v_%v is missing an up script", m.version, m.name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].version < migrations[j].version
+	})
+	return migrations, nil
+}
+
+// Latest is the newest migration version this binary knows about
+func (m *Migrator) Latest() int {
+	if len(m.migrations) == 0 {
+		return 0
+	}
+	return m.migrations[len(m.migrations)-1].version
+}
+
+// Version is the newest migration version applied to the database
+func (m *Migrator) Version() (int, error) {
+	return m.version(context.Background(), m.db)
+}
+
+func (m *Migrator) version(ctx context.Context, q execQueryer) (int, error) {
+	var version int
+	err := q.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version)
+	if err != nil {
+		return 0, fmt.Errorf("error reading schema version: %v", err)
+	}
+	return version, nil
+}
+
+// CheckVersion returns ErrSchemaAhead if the database has been migrated past
+// what this binary supports.
+func (m *Migrator) CheckVersion() error {
+	version, err := m.Version()
+	if err != nil {
+		return err
+	}
+	return m.checkVersion(version)
+}
+
+func (m *Migrator) checkVersion(version int) error {
+	if version > m.Latest() {
+		return fmt.Errorf("%w: database is at version %v, binary supports up to %v",
+			ErrSchemaAhead, version, m.Latest())
+	}
+	return nil
+}
+
+// lock starts a migration run once no other process is running one. MySQL
+// takes a named lock. SQLite has none, so the run is a single immediate
+// transaction: it holds the database's write lock throughout and, SQLite DDL
+// being transactional, leaves nothing behind if a migration fails.
+func (m *Migrator) lock(ctx context.Context) (*migrationRun, error) {
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	switch m.flavor {
+	case MySQL:
+		var acquired sql.NullInt64
+		err := conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, ?)",
+			migrationLockName, int(migrationLockTimeout.Seconds())).Scan(&acquired)
+		if err == nil && acquired.Int64 != 1 {
+			err = fmt.Errorf("timed out after %v waiting for another migration run", migrationLockTimeout)
+		}
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("error taking migration lock: %v", err)
+		}
+		return &migrationRun{conn: conn}, nil
+	case SQLite:
+		if _, err := conn.ExecContext(ctx, "BEGIN IMMEDIATE"); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("error taking migration lock: %v", err)
+		}
+		return &migrationRun{conn: conn, atomic: true}, nil
+	default:
+		conn.Close()
+		return nil, fmt.Errorf("unhandled db flavor %v", m.flavor)
+	}
+}
+
+// unlock ends the run, committing an atomic run unless it failed with err
+func (m *Migrator) unlock(ctx context.Context, run *migrationRun, err error) error {
+	defer run.conn.Close()
+	if run.atomic {
+		end := "COMMIT"
+		if err != nil {
+			end = "ROLLBACK"
+		}
+		if _, err := run.conn.ExecContext(ctx, end); err != nil {
+			return fmt.Errorf("error ending migration run: %v", err)
+		}
+		return nil
+	}
+	if _, err := run.conn.ExecContext(ctx, "SELECT RELEASE_LOCK(?)", migrationLockName); err != nil {
+		return fmt.Errorf("error releasing migration lock: %v", err)
+	}
+	return nil
+}
+
+// Up applies every migration that has not yet been applied
+func (m *Migrator) Up() error {
+	return m.MigrateTo(m.Latest())
+}
+
+// Down rolls back the given number of applied migrations
+func (m *Migrator) Down(steps int) error {
+	version, err := m.Version()
+	if err != nil {
+		return err
+	}
+
+	target := 0
+	for i := len(m.migrations) - 1; i >= 0; i-- {
+		if m.migrations[i].version > version {
+			continue
+		}
+		if steps == 0 {
+			target = m.migrations[i].version
+			break
+		}
+		steps--
+	}
+	return m.MigrateTo(target)
+}
+
+// MigrateTo moves the schema up or down until target is the newest applied
+// migration. A target of 0 rolls back every migration.
+func (m *Migrator) MigrateTo(target int) (err error) {
+	if target < 0 || target > m.Latest() {
+		return fmt.Errorf("unknown migration version %v, latest is %v", target, m.Latest())
+	}
+
+	ctx := context.Background()
+	run, err := m.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if unlockErr := m.unlock(ctx, run, err); err == nil {
+			err = unlockErr
+		}
+	}()
+
+	// Read under the lock, another run may have just finished
+	version, err := m.version(ctx, run.conn)
+	if err != nil {
+		return err
+	}
+	if err := m.checkVersion(version); err != nil {
+		return err
+	}
+
+	if target >= version {
+		for _, mig := range m.migrations {
+			if mig.version <= version || mig.version > target {
+				continue
+			}
+			if err := m.apply(ctx, run, mig, "up", mig.up, "INSERT INTO schema_migrations (version, name) VALUES (?, ?)",
+				mig.version, mig.name); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for i := len(m.migrations) - 1; i >= 0; i-- {
+		mig := m.migrations[i]
+		if mig.version > version || mig.version <= target {
+			continue
+		}
+		if mig.down == "" {
+			return fmt.Errorf("migration %v_%v has no down script", mig.version, mig.name)
+		}
+		if err := m.apply(ctx, run, mig, "down", mig.down, "DELETE FROM schema_migrations WHERE version = ?",
+			mig.version); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Migrator) apply(ctx context.Context, run *migrationRun, mig migration, direction, script, record string, args ...any) error {
+	var exec execQueryer = run.conn
+	var tx *sql.Tx
+	if !run.atomic {
+		var err error
+		if tx, err = run.conn.BeginTx(ctx, nil); err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		exec = tx
+	}
+
+	for _, statement := range splitStatements(script) {
+		if _, err := exec.ExecContext(ctx, statement); err != nil {
+			return fmt.Errorf("error running migration %v_%v: %v", mig.version, mig.name, err)
+		}
+	}
+	if _, err := exec.ExecContext(ctx, record, args...); err != nil {
+		return fmt.Errorf("error recording migration %v_%v: %v", mig.version, mig.name, err)
+	}
+	if tx != nil {
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+
+	m.log.Sugar().Infof("migrated %v %v_%v", direction, mig.version, mig.name)
+	return nil
+}
+
+// splitStatements breaks a migration script into individual statements since
+// not every driver accepts multiple statements in a single Exec. Semicolons
+// only end a statement outside of quotes, comments and the BEGIN ... END body
+// of a trigger, procedure or function.
+func splitStatements(script string) []string {
+	var statements []string
+	var statement strings.Builder
+	// depth counts the BEGIN and CASE blocks open in a compound statement
+	depth := 0
+
+	flush := func() {
+		if text := strings.TrimSpace(statement.String()); text != "" {
+			statements = append(statements, text)
+		}
+		statement.Reset()
+		depth = 0
+	}
+
+	for i := 0; i < len(script); i++ {
+		c := script[i]
+		switch {
+		case c == '\'' || c == '"' || c == '`':
+			end := closingQuote(script, i)
+			statement.WriteString(script[i:end])
+			i = end - 1
+		case c == '-' && strings.HasPrefix(script[i:], "--"), c == '#':
+			end := strings.IndexByte(script[i:], '\n')
+			if end < 0 {
+				end = len(script) - i
+			}
+			i += end - 1
+		case c == '/' && strings.HasPrefix(script[i:], "/*"):
+			end := strings.Index(script[i+2:], "*/")
+			if end < 0 {
+				i = len(script)
+			} else {
+				i += end + 3
+			}
+		case isWordByte(c):
+			end := i
+			for end < len(script) && isWordByte(script[end]) {
+				end++
+			}
+			word := strings.ToUpper(script[i:end])
+			if isCompoundStatement(statement.String()) {
+				switch word {
+				case "BEGIN", "CASE":
+					depth++
+				case "END":
+					// END IF, END LOOP and the like close blocks never counted
+					next := strings.ToUpper(nextWord(script[end:]))
+					if next != "IF" && next != "LOOP" && next != "WHILE" && next != "REPEAT" && depth > 0 {
+						depth--
+					}
+				}
+			}
+			statement.WriteString(script[i:end])
+			i = end - 1
+		case c == ';' && depth == 0:
+			flush()
+		default:
+			statement.WriteByte(c)
+		}
+	}
+	flush()
+	return statements
+}
+
+// closingQuote returns the index just past the quote closing the one at
+// start. Quotes are escaped by doubling them or with a backslash.
+func closingQuote(script string, start int) int {
+	quote := script[start]
+	for i := start + 1; i < len(script); i++ {
+		switch script[i] {
+		case '\\':
+			i++
+		case quote:
+			if i+1 < len(script) && script[i+1] == quote {
+				i++
+				continue
+			}
+			return i + 1
+		}
+	}
+	return len(script)
+}
+
+func isWordByte(c byte) bool {
+	return c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func nextWord(s string) string {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return ""
+	}
+	return strings.TrimRight(fields[0], ";")
+}
+
+// isCompoundStatement reports whether the statement started so far creates
+// a trigger, procedure or function, whose body holds its own semicolons
+func isCompoundStatement(statement string) bool {
+	fields := strings.Fields(strings.ToUpper(statement))
+	if len(fields) == 0 || fields[0] != "CREATE" {
+		return false
+	}
+	for _, field := range fields[1:] {
+		switch field {
+		case "TRIGGER", "PROCEDURE", "FUNCTION":
+			return true
+		case "TABLE", "INDEX", "VIEW", "UNIQUE":
+			return false
+		}
+	}
+	return false
+}
+
+// migrateOnStartup brings the schema up to date, refusing to run against a
+// database that is ahead of this binary.
+func migrateOnStartup(db *sql.DB, flavor Flavor, log *zap.Logger) error {
+	migrator, err := NewMigrator(db, flavor, log)
+	if err != nil {
+		return err
+	}
+	if err := migrator.CheckVersion(); err != nil {
+		return err
+	}
+	return migrator.Up()
+}
@@ -0,0 +1,227 @@
+package db
+
+import (
+	"errors"
+	"slices"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestSplitStatements(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		script string
+		want   []string
+	}{
+		{
+			name:   "statements",
+			script: "CREATE TABLE a (id INT);\n\nCREATE TABLE b (id INT);\n",
+			want:   []string{"CREATE TABLE a (id INT)", "CREATE TABLE b (id INT)"},
+		},
+		{
+			name:   "no trailing semicolon",
+			script: "DROP TABLE a; DROP TABLE b",
+			want:   []string{"DROP TABLE a", "DROP TABLE b"},
+		},
+		{
+			name:   "semicolons in quotes",
+			script: `INSERT INTO a VALUES ('x;y', "z;", ` + "`c;d`" + `); SELECT 1`,
+			want:   []string{`INSERT INTO a VALUES ('x;y', "z;", ` + "`c;d`" + `)`, "SELECT 1"},
+		},
+		{
+			name:   "escaped quotes",
+			script: `INSERT INTO a VALUES ('it''s;', 'back\';slash'); SELECT 1`,
+			want:   []string{`INSERT INTO a VALUES ('it''s;', 'back\';slash')`, "SELECT 1"},
+		},
+		{
+			name:   "line comments",
+			script: "-- drop a; and b\nDROP TABLE a; # hash; comment\nDROP TABLE b;",
+			want:   []string{"DROP TABLE a", "DROP TABLE b"},
+		},
+		{
+			name:   "block comments",
+			script: "/* setup; */ CREATE TABLE a (id INT /* key; */); /* trailing; */",
+			want:   []string{"CREATE TABLE a (id INT )"},
+		},
+		{
+			name:   "unterminated block comment",
+			script: "DROP TABLE a; /* never closed; DROP TABLE b;",
+			want:   []string{"DROP TABLE a"},
+		},
+		{
+			name: "trigger body",
+			script: `CREATE TRIGGER touch AFTER UPDATE ON a
+BEGIN
+	UPDATE a SET updated = 1 WHERE id = NEW.id;
+	DELETE FROM b WHERE id = NEW.id;
+END;
+DROP TABLE c;`,
+			want: []string{`CREATE TRIGGER touch AFTER UPDATE ON a
+BEGIN
+	UPDATE a SET updated = 1 WHERE id = NEW.id;
+	DELETE FROM b WHERE id = NEW.id;
+END`, "DROP TABLE c"},
+		},
+		{
+			name: "procedure with nested blocks",
+			script: `CREATE PROCEDURE p()
+BEGIN
+	IF 1 THEN
+		SELECT CASE WHEN 1 THEN 'a;' ELSE 'b' END;
+	END IF;
+	BEGIN
+		SELECT 2;
+	END;
+END;
+SELECT 3;`,
+			want: []string{`CREATE PROCEDURE p()
+BEGIN
+	IF 1 THEN
+		SELECT CASE WHEN 1 THEN 'a;' ELSE 'b' END;
+	END IF;
+	BEGIN
+		SELECT 2;
+	END;
+END`, "SELECT 3"},
+		},
+		{
+			name:   "begin outside a compound statement",
+			script: "BEGIN; SELECT 1; COMMIT;",
+			want:   []string{"BEGIN", "SELECT 1", "COMMIT"},
+		},
+		{
+			name:   "case outside a compound statement",
+			script: "SELECT CASE WHEN 1 THEN 2 END; SELECT 3;",
+			want:   []string{"SELECT CASE WHEN 1 THEN 2 END", "SELECT 3"},
+		},
+		{
+			name:   "only comments",
+			script: "-- nothing to run\n/* at all */",
+			want:   nil,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := splitStatements(tc.script); !slices.Equal(got, tc.want) {
+				t.Fatalf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func newTestMigrator(t *testing.T) *Migrator {
+	t.Helper()
+	db, err := NewSQLiteDB(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	migrator, err := NewMigrator(db, SQLite, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return migrator
+}
+
+func expectVersion(t *testing.T, migrator *Migrator, want int) {
+	t.Helper()
+	version, err := migrator.Version()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != want {
+		t.Fatalf("schema is at version %v, want %v", version, want)
+	}
+}
+
+func hasTable(t *testing.T, migrator *Migrator, table string) bool {
+	t.Helper()
+	var count int
+	err := migrator.db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?", table).Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return count > 0
+}
+
+func TestMigrateRoundTrip(t *testing.T) {
+	migrator := newTestMigrator(t)
+	versions := make([]int, 0, len(migrator.migrations))
+	for _, mig := range migrator.migrations {
+		versions = append(versions, mig.version)
+	}
+	if len(versions) < 3 {
+		t.Fatalf("%v migrations embedded, the round trip needs at least 3", len(versions))
+	}
+	latest := migrator.Latest()
+
+	if err := migrator.Up(); err != nil {
+		t.Fatal(err)
+	}
+	expectVersion(t, migrator, latest)
+	if !hasTable(t, migrator, "location_history") {
+		t.Fatal("latest schema has no location_history table")
+	}
+	// Up again has nothing left to do
+	if err := migrator.Up(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := migrator.Down(2); err != nil {
+		t.Fatal(err)
+	}
+	expectVersion(t, migrator, versions[len(versions)-3])
+	if hasTable(t, migrator, "location_history") {
+		t.Fatal("location_history is still there after rolling its migration back")
+	}
+
+	if err := migrator.MigrateTo(versions[1]); err != nil {
+		t.Fatal(err)
+	}
+	expectVersion(t, migrator, versions[1])
+	if err := migrator.MigrateTo(versions[len(versions)-2]); err != nil {
+		t.Fatal(err)
+	}
+	expectVersion(t, migrator, versions[len(versions)-2])
+
+	if err := migrator.MigrateTo(0); err != nil {
+		t.Fatal(err)
+	}
+	expectVersion(t, migrator, 0)
+	if hasTable(t, migrator, "users") {
+		t.Fatal("users is still there after rolling every migration back")
+	}
+
+	if err := migrator.Up(); err != nil {
+		t.Fatal(err)
+	}
+	expectVersion(t, migrator, latest)
+
+	if err := migrator.MigrateTo(latest + 1); err == nil {
+		t.Fatal("migrated to a version that isn't embedded")
+	}
+}
+
+func TestSchemaAheadRefusesToStart(t *testing.T) {
+	migrator := newTestMigrator(t)
+	if err := migrator.Up(); err != nil {
+		t.Fatal(err)
+	}
+	_, err := migrator.db.Exec("INSERT INTO schema_migrations (version, name) VALUES (?, ?)",
+		migrator.Latest()+1, "from_the_future")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := migrator.CheckVersion(); !errors.Is(err, ErrSchemaAhead) {
+		t.Fatalf("got %v checking the version, want %v", err, ErrSchemaAhead)
+	}
+	if err := migrator.Down(1); !errors.Is(err, ErrSchemaAhead) {
+		t.Fatalf("got %v rolling back, want %v", err, ErrSchemaAhead)
+	}
+	if _, err := NewSQLiteDBHandler(migrator.db, zap.NewNop()); !errors.Is(err, ErrSchemaAhead) {
+		t.Fatalf("got %v starting on the database, want %v", err, ErrSchemaAhead)
+	}
+	// Nothing was rolled back
+	expectVersion(t, migrator, migrator.Latest()+1)
+}
@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS users (
+	user_id INT AUTO_INCREMENT PRIMARY KEY,
+	username VARCHAR(255) UNIQUE NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS friendships (
+	user INT,
+	friend INT,
+	PRIMARY KEY (user, friend),
+	FOREIGN KEY (user) REFERENCES users(user_id),
+	FOREIGN KEY (friend) REFERENCES users(user_id)
+);
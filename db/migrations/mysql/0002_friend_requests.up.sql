@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS friend_requests (
+	request_id INT AUTO_INCREMENT PRIMARY KEY,
+	requester INT NOT NULL,
+	recipient INT NOT NULL,
+	status VARCHAR(16) NOT NULL,
+	created_at DATETIME NOT NULL,
+	updated_at DATETIME NOT NULL,
+	INDEX idx_friend_requests_requester (requester, status),
+	INDEX idx_friend_requests_recipient (recipient, status),
+	FOREIGN KEY (requester) REFERENCES users(user_id),
+	FOREIGN KEY (recipient) REFERENCES users(user_id)
+);
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS blocks (
+	blocker INT NOT NULL,
+	blocked INT NOT NULL,
+	created_at DATETIME NOT NULL,
+	PRIMARY KEY (blocker, blocked),
+	INDEX idx_blocks_blocked (blocked),
+	FOREIGN KEY (blocker) REFERENCES users(user_id),
+	FOREIGN KEY (blocked) REFERENCES users(user_id)
+);
@@ -0,0 +1,11 @@
+ALTER TABLE user_settings ADD COLUMN ghost BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE user_settings ADD COLUMN sharing VARCHAR(16) NOT NULL DEFAULT 'precise';
+
+CREATE TABLE IF NOT EXISTS friend_sharing (
+	user_id INT NOT NULL,
+	friend_id INT NOT NULL,
+	level VARCHAR(16) NOT NULL,
+	PRIMARY KEY (user_id, friend_id),
+	FOREIGN KEY (user_id) REFERENCES users(user_id),
+	FOREIGN KEY (friend_id) REFERENCES users(user_id)
+);
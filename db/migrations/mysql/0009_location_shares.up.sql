@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS location_shares (
+	share_id INT AUTO_INCREMENT PRIMARY KEY,
+	user_id INT NOT NULL,
+	friend_id INT NOT NULL,
+	level VARCHAR(16) NOT NULL,
+	created_at DATETIME NOT NULL,
+	expires_at DATETIME NOT NULL,
+	INDEX idx_location_shares_user (user_id, expires_at),
+	INDEX idx_location_shares_friend (friend_id, expires_at),
+	FOREIGN KEY (user_id) REFERENCES users(user_id),
+	FOREIGN KEY (friend_id) REFERENCES users(user_id)
+);
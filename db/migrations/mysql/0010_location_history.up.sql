@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS location_history (
+	history_id BIGINT AUTO_INCREMENT PRIMARY KEY,
+	user_id INT NOT NULL,
+	latitude DOUBLE NOT NULL,
+	longitude DOUBLE NOT NULL,
+	recorded_at DATETIME(3) NOT NULL,
+	INDEX idx_location_history_user (user_id, recorded_at),
+	INDEX idx_location_history_recorded (recorded_at),
+	FOREIGN KEY (user_id) REFERENCES users(user_id)
+);
@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS users (
+	user_id INTEGER PRIMARY KEY AUTOINCREMENT,
+	username TEXT UNIQUE NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS friendships (
+	user INTEGER,
+	friend INTEGER,
+	PRIMARY KEY (user, friend),
+	FOREIGN KEY (user) REFERENCES users(user_id),
+	FOREIGN KEY (friend) REFERENCES users(user_id)
+);
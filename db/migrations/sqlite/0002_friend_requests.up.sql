@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS friend_requests (
+	request_id INTEGER PRIMARY KEY AUTOINCREMENT,
+	requester INTEGER NOT NULL,
+	recipient INTEGER NOT NULL,
+	status TEXT NOT NULL,
+	created_at DATETIME NOT NULL,
+	updated_at DATETIME NOT NULL,
+	FOREIGN KEY (requester) REFERENCES users(user_id),
+	FOREIGN KEY (recipient) REFERENCES users(user_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_friend_requests_requester ON friend_requests (requester, status);
+CREATE INDEX IF NOT EXISTS idx_friend_requests_recipient ON friend_requests (recipient, status);
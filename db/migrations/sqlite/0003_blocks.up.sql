@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS blocks (
+	blocker INTEGER NOT NULL,
+	blocked INTEGER NOT NULL,
+	created_at DATETIME NOT NULL,
+	PRIMARY KEY (blocker, blocked),
+	FOREIGN KEY (blocker) REFERENCES users(user_id),
+	FOREIGN KEY (blocked) REFERENCES users(user_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_blocks_blocked ON blocks (blocked);
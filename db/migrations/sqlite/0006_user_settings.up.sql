@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS user_settings (
+	user_id INTEGER PRIMARY KEY,
+	radius REAL NOT NULL,
+	unit VARCHAR(8) NOT NULL,
+	FOREIGN KEY (user_id) REFERENCES users(user_id)
+);
@@ -0,0 +1 @@
+ALTER TABLE user_settings ADD COLUMN discoverable BOOLEAN NOT NULL DEFAULT 0;
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS friend_sharing;
+ALTER TABLE user_settings DROP COLUMN sharing;
+ALTER TABLE user_settings DROP COLUMN ghost;
@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS location_shares (
+	share_id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL,
+	friend_id INTEGER NOT NULL,
+	level VARCHAR(16) NOT NULL,
+	created_at DATETIME NOT NULL,
+	expires_at DATETIME NOT NULL,
+	FOREIGN KEY (user_id) REFERENCES users(user_id),
+	FOREIGN KEY (friend_id) REFERENCES users(user_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_location_shares_user ON location_shares (user_id, expires_at);
+CREATE INDEX IF NOT EXISTS idx_location_shares_friend ON location_shares (friend_id, expires_at);
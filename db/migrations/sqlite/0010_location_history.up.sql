@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS location_history (
+	history_id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL,
+	latitude DOUBLE NOT NULL,
+	longitude DOUBLE NOT NULL,
+	recorded_at DATETIME NOT NULL,
+	FOREIGN KEY (user_id) REFERENCES users(user_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_location_history_user ON location_history (user_id, recorded_at);
+CREATE INDEX IF NOT EXISTS idx_location_history_recorded ON location_history (recorded_at);
@@ -0,0 +1,113 @@
+package export
+
+import (
+	"encoding/json"
+	"io"
+	"nearby-friends/types"
+)
+
+// GeoJSONContentType is the media type of GeoJSON documents
+const GeoJSONContentType = "application/geo+json"
+
+// Geometry is a GeoJSON geometry. Positions are [longitude, latitude].
+type Geometry struct {
+	Type        string `json:"type"`
+	Coordinates any    `json:"coordinates"`
+}
+
+// Feature is a GeoJSON feature. A nil Geometry encodes as null.
+type Feature struct {
+	Type       string         `json:"type"`
+	Geometry   *Geometry      `json:"geometry"`
+	Properties map[string]any `json:"properties"`
+}
+
+// FeatureCollection is a GeoJSON feature collection
+type FeatureCollection struct {
+	Type     string    `json:"type"`
+	Features []Feature `json:"features"`
+}
+
+func point(longitude, latitude float64) *Geometry {
+	return &Geometry{Type: "Point", Coordinates: [2]float64{longitude, latitude}}
+}
+
+// TrackFeature returns the track as a LineString feature. The time of each
+// position is in the coordTimes property. A LineString needs two positions,
+// so single point tracks are a Point and empty ones have no geometry.
+func TrackFeature(track types.LocationTrack) Feature {
+	coordinates := make([][2]float64, 0, len(track.Points))
+	times := make([]string, 0, len(track.Points))
+	for _, p := range track.Points {
+		coordinates = append(coordinates, [2]float64{p.Longitude, p.Latitude})
+		times = append(times, formatTime(p.RecordedAt))
+	}
+
+	feature := Feature{
+		Type: "Feature",
+		Properties: map[string]any{
+			"userId":     track.UserID,
+			"from":       formatTime(track.From),
+			"to":         formatTime(track.To),
+			"truncated":  track.Truncated,
+			"coordTimes": times,
+		},
+	}
+	switch len(coordinates) {
+	case 0:
+	case 1:
+		feature.Geometry = point(coordinates[0][0], coordinates[0][1])
+	default:
+		feature.Geometry = &Geometry{Type: "LineString", Coordinates: coordinates}
+	}
+	return feature
+}
+
+// NearbyFeatures returns a point for the user and one for each friend they
+// have a distance to. Friends are placed at locations, which should be where
+// the user is allowed to see them, and friends without one are left out.
+func NearbyFeatures(
+	user types.UserLocation,
+	distances []types.UserDistance,
+	locations map[int]types.UserLocation,
+) FeatureCollection {
+	self := Feature{
+		Type:     "Feature",
+		Geometry: point(user.Longitude, user.Latitude),
+		Properties: map[string]any{
+			"id":   user.ID,
+			"name": user.Name,
+			"self": true,
+		},
+	}
+	if !user.LastUpdateTime.IsZero() {
+		self.Properties["lastUpdateTime"] = formatTime(user.LastUpdateTime)
+	}
+	collection := FeatureCollection{Type: "FeatureCollection", Features: []Feature{self}}
+	for _, distance := range distances {
+		location, ok := locations[distance.Remote.ID]
+		if !ok {
+			continue
+		}
+		collection.Features = append(collection.Features, Feature{
+			Type:     "Feature",
+			Geometry: point(location.Longitude, location.Latitude),
+			Properties: map[string]any{
+				"id":             distance.Remote.ID,
+				"name":           distance.Remote.Name,
+				"self":           false,
+				"distance":       distance.Distance,
+				"unit":           distance.Unit,
+				"lastUpdateTime": formatTime(distance.LastUpdateTime),
+			},
+		})
+	}
+	return collection
+}
+
+// WriteGeoJSON writes any of the GeoJSON objects above
+func WriteGeoJSON(w io.Writer, object any) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(object)
+}
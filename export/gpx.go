@@ -0,0 +1,82 @@
+package export
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"nearby-friends/types"
+	"time"
+)
+
+// GPXContentType is the media type of GPX documents
+const GPXContentType = "application/gpx+xml"
+
+type gpx struct {
+	XMLName  xml.Name    `xml:"gpx"`
+	Version  string      `xml:"version,attr"`
+	Creator  string      `xml:"creator,attr"`
+	Xmlns    string      `xml:"xmlns,attr"`
+	Metadata gpxMetadata `xml:"metadata"`
+	Track    gpxTrack    `xml:"trk"`
+}
+
+type gpxMetadata struct {
+	Name string `xml:"name"`
+	Time string `xml:"time"`
+}
+
+type gpxTrack struct {
+	Name    string     `xml:"name"`
+	Segment gpxSegment `xml:"trkseg"`
+}
+
+type gpxSegment struct {
+	Points []gpxPoint `xml:"trkpt"`
+}
+
+type gpxPoint struct {
+	Latitude  float64 `xml:"lat,attr"`
+	Longitude float64 `xml:"lon,attr"`
+	Time      string  `xml:"time"`
+}
+
+// WriteGPX writes the track as a GPX 1.1 document with a single track
+// segment
+func WriteGPX(w io.Writer, track types.LocationTrack) error {
+	name := fmt.Sprintf("user %v", track.UserID)
+	doc := gpx{
+		Version: "1.1",
+		Creator: "nearby-friends",
+		Xmlns:   "http://www.topografix.com/GPX/1/1",
+		Metadata: gpxMetadata{
+			Name: fmt.Sprintf("%v from %v to %v", name, formatTime(track.From), formatTime(track.To)),
+			Time: formatTime(time.Now()),
+		},
+		Track: gpxTrack{
+			Name:    name,
+			Segment: gpxSegment{Points: make([]gpxPoint, 0, len(track.Points))},
+		},
+	}
+	for _, point := range track.Points {
+		doc.Track.Segment.Points = append(doc.Track.Segment.Points, gpxPoint{
+			Latitude:  point.Latitude,
+			Longitude: point.Longitude,
+			Time:      formatTime(point.RecordedAt),
+		})
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(doc); err != nil {
+		return fmt.Errorf("error encoding gpx: %v", err)
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}
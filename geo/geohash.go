@@ -0,0 +1,179 @@
+package geo
+
+import (
+	"math"
+	"nearby-friends/types"
+	"strings"
+)
+
+// MilesPerDegree is the length of a degree of latitude on the sphere the
+// types distance algorithms use
+const MilesPerDegree = types.EarthRadiusMiles * math.Pi / 180
+
+// MaxPrecision is the longest geohash that fits in a Cell
+const MaxPrecision = 12
+
+const base32 = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+// Cell is a geohash cell. Precision is the number of base32 characters of
+// the hash, each halving the cell 5 times alternating between longitude and
+// latitude.
+type Cell struct {
+	Hash      uint64
+	Precision int
+}
+
+// Encode returns the cell of the given precision containing the point
+func Encode(latitude, longitude float64, precision int) Cell {
+	precision = clampPrecision(precision)
+	latMin, latMax := -90.0, 90.0
+	lonMin, lonMax := -180.0, 180.0
+	var hash uint64
+	for i := 0; i < precision*5; i++ {
+		hash <<= 1
+		// Even bits split longitude, odd bits latitude
+		if i%2 == 0 {
+			mid := (lonMin + lonMax) / 2
+			if longitude >= mid {
+				hash |= 1
+				lonMin = mid
+			} else {
+				lonMax = mid
+			}
+		} else {
+			mid := (latMin + latMax) / 2
+			if latitude >= mid {
+				hash |= 1
+				latMin = mid
+			} else {
+				latMax = mid
+			}
+		}
+	}
+	return Cell{Hash: hash, Precision: precision}
+}
+
+// Bounds returns the south west and north east corners of the cell
+func (c Cell) Bounds() (latMin, lonMin, latMax, lonMax float64) {
+	latMin, latMax = -90.0, 90.0
+	lonMin, lonMax = -180.0, 180.0
+	bits := c.Precision * 5
+	for i := 0; i < bits; i++ {
+		bit := (c.Hash >> (bits - 1 - i)) & 1
+		if i%2 == 0 {
+			mid := (lonMin + lonMax) / 2
+			if bit == 1 {
+				lonMin = mid
+			} else {
+				lonMax = mid
+			}
+		} else {
+			mid := (latMin + latMax) / 2
+			if bit == 1 {
+				latMin = mid
+			} else {
+				latMax = mid
+			}
+		}
+	}
+	return latMin, lonMin, latMax, lonMax
+}
+
+// Center returns the point in the middle of the cell
+func (c Cell) Center() (latitude, longitude float64) {
+	latMin, lonMin, latMax, lonMax := c.Bounds()
+	return (latMin + latMax) / 2, (lonMin + lonMax) / 2
+}
+
+// Neighbors returns the up to 8 cells surrounding the cell. Cells past the
+// poles don't exist and cells past the antimeridian wrap around.
+func (c Cell) Neighbors() []Cell {
+	latHeight, lonWidth := CellSize(c.Precision)
+	latMin, lonMin, _, _ := c.Bounds()
+	lat, lon := latMin+latHeight/2, lonMin+lonWidth/2
+
+	neighbors := make([]Cell, 0, 8)
+	for _, dLat := range []float64{-1, 0, 1} {
+		for _, dLon := range []float64{-1, 0, 1} {
+			if dLat == 0 && dLon == 0 {
+				continue
+			}
+			neighborLat := lat + dLat*latHeight
+			if neighborLat < -90 || neighborLat > 90 {
+				continue
+			}
+			neighbor := Encode(neighborLat, wrapLongitude(lon+dLon*lonWidth), c.Precision)
+			if neighbor != c {
+				neighbors = append(neighbors, neighbor)
+			}
+		}
+	}
+	return neighbors
+}
+
+func (c Cell) String() string {
+	var sb strings.Builder
+	for i := c.Precision - 1; i >= 0; i-- {
+		sb.WriteByte(base32[(c.Hash>>(5*i))&31])
+	}
+	return sb.String()
+}
+
+// CellSize returns the height and width in degrees of cells of the given
+// precision
+func CellSize(precision int) (latHeight, lonWidth float64) {
+	bits := clampPrecision(precision) * 5
+	lonBits := (bits + 1) / 2
+	latBits := bits / 2
+	return 180 / math.Exp2(float64(latBits)), 360 / math.Exp2(float64(lonBits))
+}
+
+// PrecisionFor returns the finest precision whose cells are at least radius
+// miles tall, so a radius query rarely has to look past a cell's neighbors
+func PrecisionFor(radius float64) int {
+	for precision := MaxPrecision; precision > 1; precision-- {
+		latHeight, _ := CellSize(precision)
+		if latHeight*MilesPerDegree >= radius {
+			return precision
+		}
+	}
+	return 1
+}
+
+func clampPrecision(precision int) int {
+	if precision < 1 {
+		return 1
+	}
+	if precision > MaxPrecision {
+		return MaxPrecision
+	}
+	return precision
+}
+
+func wrapLongitude(longitude float64) float64 {
+	for longitude < -180 {
+		longitude += 360
+	}
+	for longitude >= 180 {
+		longitude -= 360
+	}
+	return longitude
+}
+
+// Snap moves the point to the center of the grid square it falls in. Squares
+// are grid miles tall and as wide at the latitude of their center, so every
+// point in a square snaps to the same location.
+func Snap(latitude, longitude, grid float64) (float64, float64) {
+	if !(grid > 0) {
+		return latitude, longitude
+	}
+	latStep := grid / MilesPerDegree
+	latitude = math.Max(-90, math.Min(90, (math.Floor(latitude/latStep)+0.5)*latStep))
+
+	cos := math.Cos(latitude * math.Pi / 180)
+	if cos <= 0 || latStep/cos >= 360 {
+		return latitude, 0
+	}
+	lonStep := latStep / cos
+	return latitude, wrapLongitude((math.Floor(longitude/lonStep) + 0.5) * lonStep)
+}
@@ -0,0 +1,161 @@
+package geo
+
+import (
+	"math"
+	"nearby-friends/types"
+	"sort"
+)
+
+type entry struct {
+	location types.UserLocation
+	cell     uint64
+}
+
+// Index buckets user locations by geohash cell so radius queries only look
+// at the users in the cells around the center instead of every user.
+// An Index is not safe for concurrent use.
+type Index struct {
+	precision int
+	distance  types.DistanceFunc
+	cells     map[uint64]map[int]struct{}
+	entries   map[int]entry
+}
+
+// NewIndex creates an index with cells of the given precision, measuring
+// distances with distance. Use PrecisionFor with the radius most queries
+// will use.
+func NewIndex(precision int, distance types.DistanceFunc) *Index {
+	return &Index{
+		precision: clampPrecision(precision),
+		distance:  distance,
+		cells:     make(map[uint64]map[int]struct{}),
+		entries:   make(map[int]entry),
+	}
+}
+
+func (ix *Index) Len() int {
+	return len(ix.entries)
+}
+
+// Insert indexes the user's location, replacing the one indexed before
+func (ix *Index) Insert(location types.UserLocation) {
+	cell := Encode(location.Latitude, location.Longitude, ix.precision).Hash
+	if existing, ok := ix.entries[location.ID]; ok && existing.cell != cell {
+		ix.removeFromCell(existing.cell, location.ID)
+	}
+	if _, ok := ix.cells[cell]; !ok {
+		ix.cells[cell] = make(map[int]struct{})
+	}
+	ix.cells[cell][location.ID] = struct{}{}
+	ix.entries[location.ID] = entry{location: location, cell: cell}
+}
+
+// Move updates the location of a user already in the index. It reports
+// false, and indexes nothing, for users that aren't.
+func (ix *Index) Move(location types.UserLocation) bool {
+	if _, ok := ix.entries[location.ID]; !ok {
+		return false
+	}
+	ix.Insert(location)
+	return true
+}
+
+// Remove drops the user from the index, reporting whether it was indexed
+func (ix *Index) Remove(userID int) bool {
+	existing, ok := ix.entries[userID]
+	if !ok {
+		return false
+	}
+	ix.removeFromCell(existing.cell, userID)
+	delete(ix.entries, userID)
+	return true
+}
+
+func (ix *Index) Get(userID int) (types.UserLocation, bool) {
+	existing, ok := ix.entries[userID]
+	return existing.location, ok
+}
+
+// Candidates returns the users in the cells overlapping the radius miles
+// around center. It may include users beyond the radius, callers still have
+// to check the exact distance.
+func (ix *Index) Candidates(center types.UserLocation, radius float64) []types.UserLocation {
+	cells := ix.cover(center.Latitude, center.Longitude, radius)
+	if cells == nil {
+		candidates := make([]types.UserLocation, 0, len(ix.entries))
+		for _, existing := range ix.entries {
+			candidates = append(candidates, existing.location)
+		}
+		return candidates
+	}
+
+	var candidates []types.UserLocation
+	for cell := range cells {
+		for userID := range ix.cells[cell] {
+			candidates = append(candidates, ix.entries[userID].location)
+		}
+	}
+	return candidates
+}
+
+// Within returns the users within radius miles of center, nearest first, by
+// the index's distance. The center's own user is included if it is indexed.
+func (ix *Index) Within(center types.UserLocation, radius float64) []types.UserLocation {
+	var within []types.UserLocation
+	distances := make(map[int]float64)
+	for _, candidate := range ix.Candidates(center, radius) {
+		distance := ix.distance(center, candidate)
+		if distance <= radius {
+			within = append(within, candidate)
+			distances[candidate.ID] = distance
+		}
+	}
+	sort.Slice(within, func(i, j int) bool {
+		return distances[within[i].ID] < distances[within[j].ID]
+	})
+	return within
+}
+
+func (ix *Index) removeFromCell(cell uint64, userID int) {
+	delete(ix.cells[cell], userID)
+	if len(ix.cells[cell]) == 0 {
+		delete(ix.cells, cell)
+	}
+}
+
+// cover returns the cells overlapping the bounding box of the radius. It
+// returns nil when there would be more cells to look at than users indexed,
+// in which case scanning every user is cheaper.
+func (ix *Index) cover(latitude, longitude, radius float64) map[uint64]struct{} {
+	latHeight, lonWidth := CellSize(ix.precision)
+
+	latDelta := radius / MilesPerDegree
+	minLat, maxLat := math.Max(-90, latitude-latDelta), math.Min(90, latitude+latDelta)
+
+	// Degrees of longitude shrink towards the poles, so the box is widest at
+	// the latitude furthest from the equator
+	minLon, maxLon := -180.0, 180.0
+	cos := math.Min(math.Cos(minLat*math.Pi/180), math.Cos(maxLat*math.Pi/180))
+	if cos > 0 {
+		if lonDelta := latDelta / cos; lonDelta < 180 {
+			minLon, maxLon = longitude-lonDelta, longitude+lonDelta
+		}
+	}
+
+	rows := math.Ceil((maxLat-minLat)/latHeight) + 1
+	columns := math.Ceil((maxLon-minLon)/lonWidth) + 1
+	if rows*columns > float64(len(ix.entries)) {
+		return nil
+	}
+
+	// Sampling at cell sized steps from the corner hits every cell the box
+	// overlaps
+	cells := make(map[uint64]struct{})
+	for lat := minLat; lat < maxLat+latHeight; lat += latHeight {
+		for lon := minLon; lon < maxLon+lonWidth; lon += lonWidth {
+			cell := Encode(math.Min(lat, maxLat), wrapLongitude(math.Min(lon, maxLon)), ix.precision)
+			cells[cell.Hash] = struct{}{}
+		}
+	}
+	return cells
+}
@@ -0,0 +1,215 @@
+package geo
+
+import (
+	"math/rand"
+	"nearby-friends/types"
+	"sort"
+	"testing"
+)
+
+func testLocation(id int, lat, lon float64) types.UserLocation {
+	return types.UserLocation{User: &types.User{ID: id}, Latitude: lat, Longitude: lon}
+}
+
+// scatter returns n locations spread up to spread degrees around the center,
+// wrapping around the antimeridian and staying within the poles
+func scatter(r *rand.Rand, n int, lat, lon, spread float64) []types.UserLocation {
+	locations := make([]types.UserLocation, 0, n)
+	for id := 1; id <= n; id++ {
+		pointLat := lat + (r.Float64()*2-1)*spread
+		if pointLat > 90 {
+			pointLat = 180 - pointLat
+		}
+		if pointLat < -90 {
+			pointLat = -180 - pointLat
+		}
+		pointLon := wrapLongitude(lon + (r.Float64()*2-1)*spread)
+		locations = append(locations, testLocation(id, pointLat, pointLon))
+	}
+	return locations
+}
+
+// bruteForceWithin is what Within has to agree with
+func bruteForceWithin(locations []types.UserLocation, center types.UserLocation, radius float64) []types.UserLocation {
+	var within []types.UserLocation
+	for _, location := range locations {
+		if types.Haversine(center, location) <= radius {
+			within = append(within, location)
+		}
+	}
+	return within
+}
+
+func sortedIDs(locations []types.UserLocation) []int {
+	ids := make([]int, 0, len(locations))
+	for _, location := range locations {
+		ids = append(ids, location.ID)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+func newTestIndex(radius float64, locations []types.UserLocation) *Index {
+	ix := NewIndex(PrecisionFor(radius), types.Haversine)
+	for _, location := range locations {
+		ix.Insert(location)
+	}
+	return ix
+}
+
+func TestWithinMatchesBruteForce(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for _, tc := range []struct {
+		name     string
+		lat, lon float64
+		// spread is how many degrees around the center users are scattered
+		spread float64
+		radius float64
+	}{
+		{name: "city", lat: 40.7128, lon: -74.0060, spread: 0.5, radius: 5},
+		{name: "equator and prime meridian", lat: 0, lon: 0, spread: 0.5, radius: 5},
+		{name: "antimeridian east", lat: -17.7, lon: 179.98, spread: 0.5, radius: 5},
+		{name: "antimeridian west", lat: 65.5, lon: -179.99, spread: 0.5, radius: 10},
+		{name: "north pole", lat: 89.98, lon: 45, spread: 0.5, radius: 5},
+		{name: "south pole", lat: -89.99, lon: -120, spread: 0.5, radius: 5},
+		{name: "exactly on the pole", lat: 90, lon: 0, spread: 0.2, radius: 5},
+		{name: "wide radius", lat: 51.5, lon: -0.12, spread: 5, radius: 100},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			locations := scatter(r, 5000, tc.lat, tc.lon, tc.spread)
+			ix := newTestIndex(tc.radius, locations)
+
+			for i := 0; i < 50; i++ {
+				center := locations[r.Intn(len(locations))]
+				if i == 0 {
+					center = testLocation(0, tc.lat, tc.lon)
+				}
+				want := sortedIDs(bruteForceWithin(locations, center, tc.radius))
+				gotLocations := ix.Within(center, tc.radius)
+				got := sortedIDs(gotLocations)
+				if len(got) != len(want) {
+					t.Fatalf("around %v,%v got %v users, brute force found %v",
+						center.Latitude, center.Longitude, len(got), len(want))
+				}
+				for j := range want {
+					if got[j] != want[j] {
+						t.Fatalf("around %v,%v got users %v, brute force found %v",
+							center.Latitude, center.Longitude, got, want)
+					}
+				}
+				for j := 1; j < len(gotLocations); j++ {
+					if types.Haversine(center, gotLocations[j-1]) > types.Haversine(center, gotLocations[j]) {
+						t.Fatalf("around %v,%v users aren't nearest first", center.Latitude, center.Longitude)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestCoverUsesCellsWhenDense(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	ix := newTestIndex(5, scatter(r, 5000, 40.7128, -74.0060, 0.5))
+	if cells := ix.cover(40.7128, -74.0060, 5); cells == nil {
+		t.Fatal("a dense index scanned every user instead of the cells around the center")
+	}
+}
+
+func TestWithinAcrossTheAntimeridian(t *testing.T) {
+	ix := NewIndex(PrecisionFor(5), types.Haversine)
+	east := testLocation(1, 0, 179.99)
+	west := testLocation(2, 0, -179.99)
+	ix.Insert(east)
+	ix.Insert(west)
+	// Pad the index so the cells are used rather than a scan
+	for id := 3; id < 1000; id++ {
+		ix.Insert(testLocation(id, 30, float64(id%100)))
+	}
+
+	if got := sortedIDs(ix.Within(east, 5)); len(got) != 2 || got[0] != 1 || got[1] != 2 {
+		t.Fatalf("got users %v within 5 miles of the antimeridian, want [1 2]", got)
+	}
+}
+
+func TestWithinAcrossThePole(t *testing.T) {
+	ix := NewIndex(PrecisionFor(5), types.Haversine)
+	// Both a mile from the pole, on opposite sides
+	one := testLocation(1, 90-1/MilesPerDegree, 0)
+	other := testLocation(2, 90-1/MilesPerDegree, 180)
+	ix.Insert(one)
+	ix.Insert(other)
+	for id := 3; id < 1000; id++ {
+		ix.Insert(testLocation(id, 30, float64(id%100)))
+	}
+
+	if got := sortedIDs(ix.Within(one, 5)); len(got) != 2 {
+		t.Fatalf("got users %v within 5 miles across the pole, want [1 2]", got)
+	}
+}
+
+func TestWithinUsesIndexDistance(t *testing.T) {
+	// Measures every distance as twice the Haversine distance
+	doubled := func(primary, secondary types.UserLocation) float64 {
+		return 2 * types.Haversine(primary, secondary)
+	}
+	ix := NewIndex(PrecisionFor(5), doubled)
+	center := testLocation(1, 40.7128, -74.0060)
+	ix.Insert(center)
+	ix.Insert(testLocation(2, 40.7128+1/MilesPerDegree, -74.0060))
+	ix.Insert(testLocation(3, 40.7128+3/MilesPerDegree, -74.0060))
+
+	if got := sortedIDs(ix.Within(center, 5)); len(got) != 2 || got[0] != 1 || got[1] != 2 {
+		t.Fatalf("got users %v within 5 doubled miles, want [1 2]", got)
+	}
+}
+
+func TestIndexMoveAndRemove(t *testing.T) {
+	ix := NewIndex(PrecisionFor(5), types.Haversine)
+	if ix.Move(testLocation(1, 0, 0)) {
+		t.Fatal("moved a user that wasn't indexed")
+	}
+	ix.Insert(testLocation(1, 0, 0))
+	if !ix.Move(testLocation(1, 45, 45)) {
+		t.Fatal("couldn't move an indexed user")
+	}
+	if got := ix.Within(testLocation(2, 0, 0), 5); len(got) != 0 {
+		t.Fatalf("found %v users where the moved user used to be", len(got))
+	}
+	if got := ix.Within(testLocation(2, 45, 45), 5); len(got) != 1 {
+		t.Fatalf("found %v users where the user moved to, want 1", len(got))
+	}
+
+	if !ix.Remove(1) || ix.Remove(1) {
+		t.Fatal("removing reported the wrong result")
+	}
+	if ix.Len() != 0 || len(ix.cells) != 0 {
+		t.Fatalf("%v users and %v cells left after removing every user", ix.Len(), len(ix.cells))
+	}
+}
+
+func benchmarkLocations(n int) []types.UserLocation {
+	// Users spread over about a hundred miles, a metro area
+	return scatter(rand.New(rand.NewSource(3)), n, 40.7128, -74.0060, 1)
+}
+
+func benchmarkWithin(b *testing.B, n int) {
+	locations := benchmarkLocations(n)
+	ix := newTestIndex(5, locations)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ix.Within(locations[i%n], 5)
+	}
+}
+
+func benchmarkBruteForce(b *testing.B, n int) {
+	locations := benchmarkLocations(n)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		bruteForceWithin(locations, locations[i%n], 5)
+	}
+}
+
+func BenchmarkWithin1k(b *testing.B)       { benchmarkWithin(b, 1000) }
+func BenchmarkBruteForce1k(b *testing.B)   { benchmarkBruteForce(b, 1000) }
+func BenchmarkWithin100k(b *testing.B)     { benchmarkWithin(b, 100000) }
+func BenchmarkBruteForce100k(b *testing.B) { benchmarkBruteForce(b, 100000) }
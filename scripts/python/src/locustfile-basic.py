@@ -11,14 +11,19 @@ from uuid import uuid4
 
 users = []
 userFriendCount = {}
+tokensByID = {}
 
 class User:
     def __init__(self):
         self.name = Faker().first_name() + str(random.randint(1000, 9999))
+        self.password = str(uuid4())
         self.id = None
         #self.id = random.randint(1000, 9999)
 
 
+def auth_headers(userID):
+    return {"Authorization": "Bearer {}".format(tokensByID[userID])}
+
 def get_random_user():
     if len(users) < 1:
         return None
@@ -35,6 +40,12 @@ class Basic(TaskSet):
             pprint(vars(resp))
             if resp.status_code == 201:
                 user = resp.json()
+            else:
+                print("got non-success status code from response: {}".format(resp.status_code))
+                return
+        with self.client.post("/user/login", json=self.userObj.__dict__, catch_response=True) as resp:
+            if resp.status_code == 200:
+                tokensByID[user["id"]] = resp.json()["token"]
                 print("adding user {} to users collection".format(user))
                 users.append(user)
                 userFriendCount[user["id"]] = 0
@@ -49,7 +60,8 @@ class Basic(TaskSet):
             print("not enough users created yet")
             return
         print("selected random user to start friendship with: {}".format(randUser))
-        with self.client.get("/user/{}/possible-friends".format(randUser["id"]), catch_response=True) as resp:
+        with self.client.get("/user/{}/possible-friends".format(randUser["id"]),
+                             headers=auth_headers(randUser["id"]), catch_response=True) as resp:
             pprint(vars(resp))
             if resp.status_code == 200:
                 possibleFriends = resp.json()
@@ -68,10 +80,19 @@ class Basic(TaskSet):
 
         fr = {"user": randUser, "friend": randFriend}
         print("posting friend request: {}".format(fr))
-        with self.client.post("/user/friendship", json=fr, catch_response=True) as resp:
+        with self.client.post("/user/friendship", json=fr,
+                              headers=auth_headers(randUser["id"]), catch_response=True) as resp:
             pprint(vars(resp))
             if resp.status_code == 201:
-                possibleFriends = resp.json()
+                friendRequest = resp.json()
+            else:
+                print("got non-success status code from response: {}".format(resp.status_code))
+                return
+
+        acceptUrl = "/user/{}/friend-requests/{}/accept".format(randFriend["id"], friendRequest["id"])
+        with self.client.post(acceptUrl, headers=auth_headers(randFriend["id"]), catch_response=True) as resp:
+            pprint(vars(resp))
+            if resp.status_code == 200:
                 userFriendCount[randUser["id"]] += 1
             else:
                 print("got non-success status code from response: {}".format(resp.status_code))
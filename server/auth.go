@@ -0,0 +1,169 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"nearby-friends/auth"
+	"nearby-friends/db"
+	"nearby-friends/types"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+)
+
+// publicPaths can be reached without a bearer token
+var publicPaths = map[string]bool{
+	"/health":        true,
+	"/user/register": true,
+	"/user/login":    true,
+}
+
+// roleCacheTTL is how long a user's role is trusted before it is read from
+// the database again, so a demoted admin loses access within this window
+// rather than when their token expires.
+const roleCacheTTL = 10 * time.Second
+
+// roleCache holds the current role of users making requests to this server
+type roleCache = userCache[types.Role]
+
+func newRoleCache() *roleCache {
+	cache := newUserCache[types.Role]()
+	cache.ttl = roleCacheTTL
+	return cache
+}
+
+// bearerToken reads the token from the Authorization header. Browsers can't
+// set headers on a websocket upgrade so the access_token query parameter is
+// accepted there, and only there: query strings end up in access logs and
+// browser history.
+func bearerToken(r *http.Request) string {
+	if header := r.Header.Get("Authorization"); header != "" {
+		scheme, token, ok := strings.Cut(header, " ")
+		if ok && strings.EqualFold(scheme, "Bearer") {
+			return strings.TrimSpace(token)
+		}
+		return ""
+	}
+	if !isLocationUpgrade(r) {
+		return ""
+	}
+	return r.URL.Query().Get("access_token")
+}
+
+// isLocationUpgrade reports whether the request opens a location websocket
+func isLocationUpgrade(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, "/user/") &&
+		strings.HasSuffix(r.URL.Path, "/location") &&
+		websocket.IsWebSocketUpgrade(r)
+}
+
+// userRole is the role the user currently has. Tokens carry the role they
+// were issued with, which outlives a change of role, so it is read back from
+// the database instead.
+func (wh *RequestHandler) userRole(userID int) (types.Role, error) {
+	if role, ok := wh.roles.get(userID); ok {
+		return role, nil
+	}
+	role, err := wh.userDBHandler.GetUserRole(userID)
+	if err != nil {
+		return "", err
+	}
+	wh.roles.set(userID, role)
+	return role, nil
+}
+
+func writeGenericError(w http.ResponseWriter, err error, code int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(types.NewGenericError(err, code))
+}
+
+// authenticate verifies the bearer token on every non public request and
+// attaches the principal to the request context
+func (wh *RequestHandler) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if publicPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		token := bearerToken(r)
+		if token == "" {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeGenericError(w, errors.New("missing bearer token"), http.StatusUnauthorized)
+			return
+		}
+		claims, err := wh.tokens.Verify(token)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			writeGenericError(w, err, http.StatusUnauthorized)
+			return
+		}
+		role, err := wh.userRole(claims.UserID)
+		if errors.Is(err, db.ErrUserNotFound) {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			writeGenericError(w, err, http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			http.Error(w,
+				fmt.Sprintf("internal server error when loading role for user %v: %v", claims.UserID, err),
+				http.StatusInternalServerError)
+			return
+		}
+		claims.Role = role
+
+		next.ServeHTTP(w, r.WithContext(auth.WithClaims(r.Context(), claims)))
+	})
+}
+
+// principal is the authenticated user making the request. Only valid on
+// routes behind authenticate.
+func principal(r *http.Request) *auth.Claims {
+	claims, _ := auth.ClaimsFromContext(r.Context())
+	return claims
+}
+
+func (wh *RequestHandler) login() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var credentials types.Credentials
+		if err := json.NewDecoder(r.Body).Decode(&credentials); err != nil {
+			http.Error(w,
+				fmt.Sprintf("Invalid request body: %v", err),
+				http.StatusBadRequest)
+			return
+		}
+
+		user, err := wh.userDBHandler.Login(credentials.Name, credentials.Password)
+		if errors.Is(err, db.ErrInvalidCredentials) {
+			writeGenericError(w, err, http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			http.Error(w,
+				fmt.Sprintf("internal server error when logging in user %v: %v", credentials.Name, err),
+				http.StatusInternalServerError)
+			return
+		}
+
+		token, expiresAt, err := wh.tokens.Issue(*user)
+		if err != nil {
+			http.Error(w,
+				fmt.Sprintf("internal server error when issuing token for user %v: %v", user.ID, err),
+				http.StatusInternalServerError)
+			return
+		}
+		wh.log.With(
+			zap.String("name", user.Name),
+			zap.Int("id", user.ID),
+		).Info("Logged in User")
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(types.AuthToken{Token: token, ExpiresAt: expiresAt, User: *user})
+	}
+}
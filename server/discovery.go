@@ -0,0 +1,150 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"nearby-friends/cache"
+	"nearby-friends/geo"
+	"nearby-friends/types"
+	"net/http"
+
+	"go.uber.org/zap"
+)
+
+// discoveryPrecision is the geohash precision stranger locations are
+// coarsened to, cells of roughly 1.2km by 0.6km
+const discoveryPrecision = 6
+
+var (
+	errNotDiscoverable = errors.New("discovery is off, enable it and leave ghost mode to see nearby strangers")
+	errNoLocation      = errors.New("user has no current location, open a location socket first")
+)
+
+// nearbyStrangers returns the discoverable users within types.DiscoveryRadius
+// of the user that aren't friends and haven't blocked each other. Only users
+// that are discoverable themselves, and not ghosts, can discover others.
+func (wh *RequestHandler) nearbyStrangers(ctx context.Context, userID int) ([]types.NearbyStranger, int, error) {
+	settings := wh.userSettings(userID)
+	if !settings.Discoverable || settings.Ghost {
+		return nil, http.StatusForbidden, errNotDiscoverable
+	}
+
+	locations, err := wh.userCacheHandler.GetUserLocations(ctx, []types.User{{ID: userID}})
+	if err != nil {
+		return nil, http.StatusInternalServerError, fmt.Errorf("error getting location for user %v: %v", userID, err)
+	}
+	if len(locations) == 0 {
+		return nil, http.StatusConflict, errNoLocation
+	}
+	userLoc := locations[0]
+
+	possibleFriends, err := wh.userDBHandler.ListPossibleFriends(userID)
+	if err != nil {
+		return nil, http.StatusInternalServerError,
+			fmt.Errorf("error getting possible friends for user %v: %v", userID, err)
+	}
+	candidates, err := wh.userCacheHandler.FindNearby(ctx, userLoc, types.DiscoveryRadius)
+	if errors.Is(err, cache.ErrNearbyUnsupported) {
+		candidates, err = wh.userCacheHandler.GetUserLocations(ctx, possibleFriends)
+	}
+	if err != nil {
+		return nil, http.StatusInternalServerError,
+			fmt.Errorf("error finding users near user %v: %v", userID, err)
+	}
+
+	strangers := make(map[int]types.User, len(possibleFriends))
+	for _, possibleFriend := range possibleFriends {
+		strangers[possibleFriend.ID] = possibleFriend
+	}
+
+	nearby := []types.NearbyStranger{}
+	for _, candidate := range candidates {
+		stranger, ok := strangers[candidate.ID]
+		if !ok {
+			continue
+		}
+		if strangerSettings := wh.userSettings(candidate.ID); !strangerSettings.Discoverable || strangerSettings.Ghost {
+			continue
+		}
+		if wh.options.Distance(userLoc, candidate) > types.DiscoveryRadius {
+			continue
+		}
+
+		// Strangers only get to see the cell the user is in, and the
+		// distance to it
+		coarse := candidate
+		coarse.Latitude, coarse.Longitude = geo.Encode(candidate.Latitude, candidate.Longitude, discoveryPrecision).Center()
+		distance := settings.Unit.FromMiles(wh.options.Distance(userLoc, coarse))
+		nearby = append(nearby, types.NearbyStranger{
+			User:              stranger,
+			Latitude:          coarse.Latitude,
+			Longitude:         coarse.Longitude,
+			Distance:          math.Round(distance*10) / 10,
+			Unit:              settings.Unit,
+			FriendRequestPath: fmt.Sprintf("/user/%v/nearby/%v/friend-request", userID, stranger.ID),
+		})
+	}
+	return nearby, http.StatusOK, nil
+}
+
+func (wh *RequestHandler) listNearbyStrangers() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := pathParamInt(r, "id")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		nearby, status, err := wh.nearbyStrangers(r.Context(), userID)
+		if err != nil {
+			writeGenericError(w, err, status)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(nearby)
+	}
+}
+
+// requestNearbyStranger sends a friend request to a stranger the user can
+// currently discover
+func (wh *RequestHandler) requestNearbyStranger() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := pathParamInt(r, "id")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		strangerID, err := pathParamInt(r, "strangerID")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		nearby, status, err := wh.nearbyStrangers(r.Context(), userID)
+		if err != nil {
+			writeGenericError(w, err, status)
+			return
+		}
+		for _, stranger := range nearby {
+			if stranger.User.ID == strangerID {
+				wh.log.With(
+					zap.Int("user", userID),
+					zap.Int("stranger", strangerID),
+				).Info("Requesting friendship with nearby stranger")
+				wh.createFriendRequest(w, types.FriendRequest{
+					User:   types.User{ID: userID},
+					Friend: stranger.User,
+				})
+				return
+			}
+		}
+		writeGenericError(w,
+			fmt.Errorf("user %v is not a stranger near user %v", strangerID, userID),
+			http.StatusNotFound)
+	}
+}
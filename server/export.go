@@ -0,0 +1,123 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"nearby-friends/export"
+	"nearby-friends/types"
+	"net/http"
+)
+
+// exportLocationHistory renders the user's track between the from and to
+// query params as ?format=gpx or ?format=geojson
+func (wh *RequestHandler) exportLocationHistory() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := pathParamInt(r, "id")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if wh.history == nil {
+			writeGenericError(w, fmt.Errorf("location history is not enabled on this server"), http.StatusNotFound)
+			return
+		}
+
+		format := r.URL.Query().Get("format")
+		if format != "gpx" && format != "geojson" {
+			http.Error(w,
+				fmt.Sprintf("Invalid format '%v', expected 'gpx' or 'geojson'", format),
+				http.StatusBadRequest)
+			return
+		}
+		from, to, err := historyRange(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		track, err := LocationTrack(wh.userDBHandler, userID, from, to)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		filename := fmt.Sprintf("user-%v-history.%v", userID, format)
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+		// The status is sent by the time writing fails, so failures can only
+		// be logged and the client is left with a truncated file
+		if format == "gpx" {
+			w.Header().Set("Content-Type", export.GPXContentType)
+			w.WriteHeader(http.StatusOK)
+			if err := export.WriteGPX(w, track); err != nil {
+				wh.log.Sugar().Errorf("error writing gpx history export for user %v: %v", userID, err)
+			}
+			return
+		}
+		w.Header().Set("Content-Type", export.GeoJSONContentType)
+		w.WriteHeader(http.StatusOK)
+		if err := export.WriteGeoJSON(w, export.TrackFeature(track)); err != nil {
+			wh.log.Sugar().Errorf("error writing geojson history export for user %v: %v", userID, err)
+		}
+	}
+}
+
+// nearbyFriendsSnapshot returns the user's current location and the friends
+// in range of it, placed where the user is allowed to see them
+func (wh *RequestHandler) nearbyFriendsSnapshot(ctx context.Context, userID int) (export.FeatureCollection, int, error) {
+	locations, err := wh.userCacheHandler.GetUserLocations(ctx, []types.User{{ID: userID}})
+	if err != nil {
+		return export.FeatureCollection{}, http.StatusInternalServerError,
+			fmt.Errorf("error getting location for user %v: %v", userID, err)
+	}
+	if len(locations) == 0 {
+		return export.FeatureCollection{}, http.StatusConflict, errNoLocation
+	}
+	userLoc := locations[0]
+
+	friends, err := wh.userDBHandler.ListUserFriends(userID)
+	if err != nil {
+		return export.FeatureCollection{}, http.StatusInternalServerError,
+			fmt.Errorf("error getting friends for user %v: %v", userID, err)
+	}
+	friendLocations, err := wh.nearbyFriendLocations(ctx, userLoc, friends)
+	if err != nil {
+		return export.FeatureCollection{}, http.StatusInternalServerError,
+			fmt.Errorf("error getting friend locations for user %v: %v", userID, err)
+	}
+
+	distances := []types.UserDistance{}
+	shared := make(map[int]types.UserLocation, len(friendLocations))
+	for _, friendLocation := range friendLocations {
+		sharedLocation, ok := wh.sharedLocation(friendLocation, userID)
+		if !ok {
+			continue
+		}
+		if distance := wh.userDistanceIfValid(userLoc, sharedLocation); distance != nil {
+			distances = append(distances, *distance)
+			shared[sharedLocation.ID] = sharedLocation
+		}
+	}
+	return export.NearbyFeatures(userLoc, distances, shared), http.StatusOK, nil
+}
+
+func (wh *RequestHandler) exportNearbyFriends() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := pathParamInt(r, "id")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		collection, status, err := wh.nearbyFriendsSnapshot(r.Context(), userID)
+		if err != nil {
+			writeGenericError(w, err, status)
+			return
+		}
+
+		w.Header().Set("Content-Type", export.GeoJSONContentType)
+		w.WriteHeader(http.StatusOK)
+		if err := export.WriteGeoJSON(w, collection); err != nil {
+			wh.log.Sugar().Errorf("error writing nearby friends export for user %v: %v", userID, err)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"nearby-friends/cache"
+	"nearby-friends/types"
+	"sync"
+	"time"
+)
+
+// friendRangeSweepInterval is how often a session looks for friends whose
+// location went stale
+const friendRangeSweepInterval = 30 * time.Second
+
+type friendInRange struct {
+	location types.UserLocation
+	seenAt   time.Time
+}
+
+// friendRange tracks which friends are currently in range of a session's
+// user so the client can be told when one leaves. A friend is offline once
+// nothing was heard from them for as long as their cached location lives.
+type friendRange struct {
+	mu      sync.Mutex
+	friends map[int]friendInRange
+	ttl     time.Duration
+	now     func() time.Time
+}
+
+func newFriendRange() *friendRange {
+	return &friendRange{
+		friends: make(map[int]friendInRange),
+		ttl:     cache.UserLocationTTL,
+		now:     time.Now,
+	}
+}
+
+// observe records the friend's latest location and whether it is in range.
+// It reports whether the friend was in range before and just left it.
+func (fr *friendRange) observe(friendLocation types.UserLocation, inRange bool) bool {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	_, wasInRange := fr.friends[friendLocation.ID]
+	if inRange {
+		fr.friends[friendLocation.ID] = friendInRange{location: friendLocation, seenAt: fr.now()}
+		return false
+	}
+	delete(fr.friends, friendLocation.ID)
+	return wasInRange
+}
+
+// remove stops tracking the friend, returning their last location and
+// whether they were in range
+func (fr *friendRange) remove(friendID int) (types.UserLocation, bool) {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	friend, ok := fr.friends[friendID]
+	delete(fr.friends, friendID)
+	return friend.location, ok
+}
+
+// leftRange removes and returns the friends that are no longer in range
+// after the user moved
+func (fr *friendRange) leftRange(inRange func(friendLocation types.UserLocation) bool) []types.UserLocation {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	var left []types.UserLocation
+	for id, friend := range fr.friends {
+		if !inRange(friend.location) {
+			delete(fr.friends, id)
+			left = append(left, friend.location)
+		}
+	}
+	return left
+}
+
+// expire removes and returns the friends whose location went stale
+func (fr *friendRange) expire() []types.UserLocation {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	var expired []types.UserLocation
+	cutoff := fr.now().Add(-fr.ttl)
+	for id, friend := range fr.friends {
+		if friend.seenAt.Before(cutoff) {
+			delete(fr.friends, id)
+			expired = append(expired, friend.location)
+		}
+	}
+	return expired
+}
+
+// sweepOfflineFriends tells the client about friends that went offline
+// until the context is done
+func (wh *RequestHandler) sweepOfflineFriends(session *Session) {
+	ctx, socket, friends := session.ctx, session.socket, session.friends
+	ticker := time.NewTicker(friendRangeSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, friend := range friends.expire() {
+				if err := socket.writeFriendOutOfRange(friend, types.OutOfRangeOffline); err != nil {
+					wh.log.Sugar().Errorf("error writing friend out of range after expiry for user %v: %v", session.userID, err)
+				}
+			}
+		}
+	}
+}
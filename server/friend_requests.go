@@ -0,0 +1,128 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"nearby-friends/types"
+	"net/http"
+
+	"go.uber.org/zap"
+)
+
+func (wh *RequestHandler) sendFriendRequest() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := pathParamInt(r, "id")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var friendRequest types.FriendRequest
+		if err := json.NewDecoder(r.Body).Decode(&friendRequest); err != nil {
+			http.Error(w,
+				fmt.Sprintf("Invalid request body: %v", err),
+				http.StatusBadRequest)
+			return
+		}
+		friendRequest.User = types.User{ID: userID}
+
+		wh.createFriendRequest(w, friendRequest)
+	}
+}
+
+func (wh *RequestHandler) createFriendRequest(w http.ResponseWriter, friendRequest types.FriendRequest) {
+	if err := friendRequest.Validate(); err != nil {
+		writeGenericError(w, err, http.StatusBadRequest)
+		return
+	}
+	if err := wh.userDBHandler.SendFriendRequest(&friendRequest); err != nil {
+		http.Error(w,
+			fmt.Sprintf("error sending friend request [%v] -> [%v]: %v",
+				&friendRequest.User, &friendRequest.Friend, err),
+			dbErrorStatus(err))
+		return
+	}
+	wh.log.With(
+		zap.Int("request-id", friendRequest.ID),
+		zap.Int("user", friendRequest.User.ID),
+		zap.Int("friend", friendRequest.Friend.ID),
+	).Info("Sent friend request")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(friendRequest)
+}
+
+func (wh *RequestHandler) listFriendRequests() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := pathParamInt(r, "id")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var requests []types.FriendRequest
+		switch direction := r.URL.Query().Get("direction"); direction {
+		case "", "incoming":
+			requests, err = wh.userDBHandler.ListIncomingFriendRequests(userID)
+		case "outgoing":
+			requests, err = wh.userDBHandler.ListOutgoingFriendRequests(userID)
+		default:
+			http.Error(w,
+				fmt.Sprintf("Invalid request: direction must be 'incoming' or 'outgoing', got '%v'", direction),
+				http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w,
+				fmt.Sprintf("error listing friend requests for user %v: %v", userID, err),
+				http.StatusInternalServerError)
+			return
+		}
+		if requests == nil {
+			requests = []types.FriendRequest{}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(requests)
+	}
+}
+
+// resolveFriendRequest handles the accept, decline and cancel routes which
+// only differ in the db call made
+func (wh *RequestHandler) resolveFriendRequest(
+	resolve func(userID, requestID int) (*types.FriendRequest, error),
+) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := pathParamInt(r, "id")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		requestID, err := pathParamInt(r, "requestID")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		request, err := resolve(userID, requestID)
+		if err != nil {
+			http.Error(w,
+				fmt.Sprintf("error updating friend request %v for user %v: %v", requestID, userID, err),
+				dbErrorStatus(err))
+			return
+		}
+		if request.Status == types.FriendRequestAccepted {
+			wh.establishFriendship(r.Context(), request.User.ID, request.Friend.ID)
+		}
+		wh.log.With(
+			zap.Int("request-id", request.ID),
+			zap.String("status", string(request.Status)),
+		).Info("Resolved friend request")
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(request)
+	}
+}
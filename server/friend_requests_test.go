@@ -0,0 +1,143 @@
+package server
+
+import (
+	"nearby-friends/types"
+	"net/http"
+	"testing"
+)
+
+// sendFriendRequest sends a friend request from user to friend over HTTP
+func (ts *testServer) sendFriendRequest(t *testing.T, user types.User, token string, friend types.User) types.FriendRequest {
+	t.Helper()
+	var request types.FriendRequest
+	status := ts.do(t, http.MethodPost, "/user/"+itoa(user.ID)+"/friend-requests", token,
+		types.FriendRequest{Friend: types.User{ID: friend.ID}}, &request)
+	if status != http.StatusCreated {
+		t.Fatalf("got status %v sending a friend request, want %v", status, http.StatusCreated)
+	}
+	if request.Status != types.FriendRequestPending {
+		t.Fatalf("sent request is %v, want %v", request.Status, types.FriendRequestPending)
+	}
+	return request
+}
+
+// resolveFriendRequest accepts, declines or cancels the request as user and
+// returns the status code
+func (ts *testServer) resolveFriendRequest(t *testing.T, user types.User, token string, request types.FriendRequest, action string) int {
+	t.Helper()
+	path := "/user/" + itoa(user.ID) + "/friend-requests/" + itoa(request.ID) + "/" + action
+	return ts.do(t, http.MethodPost, path, token, nil)
+}
+
+// expectFriends checks the users the user has a friendship row with
+func (ts *testServer) expectFriends(t *testing.T, user types.User, want ...types.User) {
+	t.Helper()
+	friends, err := ts.db.ListUserFriends(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(friends) != len(want) {
+		t.Fatalf("user %v has %v friends, want %v", user.ID, len(friends), len(want))
+	}
+	for i := range want {
+		if friends[i].ID != want[i].ID {
+			t.Fatalf("user %v is friends with %v, want %v", user.ID, friends[i].ID, want[i].ID)
+		}
+	}
+}
+
+func TestAcceptFriendRequest(t *testing.T) {
+	ts := newTestServer(t, testOptions())
+	alice, aliceToken := ts.createUser(t, "alice", "")
+	bob, bobToken := ts.createUser(t, "bob", "")
+	request := ts.sendFriendRequest(t, alice, aliceToken, bob)
+
+	// Only Bob can answer the request he was sent
+	if status := ts.resolveFriendRequest(t, alice, aliceToken, request, "accept"); status != http.StatusNotFound {
+		t.Fatalf("got status %v accepting her own request, want %v", status, http.StatusNotFound)
+	}
+	ts.expectFriends(t, alice)
+
+	var accepted types.FriendRequest
+	status := ts.do(t, http.MethodPost, "/user/"+itoa(bob.ID)+"/friend-requests/"+itoa(request.ID)+"/accept",
+		bobToken, nil, &accepted)
+	if status != http.StatusOK {
+		t.Fatalf("got status %v accepting, want %v", status, http.StatusOK)
+	}
+	if accepted.Status != types.FriendRequestAccepted {
+		t.Fatalf("accepted request is %v, want %v", accepted.Status, types.FriendRequestAccepted)
+	}
+	ts.expectFriends(t, alice, bob)
+	ts.expectFriends(t, bob, alice)
+}
+
+func TestUnacceptedFriendRequestsMakeNoFriends(t *testing.T) {
+	for _, tc := range []struct {
+		action string
+		// sender resolves the request rather than the recipient
+		sender bool
+	}{
+		{action: "decline"},
+		{action: "cancel", sender: true},
+	} {
+		t.Run(tc.action, func(t *testing.T) {
+			ts := newTestServer(t, testOptions())
+			alice, aliceToken := ts.createUser(t, "alice", "")
+			bob, bobToken := ts.createUser(t, "bob", "")
+			request := ts.sendFriendRequest(t, alice, aliceToken, bob)
+
+			actor, actorToken, other, otherToken := bob, bobToken, alice, aliceToken
+			if tc.sender {
+				actor, actorToken, other, otherToken = alice, aliceToken, bob, bobToken
+			}
+			if status := ts.resolveFriendRequest(t, other, otherToken, request, tc.action); status != http.StatusNotFound {
+				t.Fatalf("got status %v from the wrong user, want %v", status, http.StatusNotFound)
+			}
+			if status := ts.resolveFriendRequest(t, actor, actorToken, request, tc.action); status != http.StatusOK {
+				t.Fatalf("got status %v, want %v", status, http.StatusOK)
+			}
+			ts.expectFriends(t, alice)
+			ts.expectFriends(t, bob)
+
+			var incoming []types.FriendRequest
+			if status := ts.do(t, http.MethodGet, "/user/"+itoa(bob.ID)+"/friend-requests", bobToken, nil, &incoming); status != http.StatusOK {
+				t.Fatalf("got status %v listing requests, want %v", status, http.StatusOK)
+			}
+			if len(incoming) != 0 {
+				t.Fatalf("bob still has %v pending requests", len(incoming))
+			}
+		})
+	}
+}
+
+func TestResolvedFriendRequestIsFinal(t *testing.T) {
+	ts := newTestServer(t, testOptions())
+	alice, aliceToken := ts.createUser(t, "alice", "")
+	bob, bobToken := ts.createUser(t, "bob", "")
+	request := ts.sendFriendRequest(t, alice, aliceToken, bob)
+	if status := ts.resolveFriendRequest(t, bob, bobToken, request, "decline"); status != http.StatusOK {
+		t.Fatalf("got status %v declining, want %v", status, http.StatusOK)
+	}
+
+	for _, tc := range []struct {
+		action string
+		user   types.User
+		token  string
+	}{
+		{"accept", bob, bobToken},
+		{"decline", bob, bobToken},
+		{"cancel", alice, aliceToken},
+	} {
+		if status := ts.resolveFriendRequest(t, tc.user, tc.token, request, tc.action); status != http.StatusConflict {
+			t.Errorf("got status %v trying to %v a declined request, want %v", status, tc.action, http.StatusConflict)
+		}
+	}
+	ts.expectFriends(t, alice)
+	ts.expectFriends(t, bob)
+
+	// Unknown requests can't be resolved either
+	request.ID += 100
+	if status := ts.resolveFriendRequest(t, bob, bobToken, request, "accept"); status != http.StatusNotFound {
+		t.Fatalf("got status %v accepting an unknown request, want %v", status, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,159 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"nearby-friends/types"
+	"net/http"
+
+	"go.uber.org/zap"
+)
+
+// establishFriendship has two users who just became friends follow each
+// other. Sessions on this server are subscribed right away, those on other
+// servers when the event published to them arrives.
+func (wh *RequestHandler) establishFriendship(ctx context.Context, userID, friendID int) {
+	wh.sessions.establishFriendship(ctx, userID, friendID)
+
+	for _, event := range []types.FriendEvent{
+		{UserID: userID, Kind: types.FriendEventFriended, Viewers: []int{userID}, FriendID: friendID},
+		{UserID: friendID, Kind: types.FriendEventFriended, Viewers: []int{friendID}, FriendID: userID},
+	} {
+		if err := wh.userPubSubHandler.BroadcastEvent(ctx, event); err != nil {
+			wh.log.Sugar().Errorf("error publishing %v event for user %v: %v", event.Kind, event.UserID, err)
+		}
+	}
+}
+
+// severFriendship stops two users who are no longer friends from seeing
+// each other. Sessions on this server are torn down right away, those on
+// other servers when the event published to them arrives.
+func (wh *RequestHandler) severFriendship(ctx context.Context, userID, friendID int) {
+	wh.sessions.severFriendship(ctx, userID, friendID)
+	wh.sharing.invalidate(userID, friendID)
+	wh.shares.invalidate(userID, friendID)
+
+	for _, event := range []types.FriendEvent{
+		{UserID: userID, Kind: types.FriendEventUnfriended, Viewers: []int{friendID}},
+		{UserID: friendID, Kind: types.FriendEventUnfriended, Viewers: []int{userID}},
+	} {
+		if err := wh.userPubSubHandler.BroadcastEvent(ctx, event); err != nil {
+			wh.log.Sugar().Errorf("error publishing %v event for user %v: %v", event.Kind, event.UserID, err)
+		}
+	}
+}
+
+// handleFriendEvent applies an event about a user the session follows,
+// published by any server
+func (wh *RequestHandler) handleFriendEvent(session *Session, event types.FriendEvent) {
+	if !event.For(session.userID) {
+		return
+	}
+	switch event.Kind {
+	case types.FriendEventFriended:
+		if err := session.Subscription().Add(session.ctx, event.FriendID); err != nil {
+			wh.log.Sugar().Errorf("error subscribing user %v to new friend %v: %v", session.userID, event.FriendID, err)
+		}
+	case types.FriendEventUnfriended:
+		// The server the friendship ended on only invalidated its own caches
+		wh.sharing.invalidate(event.UserID, session.userID)
+		wh.shares.invalidate(event.UserID, session.userID)
+		if err := session.dropFriend(session.ctx, event.UserID); err != nil {
+			wh.log.Sugar().Errorf("error dropping friend %v from user %v: %v", event.UserID, session.userID, err)
+		}
+	case types.FriendEventVisibility:
+		wh.recheckVisibility(session, event.UserID)
+	case types.FriendEventShareEnded:
+		wh.shareEnded(session, event.UserID, event.ShareID)
+	case types.FriendEventOffline:
+		if err := session.hideFriend(event.UserID, types.OutOfRangeOffline); err != nil {
+			wh.log.Sugar().Errorf("error hiding offline friend %v from user %v: %v", event.UserID, session.userID, err)
+		}
+	}
+}
+
+func (wh *RequestHandler) removeUserFriendship() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := pathParamInt(r, "id")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		friendID, err := pathParamInt(r, "friendID")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := wh.userDBHandler.RemoveFriendship(userID, friendID); err != nil {
+			http.Error(w,
+				fmt.Sprintf("error removing friendship between users %v and %v: %v", userID, friendID, err),
+				dbErrorStatus(err))
+			return
+		}
+		wh.severFriendship(r.Context(), userID, friendID)
+		wh.log.With(
+			zap.Int("user", userID),
+			zap.Int("friend", friendID),
+		).Info("Removed friendship")
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (wh *RequestHandler) blockUser() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := pathParamInt(r, "id")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		blockedID, err := pathParamInt(r, "blockedID")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := wh.userDBHandler.BlockUser(userID, blockedID); err != nil {
+			http.Error(w,
+				fmt.Sprintf("error blocking user %v for user %v: %v", blockedID, userID, err),
+				dbErrorStatus(err))
+			return
+		}
+		wh.severFriendship(r.Context(), userID, blockedID)
+		wh.log.With(
+			zap.Int("user", userID),
+			zap.Int("blocked", blockedID),
+		).Info("Blocked user")
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (wh *RequestHandler) unblockUser() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := pathParamInt(r, "id")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		blockedID, err := pathParamInt(r, "blockedID")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := wh.userDBHandler.UnblockUser(userID, blockedID); err != nil {
+			http.Error(w,
+				fmt.Sprintf("error unblocking user %v for user %v: %v", blockedID, userID, err),
+				dbErrorStatus(err))
+			return
+		}
+		wh.log.With(
+			zap.Int("user", userID),
+			zap.Int("blocked", blockedID),
+		).Info("Unblocked user")
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
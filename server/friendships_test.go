@@ -0,0 +1,101 @@
+package server
+
+import (
+	"nearby-friends/types"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRemovingFriendshipHidesFriends(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		method string
+		path   string
+	}{
+		{name: "unfriend", method: http.MethodDelete, path: "/friends/"},
+		{name: "block", method: http.MethodPut, path: "/blocked/"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ts := newTestServer(t, testOptions())
+			alice, aliceToken := ts.createUser(t, "alice", "")
+			bob, bobToken := ts.createUser(t, "bob", "")
+			ts.befriend(t, alice, bob)
+
+			aliceClient := ts.connect(t, alice, aliceToken)
+			bobClient := ts.connect(t, bob, bobToken)
+			meet(t, aliceClient, bobClient)
+
+			status := ts.do(t, tc.method, "/user/"+itoa(alice.ID)+tc.path+itoa(bob.ID), aliceToken, nil)
+			if status != http.StatusNoContent {
+				t.Fatalf("got status %v, want %v", status, http.StatusNoContent)
+			}
+			aliceClient.expectOutOfRange(bob.ID, "hidden")
+			bobClient.expectOutOfRange(alice.ID, "hidden")
+
+			// Neither hears from the other again
+			aliceClient.send(40.7129, -74.0061)
+			bobClient.send(40.7131, -74.0063)
+			aliceClient.expectNothing(100 * time.Millisecond)
+			bobClient.expectNothing(100 * time.Millisecond)
+		})
+	}
+}
+
+func TestRemovingFriendshipReachesOtherServers(t *testing.T) {
+	ts := newTestServer(t, testOptions())
+	other := newTestServerWith(t, ts.db, ts.pubsub, testOptions())
+	alice, aliceToken := ts.createUser(t, "alice", "")
+	bob, bobToken := ts.createUser(t, "bob", "")
+	ts.befriend(t, alice, bob)
+
+	aliceClient := ts.connect(t, alice, aliceToken)
+	// Bob is served by another replica, with its own caches
+	bobClient := other.connect(t, bob, bobToken)
+	meet(t, aliceClient, bobClient)
+
+	status := ts.do(t, http.MethodDelete, "/user/"+itoa(alice.ID)+"/friends/"+itoa(bob.ID), aliceToken, nil)
+	if status != http.StatusNoContent {
+		t.Fatalf("got status %v, want %v", status, http.StatusNoContent)
+	}
+	aliceClient.expectOutOfRange(bob.ID, "hidden")
+	bobClient.expectOutOfRange(alice.ID, "hidden")
+
+	aliceClient.send(40.7129, -74.0061)
+	bobClient.expectNothing(100 * time.Millisecond)
+}
+
+func TestAcceptingFriendRequestReachesOtherServers(t *testing.T) {
+	ts := newTestServer(t, testOptions())
+	other := newTestServerWith(t, ts.db, ts.pubsub, testOptions())
+	alice, aliceToken := ts.createUser(t, "alice", "")
+	bob, bobToken := ts.createUser(t, "bob", "")
+
+	aliceClient := ts.connect(t, alice, aliceToken)
+	aliceClient.send(40.7128, -74.0060)
+	// Bob is served by another replica and connected before becoming friends
+	bobClient := other.connect(t, bob, bobToken)
+	bobClient.send(40.7130, -74.0062)
+
+	var request types.FriendRequest
+	status := ts.do(t, http.MethodPost, "/user/"+itoa(alice.ID)+"/friend-requests", aliceToken,
+		types.FriendRequest{Friend: bob}, &request)
+	if status != http.StatusCreated {
+		t.Fatalf("got status %v sending the request, want %v", status, http.StatusCreated)
+	}
+	status = ts.do(t, http.MethodPost, "/user/"+itoa(bob.ID)+"/friend-requests/"+itoa(request.ID)+"/accept", bobToken, nil)
+	if status != http.StatusOK {
+		t.Fatalf("got status %v accepting the request, want %v", status, http.StatusOK)
+	}
+
+	// Both follow each other without reconnecting
+	waitFor(t, func() bool {
+		bobClient.send(40.7130, -74.0062)
+		_, ok := aliceClient.tryRead(50 * time.Millisecond)
+		return ok
+	})
+	aliceClient.drain(50 * time.Millisecond)
+	bobClient.drain(50 * time.Millisecond)
+	aliceClient.send(40.7129, -74.0061)
+	bobClient.expectDistance(alice.ID)
+}
@@ -0,0 +1,231 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"nearby-friends/db"
+	"nearby-friends/types"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// historyQueueSize is how many accepted locations can wait to be
+	// written before new ones are dropped
+	historyQueueSize = 1024
+	// historyBatchSize is the most locations written in one transaction
+	historyBatchSize = 128
+	// historyFlushInterval is how long a partial batch waits to be written
+	historyFlushInterval = time.Second
+	// historyPruneInterval is how often history past the retention is deleted
+	historyPruneInterval = time.Hour
+
+	// defaultHistoryWindow is the range returned when no from is given
+	defaultHistoryWindow = 24 * time.Hour
+	// maxHistoryPoints is the most points returned by one history query
+	maxHistoryPoints = 10000
+)
+
+// historyRecorder appends accepted locations to the db in the background so
+// a slow db never holds up a location socket. Locations are dropped rather
+// than queued without bound when the db falls behind.
+type historyRecorder struct {
+	db        db.DBHandler
+	queue     chan types.UserLocation
+	retention time.Duration
+	cancel    context.CancelFunc
+	done      chan struct{}
+	log       *zap.Logger
+}
+
+func newHistoryRecorder(db db.DBHandler, retention time.Duration, log *zap.Logger) *historyRecorder {
+	return &historyRecorder{
+		db:        db,
+		queue:     make(chan types.UserLocation, historyQueueSize),
+		retention: retention,
+		done:      make(chan struct{}),
+		log:       log,
+	}
+}
+
+// start runs the recorder until ctx is done or stop is called
+func (hr *historyRecorder) start(ctx context.Context) {
+	ctx, hr.cancel = context.WithCancel(ctx)
+	go hr.run(ctx)
+}
+
+// stop writes the locations still queued and waits for the recorder to
+// finish, or for ctx to be done
+func (hr *historyRecorder) stop(ctx context.Context) error {
+	hr.cancel()
+	select {
+	case <-hr.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("location history still being written: %v", ctx.Err())
+	}
+}
+
+// record stamps the location with the time it was accepted and queues it
+func (hr *historyRecorder) record(location types.UserLocation) {
+	location.LastUpdateTime = time.Now()
+	select {
+	case hr.queue <- location:
+	default:
+		hr.log.Warn("location history queue is full, dropping location", zap.Int("user", location.ID))
+	}
+}
+
+// run writes queued locations in batches and prunes expired history until
+// the context is done, writing whatever is still queued before returning
+func (hr *historyRecorder) run(ctx context.Context) {
+	defer close(hr.done)
+	flush := time.NewTicker(historyFlushInterval)
+	defer flush.Stop()
+	prune := time.NewTicker(historyPruneInterval)
+	defer prune.Stop()
+
+	hr.prune()
+	batch := make([]types.UserLocation, 0, historyBatchSize)
+	write := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := hr.db.AppendLocationHistory(batch); err != nil {
+			hr.log.Sugar().Errorf("error writing %v locations to history: %v", len(batch), err)
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			for {
+				select {
+				case location := <-hr.queue:
+					batch = append(batch, location)
+					if len(batch) == historyBatchSize {
+						write()
+					}
+				default:
+					write()
+					return
+				}
+			}
+		case location := <-hr.queue:
+			batch = append(batch, location)
+			if len(batch) == historyBatchSize {
+				write()
+			}
+		case <-flush.C:
+			write()
+		case <-prune.C:
+			hr.prune()
+		}
+	}
+}
+
+func (hr *historyRecorder) prune() {
+	if hr.retention <= 0 {
+		return
+	}
+	pruned, err := hr.db.PruneLocationHistory(time.Now().Add(-hr.retention))
+	if err != nil {
+		hr.log.Sugar().Errorf("error pruning location history: %v", err)
+		return
+	}
+	if pruned > 0 {
+		hr.log.Info("Pruned location history", zap.Int64("locations", pruned))
+	}
+}
+
+// recordHistory adds the location to the user's history if history is on
+func (wh *RequestHandler) recordHistory(location types.UserLocation) {
+	if wh.history != nil {
+		wh.history.record(location)
+	}
+}
+
+func historyRange(r *http.Request) (time.Time, time.Time, error) {
+	return HistoryRange(r.URL.Query().Get("from"), r.URL.Query().Get("to"))
+}
+
+// HistoryRange parses from and to as RFC 3339 times. To defaults to now and
+// from to defaultHistoryWindow before to.
+func HistoryRange(from, to string) (time.Time, time.Time, error) {
+	end := time.Now()
+	if to != "" {
+		parsed, err := time.Parse(time.RFC3339, to)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("Invalid 'to' time '%v': %v", to, err)
+		}
+		end = parsed
+	}
+	start := end.Add(-defaultHistoryWindow)
+	if from != "" {
+		parsed, err := time.Parse(time.RFC3339, from)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("Invalid 'from' time '%v': %v", from, err)
+		}
+		start = parsed
+	}
+	if !start.Before(end) {
+		return time.Time{}, time.Time{}, fmt.Errorf("Invalid range: 'from' %v is not before 'to' %v", start, end)
+	}
+	return start, end, nil
+}
+
+// LocationTrack loads the user's history between from and to, at most
+// maxHistoryPoints of it
+func LocationTrack(userDBHandler db.DBHandler, userID int, from, to time.Time) (types.LocationTrack, error) {
+	// Ask for one point more than returned to know if any were left out
+	points, err := userDBHandler.ListLocationHistory(userID, from, to, maxHistoryPoints+1)
+	if err != nil {
+		return types.LocationTrack{}, fmt.Errorf("error getting location history for user %v: %v", userID, err)
+	}
+	track := types.LocationTrack{
+		UserID: userID,
+		From:   from,
+		To:     to,
+		Points: points,
+	}
+	if len(points) > maxHistoryPoints {
+		track.Points, track.Truncated = points[:maxHistoryPoints], true
+	}
+	return track, nil
+}
+
+// getLocationHistory returns the user's track between the from and to
+// query params
+func (wh *RequestHandler) getLocationHistory() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := pathParamInt(r, "id")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if wh.history == nil {
+			writeGenericError(w, fmt.Errorf("location history is not enabled on this server"), http.StatusNotFound)
+			return
+		}
+
+		from, to, err := historyRange(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		track, err := LocationTrack(wh.userDBHandler, userID, from, to)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(track)
+	}
+}
@@ -0,0 +1,199 @@
+package server
+
+import (
+	"context"
+	"nearby-friends/types"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// historyLength is how many points of the user's history are written
+func (ts *testServer) historyLength(t *testing.T, userID int) int {
+	t.Helper()
+	points, err := ts.db.ListLocationHistory(userID, time.Time{}, time.Now().Add(time.Hour), maxHistoryPoints)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(points)
+}
+
+// startHistoryRecorder records the history of the test server's users until
+// the test ends
+func (ts *testServer) startHistoryRecorder(t *testing.T, retention time.Duration) *historyRecorder {
+	t.Helper()
+	recorder := newHistoryRecorder(ts.db, retention, zap.NewNop())
+	recorder.start(context.Background())
+	t.Cleanup(func() { recorder.stop(context.Background()) })
+	return recorder
+}
+
+func locatedAt(user types.User, latitude float64, recordedAt time.Time) types.UserLocation {
+	return types.UserLocation{User: &user, Latitude: latitude, Longitude: -74.0060, LastUpdateTime: recordedAt}
+}
+
+func TestHistoryRecorderBatches(t *testing.T) {
+	ts := newTestServer(t, testOptions())
+	alice, _ := ts.createUser(t, "alice", "")
+	recorder := ts.startHistoryRecorder(t, 0)
+
+	// A full batch is written right away, the rest waits for the flush
+	for i := 0; i <= historyBatchSize; i++ {
+		recorder.record(locatedAt(alice, 40.7128, time.Time{}))
+	}
+	waitFor(t, func() bool { return ts.historyLength(t, alice.ID) >= historyBatchSize })
+	if got := ts.historyLength(t, alice.ID); got != historyBatchSize {
+		t.Fatalf("%v locations written before the flush, want a batch of %v", got, historyBatchSize)
+	}
+	waitFor(t, func() bool { return ts.historyLength(t, alice.ID) == historyBatchSize+1 })
+}
+
+func TestHistoryRecorderFlushesOnStop(t *testing.T) {
+	ts := newTestServer(t, testOptions())
+	alice, _ := ts.createUser(t, "alice", "")
+	recorder := newHistoryRecorder(ts.db, 0, zap.NewNop())
+	recorder.start(context.Background())
+
+	for i := 0; i < 3; i++ {
+		recorder.record(locatedAt(alice, 40.7128, time.Time{}))
+	}
+	if err := recorder.stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := ts.historyLength(t, alice.ID); got != 3 {
+		t.Fatalf("%v locations written by stop, want 3", got)
+	}
+}
+
+func TestHistoryRecorderPrunes(t *testing.T) {
+	ts := newTestServer(t, testOptions())
+	alice, _ := ts.createUser(t, "alice", "")
+	now := time.Now()
+	err := ts.db.AppendLocationHistory([]types.UserLocation{
+		locatedAt(alice, 1, now.Add(-3*time.Hour)),
+		locatedAt(alice, 2, now.Add(-2*time.Hour)),
+		locatedAt(alice, 3, now.Add(-time.Minute)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The recorder prunes when it starts and every historyPruneInterval
+	ts.startHistoryRecorder(t, time.Hour)
+	waitFor(t, func() bool { return ts.historyLength(t, alice.ID) == 1 })
+	points, err := ts.db.ListLocationHistory(alice.ID, time.Time{}, now.Add(time.Hour), maxHistoryPoints)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if points[0].Latitude != 3 {
+		t.Fatalf("kept %+v, want the location within the retention", points[0])
+	}
+}
+
+func TestHistoryRange(t *testing.T) {
+	to := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		name     string
+		from, to string
+		wantFrom time.Time
+		wantErr  bool
+	}{
+		{name: "default window", to: to.Format(time.RFC3339), wantFrom: to.Add(-defaultHistoryWindow)},
+		{name: "both", from: "2024-04-01T00:00:00Z", to: to.Format(time.RFC3339), wantFrom: time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)},
+		{name: "from equal to to", from: to.Format(time.RFC3339), to: to.Format(time.RFC3339), wantErr: true},
+		{name: "from after to", from: "2024-06-01T00:00:00Z", to: to.Format(time.RFC3339), wantErr: true},
+		{name: "invalid from", from: "yesterday", to: to.Format(time.RFC3339), wantErr: true},
+		{name: "invalid to", to: "2024-05-01", wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			from, end, err := HistoryRange(tc.from, tc.to)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("got range %v to %v, want an error", from, end)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !from.Equal(tc.wantFrom) || !end.Equal(to) {
+				t.Fatalf("got range %v to %v, want %v to %v", from, end, tc.wantFrom, to)
+			}
+		})
+	}
+
+	// To defaults to now
+	before := time.Now()
+	from, end, err := HistoryRange("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if end.Before(before) || end.After(time.Now()) || !from.Equal(end.Add(-defaultHistoryWindow)) {
+		t.Fatalf("got range %v to %v, want the last %v", from, end, defaultHistoryWindow)
+	}
+}
+
+func TestGetLocationHistory(t *testing.T) {
+	options := testOptions()
+	options.History = true
+	ts := newTestServer(t, options)
+	alice, aliceToken := ts.createUser(t, "alice", "")
+	bob, bobToken := ts.createUser(t, "bob", "")
+
+	// Accepted locations are recorded
+	ts.connect(t, alice, aliceToken).send(40.7128, -74.0060)
+	waitFor(t, func() bool { return ts.historyLength(t, alice.ID) == 1 })
+
+	getHistory := func(user types.User, token string, query url.Values) (types.LocationTrack, int) {
+		t.Helper()
+		var track types.LocationTrack
+		status := ts.do(t, http.MethodGet, "/user/"+itoa(user.ID)+"/history?"+query.Encode(), token, nil, &track)
+		return track, status
+	}
+	track, status := getHistory(alice, aliceToken, nil)
+	if status != http.StatusOK {
+		t.Fatalf("got status %v, want %v", status, http.StatusOK)
+	}
+	if len(track.Points) != 1 || track.Points[0].Latitude != 40.7128 || track.Truncated {
+		t.Fatalf("got track %+v, want the location sent", track)
+	}
+
+	// Bob has more history than one query returns, part of it outside the
+	// default window
+	now := time.Now()
+	locations := []types.UserLocation{locatedAt(bob, 1, now.Add(-2*defaultHistoryWindow))}
+	for i := 0; i < maxHistoryPoints+1; i++ {
+		locations = append(locations, locatedAt(bob, 2, now.Add(-time.Duration(i+1)*time.Second)))
+	}
+	if err := ts.db.AppendLocationHistory(locations); err != nil {
+		t.Fatal(err)
+	}
+	track, status = getHistory(bob, bobToken, nil)
+	if status != http.StatusOK {
+		t.Fatalf("got status %v, want %v", status, http.StatusOK)
+	}
+	if len(track.Points) != maxHistoryPoints || !track.Truncated {
+		t.Fatalf("got %v points, truncated %v, want %v truncated", len(track.Points), track.Truncated, maxHistoryPoints)
+	}
+	for _, point := range track.Points {
+		if point.Latitude != 2 {
+			t.Fatalf("got %+v outside the default window", point)
+		}
+	}
+
+	query := url.Values{"from": {now.Format(time.RFC3339)}, "to": {now.Add(-time.Hour).Format(time.RFC3339)}}
+	if _, status := getHistory(bob, bobToken, query); status != http.StatusBadRequest {
+		t.Fatalf("got status %v for a range ending before it starts, want %v", status, http.StatusBadRequest)
+	}
+}
+
+func TestLocationHistoryDisabled(t *testing.T) {
+	ts := newTestServer(t, testOptions())
+	alice, aliceToken := ts.createUser(t, "alice", "")
+	if status := ts.do(t, http.MethodGet, "/user/"+itoa(alice.ID)+"/history", aliceToken, nil); status != http.StatusNotFound {
+		t.Fatalf("got status %v with history off, want %v", status, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,299 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"nearby-friends/db"
+	"nearby-friends/types"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// maxLocationShareDuration bounds how long a single location share can run
+const maxLocationShareDuration = 7 * 24 * time.Hour
+
+// sharesCache holds the outgoing location shares of users seen by this
+// server. Shares stay cached after they expire and are filtered on use.
+type sharesCache = userCache[[]types.LocationShare]
+
+func newSharesCache() *sharesCache {
+	return newUserCache[[]types.LocationShare]()
+}
+
+// activeShare returns the active share the sharer holds with the viewer that
+// expires last, or nil if there is none
+func (wh *RequestHandler) activeShare(sharerID, viewerID int) (*types.LocationShare, error) {
+	shares, ok := wh.shares.get(sharerID)
+	if !ok {
+		var err error
+		shares, err = wh.userDBHandler.ListLocationShares(sharerID)
+		if err != nil {
+			return nil, err
+		}
+		wh.shares.set(sharerID, shares)
+	}
+
+	var active *types.LocationShare
+	now := time.Now()
+	for i, share := range shares {
+		if share.Friend.ID != viewerID || !share.Active(now) {
+			continue
+		}
+		if active == nil || share.ExpiresAt.After(active.ExpiresAt) {
+			active = &shares[i]
+		}
+	}
+	return active, nil
+}
+
+// sharingRank orders sharing levels from least to most revealing
+func sharingRank(level types.SharingLevel) int {
+	switch level {
+	case types.SharingApproximate:
+		return 1
+	case types.SharingPrecise:
+		return 2
+	default:
+		return 0
+	}
+}
+
+// watchedShare is a share a session waits on to run out
+type watchedShare struct {
+	share   types.LocationShare
+	timer   *time.Timer
+	expired func(types.LocationShare)
+}
+
+// shareExpiries tells a session's user when a location share they are
+// receiving runs out. Pending timers are stopped when the session ends.
+type shareExpiries struct {
+	mu      sync.Mutex
+	watched map[int]*watchedShare
+	done    bool
+}
+
+func newShareExpiries(ctx context.Context) *shareExpiries {
+	expiries := &shareExpiries{watched: make(map[int]*watchedShare)}
+	context.AfterFunc(ctx, expiries.stop)
+	return expiries
+}
+
+// watch calls expired once the share runs out. Shares already watched are
+// ignored.
+func (se *shareExpiries) watch(share types.LocationShare, expired func(types.LocationShare)) {
+	se.mu.Lock()
+	defer se.mu.Unlock()
+	if se.done {
+		return
+	}
+	if _, ok := se.watched[share.ID]; ok {
+		return
+	}
+	watched := &watchedShare{share: share, expired: expired}
+	watched.timer = time.AfterFunc(time.Until(share.ExpiresAt), func() {
+		if se.take(share.ID) != nil {
+			expired(share)
+		}
+	})
+	se.watched[share.ID] = watched
+}
+
+// end runs the expiry of a share that was ended early right away, with the
+// time it ended at. It reports false for shares that aren't watched.
+func (se *shareExpiries) end(shareID int, endedAt time.Time) bool {
+	watched := se.take(shareID)
+	if watched == nil {
+		return false
+	}
+	watched.timer.Stop()
+	share := watched.share
+	share.ExpiresAt = endedAt
+	watched.expired(share)
+	return true
+}
+
+// take stops watching the share, returning it unless it wasn't watched.
+// Only one caller gets to run a share's expiry.
+func (se *shareExpiries) take(shareID int) *watchedShare {
+	se.mu.Lock()
+	defer se.mu.Unlock()
+	watched, ok := se.watched[shareID]
+	if !ok {
+		return nil
+	}
+	delete(se.watched, shareID)
+	return watched
+}
+
+func (se *shareExpiries) stop() {
+	se.mu.Lock()
+	defer se.mu.Unlock()
+	se.done = true
+	for id, watched := range se.watched {
+		watched.timer.Stop()
+		delete(se.watched, id)
+	}
+}
+
+// watchShareExpiry tells the viewer when the share the sharer holds with
+// them runs out, and takes the sharer out of range if the viewer can no
+// longer see them at all
+func (wh *RequestHandler) watchShareExpiry(session *Session, sharerID int) {
+	viewerID, socket := session.userID, session.socket
+	share, err := wh.activeShare(sharerID, viewerID)
+	if err != nil {
+		wh.log.Sugar().Errorf("error loading location shares for user %v: %v", sharerID, err)
+		return
+	}
+	if share == nil {
+		return
+	}
+	session.expiries.watch(*share, func(share types.LocationShare) {
+		if err := socket.write(types.MessageShareExpired, share); err != nil {
+			wh.log.Sugar().Errorf("error writing share expired to user %v: %v", viewerID, err)
+		}
+		if wh.sharingLevel(sharerID, viewerID) != types.SharingOff {
+			return
+		}
+		if err := session.hideFriend(sharerID, types.OutOfRangeHidden); err != nil {
+			wh.log.Sugar().Errorf("error writing friend out of range after share expired to user %v: %v", viewerID, err)
+		}
+	})
+}
+
+// shareEnded tells the viewer a share they were receiving was ended early
+// and hides the sharer if the viewer can no longer see them
+func (wh *RequestHandler) shareEnded(session *Session, sharerID, shareID int) {
+	// The server the share was ended on only invalidated its own cache
+	wh.shares.invalidate(sharerID)
+	if !session.expiries.end(shareID, time.Now()) {
+		wh.recheckVisibility(session, sharerID)
+	}
+}
+
+// createLocationShares shares the user's location with the friends in the
+// request body for the requested duration
+func (wh *RequestHandler) createLocationShares() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := pathParamInt(r, "id")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var request types.LocationShareRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w,
+				fmt.Sprintf("Invalid request body: %v", err),
+				http.StatusBadRequest)
+			return
+		}
+		duration, err := time.ParseDuration(request.Duration)
+		if err != nil {
+			writeGenericError(w,
+				fmt.Errorf("%w: invalid duration '%v'", db.ErrInvalidLocationShare, request.Duration),
+				http.StatusBadRequest)
+			return
+		}
+		if duration <= 0 || duration > maxLocationShareDuration {
+			writeGenericError(w,
+				fmt.Errorf("%w: duration must be positive and at most %v", db.ErrInvalidLocationShare, maxLocationShareDuration),
+				http.StatusBadRequest)
+			return
+		}
+
+		shares, err := wh.userDBHandler.CreateLocationShares(userID, request.Friends, request.Level, time.Now().Add(duration))
+		if err != nil {
+			writeGenericError(w, err, dbErrorStatus(err))
+			return
+		}
+		wh.shares.invalidate(userID)
+		wh.log.With(
+			zap.Int("user", userID),
+			zap.Int("friends", len(shares)),
+			zap.Duration("duration", duration),
+		).Info("Created location shares")
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(shares)
+	}
+}
+
+// listLocationShares returns the user's active shares. Shares friends hold
+// with the user are returned with ?direction=incoming.
+func (wh *RequestHandler) listLocationShares() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := pathParamInt(r, "id")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var shares []types.LocationShare
+		switch direction := r.URL.Query().Get("direction"); direction {
+		case "", "outgoing":
+			shares, err = wh.userDBHandler.ListLocationShares(userID)
+		case "incoming":
+			shares, err = wh.userDBHandler.ListIncomingLocationShares(userID)
+		default:
+			http.Error(w,
+				fmt.Sprintf("Invalid direction '%v', expected 'incoming' or 'outgoing'", direction),
+				http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w,
+				fmt.Sprintf("error listing location shares for user %v: %v", userID, err),
+				http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(shares)
+	}
+}
+
+// endLocationShare stops one of the user's shares before it runs out
+func (wh *RequestHandler) endLocationShare() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := pathParamInt(r, "id")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		shareID, err := pathParamInt(r, "shareID")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		share, err := wh.userDBHandler.EndLocationShare(userID, shareID)
+		if err != nil {
+			writeGenericError(w, err, dbErrorStatus(err))
+			return
+		}
+		wh.shares.invalidate(userID)
+		event := types.FriendEvent{
+			UserID:  userID,
+			Kind:    types.FriendEventShareEnded,
+			Viewers: []int{share.Friend.ID},
+			ShareID: share.ID,
+		}
+		if err := wh.userPubSubHandler.BroadcastEvent(r.Context(), event); err != nil {
+			wh.log.Sugar().Errorf("error publishing %v event for user %v: %v", event.Kind, userID, err)
+		}
+		wh.log.With(
+			zap.Int("user", userID),
+			zap.Int("share", shareID),
+		).Info("Ended location share")
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"context"
+	"nearby-friends/types"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestEndingShareEarlyHidesSharer(t *testing.T) {
+	ts := newTestServer(t, testOptions())
+	other := newTestServerWith(t, ts.db, ts.pubsub, testOptions())
+	alice, aliceToken := ts.createUser(t, "alice", "")
+	bob, bobToken := ts.createUser(t, "bob", "")
+	ts.befriend(t, alice, bob)
+
+	// Alice only shows bob her location through the share
+	path := "/user/" + itoa(alice.ID)
+	if status := ts.do(t, http.MethodPut, path+"/sharing/"+itoa(bob.ID), aliceToken,
+		types.FriendSharing{Level: types.SharingOff}); status != http.StatusOK {
+		t.Fatalf("got status %v setting sharing, want %v", status, http.StatusOK)
+	}
+	var shares []types.LocationShare
+	if status := ts.do(t, http.MethodPost, path+"/shares", aliceToken, types.LocationShareRequest{
+		Friends:  []types.User{bob},
+		Duration: "1h",
+		Level:    types.SharingPrecise,
+	}, &shares); status != http.StatusCreated || len(shares) != 1 {
+		t.Fatalf("got status %v and %v shares, want %v and 1", status, len(shares), http.StatusCreated)
+	}
+
+	aliceClient := ts.connect(t, alice, aliceToken)
+	// Bob is served by another replica
+	bobClient := other.connect(t, bob, bobToken)
+	meet(t, aliceClient, bobClient)
+
+	if status := ts.do(t, http.MethodDelete, path+"/shares/"+itoa(shares[0].ID), aliceToken, nil); status != http.StatusNoContent {
+		t.Fatalf("got status %v ending the share, want %v", status, http.StatusNoContent)
+	}
+	var ended types.LocationShare
+	bobClient.expect(types.MessageShareExpired, &ended)
+	if ended.ID != shares[0].ID || !ended.ExpiresAt.Before(shares[0].ExpiresAt) {
+		t.Fatalf("got share %+v expired, want share %v ended early", ended, shares[0].ID)
+	}
+	bobClient.expectOutOfRange(alice.ID, types.OutOfRangeHidden)
+
+	aliceClient.send(40.7128, -74.0060)
+	bobClient.expectNothing(100 * time.Millisecond)
+}
+
+func TestShareExpiriesEnd(t *testing.T) {
+	expiries := newShareExpiries(context.Background())
+	expired := make(chan types.LocationShare, 1)
+	share := types.LocationShare{ID: 1, ExpiresAt: time.Now().Add(time.Hour)}
+	expiries.watch(share, func(share types.LocationShare) { expired <- share })
+
+	endedAt := time.Now()
+	if !expiries.end(1, endedAt) {
+		t.Fatal("a watched share wasn't ended")
+	}
+	if got := <-expired; !got.ExpiresAt.Equal(endedAt) {
+		t.Fatalf("share expired at %v, want when it ended %v", got.ExpiresAt, endedAt)
+	}
+	if expiries.end(1, endedAt) {
+		t.Fatal("a share was ended twice")
+	}
+}
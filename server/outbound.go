@@ -0,0 +1,184 @@
+package server
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"nearby-friends/types"
+	"slices"
+	"sync"
+)
+
+// DropPolicy is what a session does with new messages when its outbound
+// queue is full because the client can't keep up
+type DropPolicy string
+
+const (
+	// DropOldest discards the oldest queued message
+	DropOldest DropPolicy = "drop-oldest"
+	// DropCoalesce keeps only the latest distance per friend, and discards
+	// the oldest message if the queue is still full
+	DropCoalesce DropPolicy = "coalesce"
+	// DropDisconnect closes the connection of the slow client
+	DropDisconnect DropPolicy = "disconnect"
+)
+
+// Valid reports whether the policy is one the queue knows
+func (p DropPolicy) Valid() bool {
+	return p == DropOldest || p == DropCoalesce || p == DropDisconnect
+}
+
+// outboundMetrics counts, across all sessions, the messages written to
+// clients and the ones that never made it. Served on /debug/vars.
+var outboundMetrics = expvar.NewMap("outbound")
+
+// outboundMessage is a payload waiting to be written. The envelope, and its
+// sequence number, are only added when it is written so coalescing never
+// leaves gaps in the sequence.
+type outboundMessage struct {
+	messageType types.MessageType
+	payload     json.RawMessage
+	// friendID is set for friend distances, which coalesce per friend
+	friendID int
+}
+
+// outboundQueue holds the messages a session's writer hasn't written yet.
+// It never grows past size, making room according to the drop policy. A
+// paused queue keeps accepting messages while its session waits to be
+// resumed, but hands none to the writer.
+type outboundQueue struct {
+	mu         sync.Mutex
+	cond       *sync.Cond
+	messages   []outboundMessage
+	size       int
+	policy     DropPolicy
+	closed     bool
+	overflowed bool
+	paused     bool
+	// dropped counts the messages discarded to make room
+	dropped int64
+}
+
+func newOutboundQueue(size int, policy DropPolicy) *outboundQueue {
+	if size < 1 {
+		size = 1
+	}
+	q := &outboundQueue{size: size, policy: policy}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// push queues the message. It fails once the queue is closed, or overflowed
+// under the disconnect policy.
+func (q *outboundQueue) push(message outboundMessage) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.overflowed {
+		return errSlowConsumer
+	}
+	if q.closed {
+		return errSessionClosed
+	}
+
+	if q.policy == DropCoalesce && message.friendID != 0 {
+		for i, queued := range q.messages {
+			if queued.messageType == message.messageType && queued.friendID == message.friendID {
+				// Move to the back so it stays ordered after anything
+				// queued for the friend in the meantime
+				q.messages = append(q.messages[:i], q.messages[i+1:]...)
+				outboundMetrics.Add("coalesced", 1)
+				break
+			}
+		}
+	}
+
+	if len(q.messages) >= q.size {
+		if q.policy == DropDisconnect {
+			q.overflowed = true
+			q.messages = nil
+			outboundMetrics.Add("disconnected", 1)
+			q.cond.Signal()
+			return errSlowConsumer
+		}
+		q.messages = q.messages[1:]
+		q.dropped++
+		outboundMetrics.Add("dropped", 1)
+	}
+	q.messages = append(q.messages, message)
+	q.cond.Signal()
+	return nil
+}
+
+// wait blocks until there are messages to write and takes them. It reports
+// false once the queue is closed and drained, overflowed or paused.
+func (q *outboundQueue) wait() ([]outboundMessage, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.messages) == 0 && !q.closed && !q.overflowed && !q.paused {
+		q.cond.Wait()
+	}
+	if q.overflowed || q.paused || len(q.messages) == 0 {
+		return nil, false
+	}
+	messages := q.messages
+	q.messages = nil
+	return messages, true
+}
+
+// close stops new messages from being queued. Messages already queued are
+// still handed to the writer.
+func (q *outboundQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.cond.Signal()
+}
+
+// requeue puts messages the writer took but couldn't write back in front
+func (q *outboundQueue) requeue(messages []outboundMessage) {
+	if len(messages) == 0 {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.messages = append(slices.Clone(messages), q.messages...)
+}
+
+// pause stops handing messages to the writer, which returns, until unpause
+func (q *outboundQueue) pause() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.paused = true
+	q.cond.Signal()
+}
+
+func (q *outboundQueue) unpause() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.paused = false
+}
+
+// droppedCount is how many messages were discarded so far
+func (q *outboundQueue) droppedCount() int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.dropped
+}
+
+func (q *outboundQueue) isOverflowed() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.overflowed
+}
+
+func marshalOutbound(messageType types.MessageType, payload any) (outboundMessage, error) {
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return outboundMessage{}, fmt.Errorf("error marshaling %v message to JSON: %v", messageType, err)
+	}
+	message := outboundMessage{messageType: messageType, payload: raw}
+	if distance, ok := payload.(types.UserDistance); ok && distance.Remote != nil {
+		message.friendID = distance.Remote.ID
+	}
+	return message, nil
+}
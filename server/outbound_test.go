@@ -0,0 +1,217 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"nearby-friends/types"
+	"testing"
+	"time"
+)
+
+func outboundCount(name string) int64 {
+	if counter, ok := outboundMetrics.Get(name).(*expvar.Int); ok {
+		return counter.Value()
+	}
+	return 0
+}
+
+func distanceTo(t *testing.T, friendID int, distance float64) outboundMessage {
+	t.Helper()
+	message, err := marshalOutbound(types.MessageFriendDistance, types.UserDistance{
+		Primary:  &types.User{ID: 1},
+		Remote:   &types.User{ID: friendID},
+		Distance: distance,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return message
+}
+
+func errorMessage(t *testing.T, text string) outboundMessage {
+	t.Helper()
+	message, err := marshalOutbound(types.MessageError, types.NewGenericError(errors.New(text), 500))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return message
+}
+
+// takeQueued takes what the queue holds without waiting
+func takeQueued(t *testing.T, q *outboundQueue) []outboundMessage {
+	t.Helper()
+	q.close()
+	messages, _ := q.wait()
+	return messages
+}
+
+func distances(t *testing.T, messages []outboundMessage) []float64 {
+	t.Helper()
+	var values []float64
+	for _, message := range messages {
+		var distance types.UserDistance
+		if err := json.Unmarshal(message.payload, &distance); err != nil {
+			t.Fatal(err)
+		}
+		values = append(values, distance.Distance)
+	}
+	return values
+}
+
+func TestOutboundDropOldest(t *testing.T) {
+	q := newOutboundQueue(3, DropOldest)
+	dropped := outboundCount("dropped")
+	for i := 1; i <= 5; i++ {
+		if err := q.push(distanceTo(t, 2, float64(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := distances(t, takeQueued(t, q)); len(got) != 3 || got[0] != 3 || got[2] != 5 {
+		t.Fatalf("queued distances %v, want the latest 3", got)
+	}
+	if q.droppedCount() != 2 {
+		t.Fatalf("queue dropped %v messages, want 2", q.droppedCount())
+	}
+	if got := outboundCount("dropped") - dropped; got != 2 {
+		t.Fatalf("dropped counter went up by %v, want 2", got)
+	}
+}
+
+func TestOutboundCoalesce(t *testing.T) {
+	q := newOutboundQueue(3, DropCoalesce)
+	coalesced := outboundCount("coalesced")
+	dropped := outboundCount("dropped")
+	for _, message := range []outboundMessage{
+		distanceTo(t, 2, 1),
+		distanceTo(t, 3, 1),
+		distanceTo(t, 2, 2),
+		distanceTo(t, 2, 3),
+	} {
+		if err := q.push(message); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Only the latest distance to friend 2 is left, after friend 3's
+	queued := takeQueued(t, q)
+	if len(queued) != 2 || queued[0].friendID != 3 || queued[1].friendID != 2 {
+		t.Fatalf("queued %+v, want friend 3 then friend 2", queued)
+	}
+	if got := distances(t, queued[1:]); got[0] != 3 {
+		t.Fatalf("queued distance %v to friend 2, want the latest, 3", got[0])
+	}
+	if got := outboundCount("coalesced") - coalesced; got != 2 {
+		t.Fatalf("coalesced counter went up by %v, want 2", got)
+	}
+	if outboundCount("dropped") != dropped || q.droppedCount() != 0 {
+		t.Fatal("messages were dropped while they could be coalesced")
+	}
+}
+
+func TestOutboundCoalesceDropsOldestWhenFull(t *testing.T) {
+	q := newOutboundQueue(2, DropCoalesce)
+	for _, message := range []outboundMessage{
+		errorMessage(t, "first"),
+		distanceTo(t, 2, 1),
+		distanceTo(t, 3, 1),
+	} {
+		if err := q.push(message); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	queued := takeQueued(t, q)
+	if len(queued) != 2 || queued[0].friendID != 2 || queued[1].friendID != 3 {
+		t.Fatalf("queued %+v, want the distances to friends 2 and 3", queued)
+	}
+	if q.droppedCount() != 1 {
+		t.Fatalf("queue dropped %v messages, want 1", q.droppedCount())
+	}
+}
+
+func TestOutboundDisconnect(t *testing.T) {
+	q := newOutboundQueue(2, DropDisconnect)
+	disconnected := outboundCount("disconnected")
+	for i := 1; i <= 2; i++ {
+		if err := q.push(distanceTo(t, 2, float64(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := q.push(distanceTo(t, 2, 3)); !errors.Is(err, errSlowConsumer) {
+		t.Fatalf("got %v overflowing the queue, want %v", err, errSlowConsumer)
+	}
+	if err := q.push(distanceTo(t, 2, 4)); !errors.Is(err, errSlowConsumer) {
+		t.Fatalf("got %v after the queue overflowed, want %v", err, errSlowConsumer)
+	}
+	if !q.isOverflowed() {
+		t.Fatal("queue isn't marked overflowed")
+	}
+	if messages, ok := q.wait(); ok || len(messages) != 0 {
+		t.Fatalf("writer was handed %v messages of an overflowed queue", len(messages))
+	}
+	if got := outboundCount("disconnected") - disconnected; got != 1 {
+		t.Fatalf("disconnected counter went up by %v, want 1", got)
+	}
+}
+
+func TestOutboundRequeueAndPause(t *testing.T) {
+	q := newOutboundQueue(4, DropOldest)
+	for i := 1; i <= 3; i++ {
+		q.push(distanceTo(t, 2, float64(i)))
+	}
+	taken, ok := q.wait()
+	if !ok || len(taken) != 3 {
+		t.Fatalf("writer took %v messages, want 3", len(taken))
+	}
+	q.push(distanceTo(t, 2, 4))
+	// The writer only managed the first message
+	q.requeue(taken[1:])
+
+	q.pause()
+	q.push(distanceTo(t, 2, 5))
+	if messages, ok := q.wait(); ok || len(messages) != 0 {
+		t.Fatal("a paused queue handed messages to the writer")
+	}
+	q.unpause()
+
+	if got := distances(t, takeQueued(t, q)); len(got) != 4 || got[0] != 2 || got[3] != 5 {
+		t.Fatalf("queued distances %v, want the unwritten 2 and 3 before 4 and 5", got)
+	}
+	if err := q.push(distanceTo(t, 2, 6)); !errors.Is(err, errSessionClosed) {
+		t.Fatalf("got %v pushing to a closed queue, want %v", err, errSessionClosed)
+	}
+}
+
+func TestSlowClientDisconnected(t *testing.T) {
+	options := testOptions()
+	options.OutboundQueueSize = 2
+	options.DropPolicy = DropDisconnect
+	ts := newTestServer(t, options)
+	alice, aliceToken := ts.createUser(t, "alice", "")
+	bob, bobToken := ts.createUser(t, "bob", "")
+	ts.befriend(t, alice, bob)
+
+	aliceClient := ts.connect(t, alice, aliceToken)
+	bobClient := ts.connect(t, bob, bobToken)
+	meet(t, aliceClient, bobClient)
+
+	// Bob's writer is stuck while Alice keeps moving
+	bobSession := ts.handler.sessions.sessions(bob.ID)[0]
+	bobSession.socket.mu.Lock()
+	for i := 0; i < 5; i++ {
+		aliceClient.send(40.7128, -74.0060+float64(i)/100000)
+	}
+	bobSession.socket.mu.Unlock()
+
+	select {
+	case <-bobClient.closed:
+	case <-time.After(testMessageTimeout):
+		t.Fatal("the slow client is still connected")
+	}
+	waitFor(t, func() bool { return len(ts.handler.sessions.sessions(bob.ID)) == 0 })
+	// Alice's session is unaffected
+	aliceClient.send(40.7128, -74.0060)
+}
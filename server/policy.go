@@ -0,0 +1,63 @@
+package server
+
+import (
+	"fmt"
+	"nearby-friends/auth"
+	"net/http"
+
+	"go.uber.org/zap"
+)
+
+// accessRule decides whether the authenticated principal may act on the
+// user identified by the {id} in the request path
+type accessRule func(claims *auth.Claims, userID int) bool
+
+// selfOnly lets users act only as themselves
+func selfOnly(claims *auth.Claims, userID int) bool {
+	return claims.UserID == userID
+}
+
+// selfOrAdmin lets users read their own data and admins read anyone's
+func selfOrAdmin(claims *auth.Claims, userID int) bool {
+	return selfOnly(claims, userID) || claims.IsAdmin()
+}
+
+// adminOnly guards a route that isn't about any one user
+func (wh *RequestHandler) adminOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims := principal(r)
+		if claims == nil || !claims.IsAdmin() {
+			writeGenericError(w, fmt.Errorf("only admins can access %v", r.URL.Path), http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// authorize guards a /user/{id}/... route with the access rule
+func (wh *RequestHandler) authorize(rule accessRule, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := pathParamInt(r, "id")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		claims := principal(r)
+		if claims == nil || !rule(claims, userID) {
+			if claims != nil {
+				wh.log.With(
+					zap.Int("principal", claims.UserID),
+					zap.Int("user", userID),
+					zap.String("path", r.URL.Path),
+				).Warn("Denied request")
+			}
+			writeGenericError(w,
+				fmt.Errorf("user is not allowed to access user %v", userID),
+				http.StatusForbidden)
+			return
+		}
+
+		next(w, r)
+	}
+}
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"nearby-friends/types"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// policyRoute is a route of NewRequestHandler and who may call it. path is
+// formatted with the user the request acts on, and another user for the
+// routes naming a second one.
+type policyRoute struct {
+	method string
+	path   string
+	// admins reports whether admins may act on users other than themselves
+	admins bool
+}
+
+var userRoutes = []policyRoute{
+	{http.MethodGet, "/user/{id}/location", false},
+	{http.MethodGet, "/user/{id}/history", false},
+	{http.MethodGet, "/user/{id}/history/export", false},
+	{http.MethodGet, "/user/{id}/settings", true},
+	{http.MethodPut, "/user/{id}/settings", false},
+	{http.MethodGet, "/user/{id}/sharing", true},
+	{http.MethodPut, "/user/{id}/sharing/{other}", false},
+	{http.MethodDelete, "/user/{id}/sharing/{other}", false},
+	{http.MethodPost, "/user/{id}/shares", false},
+	{http.MethodGet, "/user/{id}/shares", true},
+	{http.MethodDelete, "/user/{id}/shares/1", false},
+	{http.MethodGet, "/user/{id}/nearby", false},
+	{http.MethodPost, "/user/{id}/nearby/{other}/friend-request", false},
+	{http.MethodGet, "/user/{id}/friends/nearby", false},
+	{http.MethodGet, "/user/{id}/friends", true},
+	{http.MethodDelete, "/user/{id}/friends/{other}", false},
+	{http.MethodPut, "/user/{id}/blocked/{other}", false},
+	{http.MethodDelete, "/user/{id}/blocked/{other}", false},
+	{http.MethodGet, "/user/{id}/possible-friends", true},
+	{http.MethodPost, "/user/{id}/friend-requests", false},
+	{http.MethodGet, "/user/{id}/friend-requests", true},
+	{http.MethodPost, "/user/{id}/friend-requests/1/accept", false},
+	{http.MethodPost, "/user/{id}/friend-requests/1/decline", false},
+	{http.MethodPost, "/user/{id}/friend-requests/1/cancel", false},
+}
+
+func (r policyRoute) on(userID, otherID int) string {
+	return strings.NewReplacer("{id}", itoa(userID), "{other}", itoa(otherID)).Replace(r.path)
+}
+
+func denied(status int) bool {
+	return status == http.StatusUnauthorized || status == http.StatusForbidden
+}
+
+func TestUserRoutePolicies(t *testing.T) {
+	ts := newTestServer(t, testOptions())
+	alice, aliceToken := ts.createUser(t, "alice", "")
+	bob, bobToken := ts.createUser(t, "bob", "")
+	admin, adminToken := ts.createUser(t, "admin", types.RoleAdmin)
+	// Discovery is off by default, which the nearby routes refuse with a 403
+	for _, user := range []types.User{alice, admin} {
+		settings := types.DefaultUserSettings()
+		settings.Discoverable = true
+		if err := ts.db.UpdateUserSettings(user.ID, settings); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, route := range userRoutes {
+		t.Run(route.method+" "+route.path, func(t *testing.T) {
+			path := route.on(alice.ID, bob.ID)
+			if status := ts.do(t, route.method, path, "", nil); status != http.StatusUnauthorized {
+				t.Errorf("got %v without a token, want 401", status)
+			}
+			if status := ts.do(t, route.method, path, bobToken, nil); status != http.StatusForbidden {
+				t.Errorf("got %v with another user's token, want 403", status)
+			}
+			if status := ts.do(t, route.method, path, aliceToken, nil); denied(status) {
+				t.Errorf("got %v for the owner", status)
+			}
+			if status := ts.do(t, route.method, route.on(admin.ID, bob.ID), adminToken, nil); denied(status) {
+				t.Errorf("got %v for an admin acting as themselves", status)
+			}
+			status := ts.do(t, route.method, path, adminToken, nil)
+			if route.admins && denied(status) {
+				t.Errorf("got %v for an admin, want them allowed", status)
+			}
+			if !route.admins && status != http.StatusForbidden {
+				t.Errorf("got %v for an admin, want 403", status)
+			}
+		})
+	}
+}
+
+func TestUnscopedRoutePolicies(t *testing.T) {
+	ts := newTestServer(t, testOptions())
+	_, userToken := ts.createUser(t, "alice", "")
+	_, adminToken := ts.createUser(t, "admin", types.RoleAdmin)
+
+	for _, path := range []string{"/health", "/user/register", "/user/login"} {
+		method := http.MethodPost
+		if path == "/health" {
+			method = http.MethodGet
+		}
+		if status := ts.do(t, method, path, "", nil); denied(status) {
+			t.Errorf("got %v for public %v %v", status, method, path)
+		}
+	}
+
+	if status := ts.do(t, http.MethodPost, "/user/friendship", "", nil); status != http.StatusUnauthorized {
+		t.Errorf("got %v for /user/friendship without a token, want 401", status)
+	}
+	if status := ts.do(t, http.MethodPost, "/user/friendship", userToken, nil); denied(status) {
+		t.Errorf("got %v for /user/friendship with a token", status)
+	}
+
+	if status := ts.do(t, http.MethodGet, "/debug/vars", "", nil); status != http.StatusUnauthorized {
+		t.Errorf("got %v for /debug/vars without a token, want 401", status)
+	}
+	if status := ts.do(t, http.MethodGet, "/debug/vars", userToken, nil); status != http.StatusForbidden {
+		t.Errorf("got %v for /debug/vars as a user, want 403", status)
+	}
+	if status := ts.do(t, http.MethodGet, "/debug/vars", adminToken, nil); status != http.StatusOK {
+		t.Errorf("got %v for /debug/vars as an admin, want 200", status)
+	}
+}
+
+func TestDemotedAdminLosesAccess(t *testing.T) {
+	ts := newTestServer(t, testOptions())
+	clock := time.Now()
+	ts.handler.roles.now = func() time.Time { return clock }
+	alice, _ := ts.createUser(t, "alice", "")
+	_, adminToken := ts.createUser(t, "admin", types.RoleAdmin)
+
+	settings := "/user/" + itoa(alice.ID) + "/settings"
+	if status := ts.do(t, http.MethodGet, settings, adminToken, nil); status != http.StatusOK {
+		t.Fatalf("got %v for an admin, want 200", status)
+	}
+	if err := ts.db.SetUserRole("admin", types.RoleUser); err != nil {
+		t.Fatal(err)
+	}
+	clock = clock.Add(roleCacheTTL)
+	if status := ts.do(t, http.MethodGet, settings, adminToken, nil); status != http.StatusForbidden {
+		t.Fatalf("got %v with the token of a demoted admin, want 403", status)
+	}
+	if status := ts.do(t, http.MethodGet, "/debug/vars", adminToken, nil); status != http.StatusForbidden {
+		t.Fatalf("got %v for /debug/vars with the token of a demoted admin, want 403", status)
+	}
+}
+
+func TestQueryTokenOnlyOpensLocationSocket(t *testing.T) {
+	ts := newTestServer(t, testOptions())
+	alice, token := ts.createUser(t, "alice", "")
+
+	query := "?access_token=" + token
+	if status := ts.do(t, http.MethodGet, "/user/"+itoa(alice.ID)+"/settings"+query, "", nil); status != http.StatusUnauthorized {
+		t.Errorf("got %v for settings with the token in the query, want 401", status)
+	}
+	if status := ts.do(t, http.MethodGet, "/user/"+itoa(alice.ID)+"/location"+query, "", nil); status != http.StatusUnauthorized {
+		t.Errorf("got %v for a plain GET of the location route with the token in the query, want 401", status)
+	}
+
+	dialer := websocket.Dialer{Subprotocols: []string{types.ProtocolV1}}
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/user/" + itoa(alice.ID) + "/location" + query
+	conn, _, err := dialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("opening the location socket with the token in the query: %v", err)
+	}
+	conn.Close()
+}
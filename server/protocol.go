@@ -0,0 +1,355 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"nearby-friends/types"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+)
+
+var (
+	// errInvalidMessage is returned when a client message can't be decoded.
+	// The socket is still usable afterwards.
+	errInvalidMessage = errors.New("invalid message")
+	errSlowConsumer   = errors.New("client is not reading messages fast enough")
+	errSessionClosed  = errors.New("session is closed")
+	// errResumeUnavailable is returned when a client can't resume its
+	// session and has to start a new one
+	errResumeUnavailable = errors.New("session can't be resumed")
+)
+
+// writeFlushTimeout bounds how long a closing socket waits for the messages
+// still queued to be written
+const writeFlushTimeout = time.Second
+
+// maxMessageSize is the largest message a client may send. Location updates
+// are a few hundred bytes.
+const maxMessageSize = 4096
+
+// resumeBufferSize is how many of the latest messages written on a socket are
+// kept to be replayed to a client resuming its session
+const resumeBufferSize = 256
+
+// locationSocket reads and writes the messages on a location websocket in
+// the protocol negotiated during the upgrade. Sockets that negotiated
+// types.ProtocolV1 exchange envelopes, all others exchange the legacy raw
+// payloads. Writes are queued and written by the socket's own writer, see
+// run, so callers never block on a slow client. Reads fail once the client
+// has been silent, not even answering pings, for longer than pongTimeout.
+//
+// A ProtocolV1 socket outlives its connection while its session waits to be
+// resumed: it is detached from the lost connection and attached to the one
+// the client comes back on, keeping its queue and sequence numbers.
+type locationSocket struct {
+	queue        *outboundQueue
+	enveloped    bool
+	seq          atomic.Int64
+	pongTimeout  time.Duration
+	writeTimeout time.Duration
+	log          *zap.Logger
+
+	mu   sync.Mutex
+	conn *websocket.Conn
+	// done is closed when the writer of conn returns
+	done chan struct{}
+	// sent holds the latest frames written, oldest first, to replay to a
+	// resuming client
+	sent []sentFrame
+}
+
+// sentFrame is an enveloped message as it was written to the client
+type sentFrame struct {
+	seq   int64
+	frame []byte
+}
+
+func newLocationSocket(conn *websocket.Conn, options Options, log *zap.Logger) *locationSocket {
+	socket := &locationSocket{
+		queue:        newOutboundQueue(options.OutboundQueueSize, options.DropPolicy),
+		enveloped:    conn.Subprotocol() == types.ProtocolV1,
+		pongTimeout:  options.PongTimeout,
+		writeTimeout: options.WriteTimeout,
+		log:          log,
+		conn:         conn,
+		done:         make(chan struct{}),
+	}
+	socket.configure(conn)
+	return socket
+}
+
+// configure applies the read limit and deadline to a connection and has its
+// pongs extend the deadline
+func (s *locationSocket) configure(conn *websocket.Conn) {
+	conn.SetReadLimit(maxMessageSize)
+	s.extendReadDeadline(conn)
+	conn.SetPongHandler(func(string) error {
+		s.extendReadDeadline(conn)
+		return nil
+	})
+}
+
+// extendReadDeadline gives the client another pongTimeout to be heard from
+func (s *locationSocket) extendReadDeadline(conn *websocket.Conn) {
+	if s.pongTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(s.pongTimeout))
+	}
+}
+
+// deadline is when a write started now has to be done by
+func (s *locationSocket) deadline() time.Time {
+	if s.writeTimeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(s.writeTimeout)
+}
+
+// connection returns the connection the socket is attached to
+func (s *locationSocket) connection() (*websocket.Conn, chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conn, s.done
+}
+
+// start runs the writer for the connection the socket was created with
+func (s *locationSocket) start() {
+	conn, done := s.connection()
+	go s.run(conn, done, nil)
+}
+
+// run writes the replayed frames and then queued messages to conn until the
+// socket is closed or detached. It is the only goroutine writing data frames
+// to the connection. If a write fails, or the client falls too far behind
+// under DropDisconnect, the connection is closed so the reader notices too.
+func (s *locationSocket) run(conn *websocket.Conn, done chan struct{}, replay []sentFrame) {
+	defer close(done)
+	for _, sent := range replay {
+		conn.SetWriteDeadline(s.deadline())
+		if err := conn.WriteMessage(websocket.TextMessage, sent.frame); err != nil {
+			s.log.Sugar().Errorf("error replaying message: %v", err)
+			conn.Close()
+			return
+		}
+		outboundMetrics.Add("replayed", 1)
+	}
+	for {
+		messages, ok := s.queue.wait()
+		if !ok {
+			if s.queue.isOverflowed() {
+				conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.ClosePolicyViolation, errSlowConsumer.Error()),
+					time.Now().Add(writeFlushTimeout))
+				conn.Close()
+			}
+			return
+		}
+		for i, message := range messages {
+			if err := s.writeNow(conn, message); err != nil {
+				s.log.Sugar().Error(err)
+				// Keep what wasn't written for a resuming client
+				s.queue.requeue(messages[i+1:])
+				conn.Close()
+				return
+			}
+			outboundMetrics.Add("sent", 1)
+		}
+	}
+}
+
+func (s *locationSocket) writeNow(conn *websocket.Conn, message outboundMessage) error {
+	frame := []byte(message.payload)
+	if s.enveloped {
+		seq := s.seq.Add(1)
+		var err error
+		frame, err = json.Marshal(types.Envelope{
+			Type:    message.messageType,
+			Seq:     seq,
+			Payload: message.payload,
+		})
+		if err != nil {
+			return fmt.Errorf("error marshaling %v message to JSON: %v", message.messageType, err)
+		}
+		// Recorded before writing, a frame that fails to write is still
+		// one the client never got
+		s.recordSent(seq, frame)
+	}
+	conn.SetWriteDeadline(s.deadline())
+	if err := conn.WriteMessage(websocket.TextMessage, frame); err != nil {
+		return fmt.Errorf("error sending %v message: %v", message.messageType, err)
+	}
+	return nil
+}
+
+func (s *locationSocket) recordSent(seq int64, frame []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.sent) == resumeBufferSize {
+		s.sent = s.sent[1:]
+	}
+	s.sent = append(s.sent, sentFrame{seq: seq, frame: frame})
+}
+
+// sentAfter returns the frames written after lastSeq. It fails if some of
+// them are no longer buffered, or lastSeq was never sent.
+func (s *locationSocket) sentAfter(lastSeq int64) ([]sentFrame, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current := s.seq.Load()
+	if lastSeq < 0 || lastSeq > current {
+		return nil, fmt.Errorf("%w: last seq %v was never sent, latest is %v", errResumeUnavailable, lastSeq, current)
+	}
+	var frames []sentFrame
+	for _, sent := range s.sent {
+		if sent.seq > lastSeq {
+			frames = append(frames, sent)
+		}
+	}
+	if int64(len(frames)) != current-lastSeq {
+		return nil, fmt.Errorf("%w: messages after seq %v are no longer buffered", errResumeUnavailable, lastSeq)
+	}
+	return frames, nil
+}
+
+// ping asks the client to prove it is still there. Control frames may be
+// written alongside the writer.
+func (s *locationSocket) ping() error {
+	conn, _ := s.connection()
+	if err := conn.WriteControl(websocket.PingMessage, nil, s.deadline()); err != nil {
+		return fmt.Errorf("error sending ping: %v", err)
+	}
+	return nil
+}
+
+// detach closes the connection and stops its writer. Messages keep being
+// queued until the socket is attached to a new connection or closed.
+func (s *locationSocket) detach() {
+	conn, done := s.connection()
+	conn.Close()
+	s.queue.pause()
+	<-done
+}
+
+// attach moves a detached socket to the connection its client resumed on.
+// The frames written after lastSeq are replayed before the queued messages.
+func (s *locationSocket) attach(conn *websocket.Conn, lastSeq int64) error {
+	if conn.Subprotocol() != types.ProtocolV1 {
+		return fmt.Errorf("%w: sessions can only be resumed with %v", errResumeUnavailable, types.ProtocolV1)
+	}
+	replay, err := s.sentAfter(lastSeq)
+	if err != nil {
+		return err
+	}
+
+	s.configure(conn)
+	s.mu.Lock()
+	s.conn, s.done = conn, make(chan struct{})
+	done := s.done
+	s.mu.Unlock()
+	s.queue.unpause()
+	go s.run(conn, done, replay)
+	return nil
+}
+
+// close stops queueing messages, waits up to writeFlushTimeout for the ones
+// already queued to be written and then tells the client why the socket is
+// closing. The close frame is skipped if the writer already sent one.
+func (s *locationSocket) close(code int, reason string) {
+	conn, done := s.connection()
+	s.queue.close()
+	select {
+	case <-done:
+	case <-time.After(writeFlushTimeout):
+	}
+	if s.queue.isOverflowed() {
+		return
+	}
+	conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(code, reason),
+		time.Now().Add(writeFlushTimeout))
+}
+
+// readLocation reads the next location update along with the client's
+// sequence number for it. Legacy clients don't send sequence numbers.
+// Malformed and invalid locations are reported as errInvalidMessage.
+func (s *locationSocket) readLocation() (types.UserLocation, int64, error) {
+	var userLocation types.UserLocation
+	conn, _ := s.connection()
+	_, p, err := conn.ReadMessage()
+	if err != nil {
+		return userLocation, 0, err
+	}
+	s.extendReadDeadline(conn)
+
+	if !s.enveloped {
+		if err := json.Unmarshal(p, &userLocation); err != nil {
+			return userLocation, 0, fmt.Errorf("%w: error unmarshalling user location from message '%v': %v",
+				errInvalidMessage, string(p), err)
+		}
+		return userLocation, 0, validLocation(userLocation)
+	}
+
+	var envelope types.Envelope
+	if err := json.Unmarshal(p, &envelope); err != nil {
+		return userLocation, 0, fmt.Errorf("%w: error unmarshalling envelope from message '%v': %v",
+			errInvalidMessage, string(p), err)
+	}
+	if envelope.Type != types.MessageLocationUpdate {
+		return userLocation, envelope.Seq, fmt.Errorf("%w: unexpected message type '%v'",
+			errInvalidMessage, envelope.Type)
+	}
+	if err := json.Unmarshal(envelope.Payload, &userLocation); err != nil {
+		return userLocation, envelope.Seq, fmt.Errorf("%w: error unmarshalling user location payload: %v",
+			errInvalidMessage, err)
+	}
+	return userLocation, envelope.Seq, validLocation(userLocation)
+}
+
+// validLocation rejects locations that fail validation as invalid messages
+func validLocation(userLocation types.UserLocation) error {
+	if err := userLocation.Validate(); err != nil {
+		return fmt.Errorf("%w: %w", errInvalidMessage, err)
+	}
+	return nil
+}
+
+// write queues the payload to be sent framed for the socket's protocol.
+// Message types the legacy protocol has no representation for are dropped.
+func (s *locationSocket) write(messageType types.MessageType, payload any) error {
+	if !s.enveloped && messageType != types.MessageFriendDistance && messageType != types.MessageError {
+		return nil
+	}
+	message, err := marshalOutbound(messageType, payload)
+	if err != nil {
+		return err
+	}
+	if err := s.queue.push(message); err != nil {
+		return fmt.Errorf("error queueing %v message: %w", messageType, err)
+	}
+	return nil
+}
+
+func (s *locationSocket) writeUserDistance(distance types.UserDistance) error {
+	return s.write(types.MessageFriendDistance, distance)
+}
+
+func (s *locationSocket) writeFriendOutOfRange(friendLocation types.UserLocation, reason types.OutOfRangeReason) error {
+	return s.write(types.MessageFriendOutOfRange, types.FriendOutOfRange{
+		Friend:         friendLocation.User,
+		Reason:         reason,
+		LastUpdateTime: time.Now(),
+	})
+}
+
+func (s *locationSocket) writeError(err error, code int) error {
+	return s.write(types.MessageError, types.NewGenericError(err, code))
+}
+
+// ack tells the client the location update with seq was applied
+func (s *locationSocket) ack(seq int64) error {
+	return s.write(types.MessageAck, types.Ack{Seq: seq})
+}
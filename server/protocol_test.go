@@ -0,0 +1,78 @@
+package server
+
+import (
+	"encoding/json"
+	"nearby-friends/types"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// readBare reads the next frame of a legacy socket as a bare distance
+func readBare(t *testing.T, conn *websocket.Conn) types.UserDistance {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(testMessageTimeout))
+	_, frame, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(frame, &fields); err != nil {
+		t.Fatal(err)
+	}
+	if _, enveloped := fields["payload"]; enveloped {
+		t.Fatalf("legacy client got enveloped message %s", frame)
+	}
+	var distance types.UserDistance
+	if err := json.Unmarshal(frame, &distance); err != nil {
+		t.Fatal(err)
+	}
+	if distance.Remote == nil {
+		t.Fatalf("legacy client got %s, want a friend's distance", frame)
+	}
+	return distance
+}
+
+func TestLegacyClientGetsOnlyDistances(t *testing.T) {
+	ts := newTestServer(t, testOptions())
+	alice, aliceToken := ts.createUser(t, "alice", "")
+	bob, bobToken := ts.createUser(t, "bob", "")
+	ts.befriend(t, alice, bob)
+
+	bobClient := ts.connect(t, bob, bobToken)
+	bobClient.send(40.7130, -74.0062)
+
+	// Alice's client predates the subprotocol and sends bare locations
+	conn := ts.dialConn(t, alice, aliceToken, "")
+	if conn.Subprotocol() != "" {
+		t.Fatalf("legacy client was given subprotocol %v", conn.Subprotocol())
+	}
+	sendBare := func(latitude, longitude float64) {
+		t.Helper()
+		if err := conn.WriteJSON(types.UserLocation{User: &alice, Latitude: latitude, Longitude: longitude}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// No session message or ack comes before the distance
+	sendBare(40.7128, -74.0060)
+	if distance := readBare(t, conn); distance.Remote.ID != bob.ID {
+		t.Fatalf("got distance to %v, want %v", distance.Remote.ID, bob.ID)
+	}
+
+	bobClient.send(40.7131, -74.0063)
+	if distance := readBare(t, conn); distance.Remote.ID != bob.ID || distance.Distance <= 0 {
+		t.Fatalf("got %+v, want bob's new distance", distance)
+	}
+	sendBare(40.7129, -74.0061)
+	bobClient.expectDistance(alice.ID)
+
+	// Bob going offline is an out_of_range message the legacy protocol
+	// has no representation for
+	bobClient.conn.Close()
+	waitFor(t, func() bool { return len(ts.handler.sessions.sessions(bob.ID)) == 0 })
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, frame, err := conn.ReadMessage(); err == nil {
+		t.Fatalf("legacy client got %s", frame)
+	}
+}
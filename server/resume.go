@@ -0,0 +1,169 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"nearby-friends/types"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+)
+
+// newResumeToken returns an unguessable token for a session
+func newResumeToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("error generating resume token: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// makeResumable gives ProtocolV1 sessions a resume token when resuming is
+// enabled. Without a token the session still works, it just can't be
+// resumed.
+func (wh *RequestHandler) makeResumable(session *Session) {
+	if !session.socket.enveloped || wh.options.ResumeWindow <= 0 {
+		return
+	}
+	token, err := newResumeToken()
+	if err != nil {
+		wh.log.Sugar().Errorf("session %v of user %v can't be resumed: %v", session.id, session.userID, err)
+		return
+	}
+	session.token = token
+}
+
+// parkedSession is a session whose client lost its connection
+type parkedSession struct {
+	session *Session
+	// dropped is how many messages the session's queue had dropped when it
+	// was parked. Any dropped after would be missing from the resume.
+	dropped int64
+	resumed chan struct{}
+}
+
+// parkedSessions holds the sessions waiting for their client to come back,
+// by resume token. A parked session keeps its subscription and keeps
+// queueing friend updates, so a client resuming it gets what it missed
+// instead of reloading its friends.
+type parkedSessions struct {
+	mu      sync.Mutex
+	byToken map[string]*parkedSession
+}
+
+func newParkedSessions() *parkedSessions {
+	return &parkedSessions{byToken: make(map[string]*parkedSession)}
+}
+
+// park holds the session for window. If it isn't resumed by then, or it is
+// closed in the meantime, expired is called.
+func (p *parkedSessions) park(session *Session, window time.Duration, expired func()) {
+	parked := &parkedSession{
+		session: session,
+		dropped: session.socket.queue.droppedCount(),
+		resumed: make(chan struct{}),
+	}
+	p.mu.Lock()
+	p.byToken[session.token] = parked
+	p.mu.Unlock()
+
+	go func() {
+		timer := time.NewTimer(window)
+		defer timer.Stop()
+		select {
+		case <-parked.resumed:
+			return
+		case <-timer.C:
+		case <-session.Done():
+		}
+		if _, ok := p.claim(session.token, session.userID); ok {
+			expired()
+		}
+	}()
+}
+
+// claim takes the session parked under token if it belongs to userID. Only
+// one caller can claim a parked session.
+func (p *parkedSessions) claim(token string, userID int) (*parkedSession, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	parked, ok := p.byToken[token]
+	if !ok || parked.session.userID != userID {
+		return nil, false
+	}
+	delete(p.byToken, token)
+	return parked, true
+}
+
+// resumable reports whether the session should be parked after reading from
+// it failed with err. Only sessions that lost their connection are, not
+// those the client closed normally or the server closed.
+func (wh *RequestHandler) resumable(session *Session, err error) bool {
+	if session.token == "" || err == nil || session.ctx.Err() != nil {
+		return false
+	}
+	if _, ok := session.Location(); !ok || session.socket.queue.isOverflowed() {
+		return false
+	}
+	code, _ := readCloseCode(err)
+	if code == websocket.CloseMessageTooBig {
+		return false
+	}
+	return !websocket.IsCloseError(err, websocket.CloseNormalClosure)
+}
+
+// parkSession detaches the session from its lost connection and holds it
+// for the resume window
+func (wh *RequestHandler) parkSession(session *Session) {
+	session.socket.detach()
+	wh.parked.park(session, wh.options.ResumeWindow, func() {
+		wh.endSession(session, websocket.CloseGoingAway, "resume window expired")
+	})
+	wh.log.With(
+		zap.Int("user", session.userID),
+		zap.Uint64("session", session.id),
+	).Debug("Parked session")
+}
+
+// resumeSession attaches the connection to the session parked under the
+// token, replaying what the client missed after lastSeq. A session that
+// can't be resumed completely is ended and the client has to start over.
+func (wh *RequestHandler) resumeSession(userID int, token, lastSeq string, conn *websocket.Conn) (*Session, error) {
+	seq, err := strconv.ParseInt(lastSeq, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid last seq '%v'", errResumeUnavailable, lastSeq)
+	}
+	parked, ok := wh.parked.claim(token, userID)
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown or expired token", errResumeUnavailable)
+	}
+	close(parked.resumed)
+
+	session := parked.session
+	if session.ctx.Err() != nil {
+		wh.endSession(session, websocket.CloseGoingAway, "session closed")
+		return nil, fmt.Errorf("%w: session was closed", errResumeUnavailable)
+	}
+	if session.socket.queue.droppedCount() != parked.dropped || session.socket.queue.isOverflowed() {
+		wh.endSession(session, websocket.CloseGoingAway, "session replaced")
+		return nil, fmt.Errorf("%w: messages were dropped while disconnected", errResumeUnavailable)
+	}
+	if err := session.socket.attach(conn, seq); err != nil {
+		wh.endSession(session, websocket.CloseGoingAway, "session replaced")
+		return nil, err
+	}
+	return session, nil
+}
+
+// sessionInfo tells the client how to resume the session
+func (wh *RequestHandler) sessionInfo(session *Session, resumed bool) types.SessionInfo {
+	info := types.SessionInfo{Token: session.token, Resumed: resumed}
+	if session.token != "" {
+		info.ResumeWindow = wh.options.ResumeWindow.String()
+	}
+	return info
+}
@@ -0,0 +1,182 @@
+package server
+
+import (
+	"encoding/json"
+	"nearby-friends/types"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func resumeOptions(window time.Duration) Options {
+	options := testOptions()
+	options.ResumeWindow = window
+	return options
+}
+
+// connectResumable opens the user's location socket and returns the resume
+// token the session came with
+func (ts *testServer) connectResumable(t *testing.T, user types.User, token string) (*testClient, string) {
+	t.Helper()
+	client := ts.dial(t, user, token, "", types.ProtocolV1)
+	var info types.SessionInfo
+	client.expect(types.MessageSession, &info)
+	if info.Token == "" {
+		t.Fatal("session came without a resume token")
+	}
+	return client, info.Token
+}
+
+// resume reconnects as the user with the resume token, having read every
+// message up to lastSeq
+func (ts *testServer) resume(t *testing.T, user types.User, token, resumeToken string, lastSeq int64) *testClient {
+	t.Helper()
+	query := "?resume=" + resumeToken + "&lastSeq=" + strconv.FormatInt(lastSeq, 10)
+	return ts.dial(t, user, token, query, types.ProtocolV1)
+}
+
+// loseConnection drops the client's connection without a close frame and
+// waits for the server to park its session
+func (ts *testServer) loseConnection(t *testing.T, client *testClient, resumeToken string) {
+	t.Helper()
+	client.conn.Close()
+	waitFor(t, func() bool {
+		ts.handler.parked.mu.Lock()
+		defer ts.handler.parked.mu.Unlock()
+		_, parked := ts.handler.parked.byToken[resumeToken]
+		return parked
+	})
+}
+
+// expectSessionInfo reads messages until the session message and returns it
+func (c *testClient) expectSessionInfo() types.SessionInfo {
+	c.t.Helper()
+	for {
+		envelope := c.next()
+		if envelope.Type != types.MessageSession {
+			continue
+		}
+		var info types.SessionInfo
+		if err := json.Unmarshal(envelope.Payload, &info); err != nil {
+			c.t.Fatal(err)
+		}
+		return info
+	}
+}
+
+func TestResumeReplaysOnlyMissedMessages(t *testing.T) {
+	ts := newTestServer(t, resumeOptions(time.Minute))
+	alice, aliceToken := ts.createUser(t, "alice", "")
+	bob, bobToken := ts.createUser(t, "bob", "")
+	ts.befriend(t, alice, bob)
+
+	aliceClient, resumeToken := ts.connectResumable(t, alice, aliceToken)
+	bobClient := ts.connect(t, bob, bobToken)
+	meet(t, aliceClient, bobClient)
+	bobClient.send(40.7131, -74.0063)
+	aliceClient.expectDistance(bob.ID)
+	// The last message read is lost with the connection
+	lastSeq := aliceClient.lastSeq - 1
+	ts.loseConnection(t, aliceClient, resumeToken)
+
+	// Bob keeps moving while Alice is away
+	bobClient.send(40.7132, -74.0064)
+	bobClient.send(40.7133, -74.0065)
+
+	resumed := ts.resume(t, alice, aliceToken, resumeToken, lastSeq)
+	var seqs []int64
+	distances := 0
+	var info types.SessionInfo
+	for info.Token == "" {
+		envelope := resumed.next()
+		seqs = append(seqs, envelope.Seq)
+		switch envelope.Type {
+		case types.MessageFriendDistance:
+			distances++
+		case types.MessageSession:
+			if err := json.Unmarshal(envelope.Payload, &info); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if !info.Resumed || info.Token != resumeToken {
+		t.Fatalf("got session %+v, want %v resumed", info, resumeToken)
+	}
+	for i, seq := range seqs {
+		if seq != lastSeq+int64(i)+1 {
+			t.Fatalf("resumed with seqs %v after %v, want every seq after it once, in order", seqs, lastSeq)
+		}
+	}
+	// The replayed distance and the latest queued while away, the two
+	// queued are coalesced
+	if distances != 2 {
+		t.Fatalf("got %v distances on resume, want 2", distances)
+	}
+
+	// The resumed session is live
+	bobClient.send(40.7134, -74.0066)
+	resumed.expectDistance(bob.ID)
+}
+
+func TestResumeRejectsOtherUsersToken(t *testing.T) {
+	ts := newTestServer(t, resumeOptions(time.Minute))
+	alice, aliceToken := ts.createUser(t, "alice", "")
+	bob, bobToken := ts.createUser(t, "bob", "")
+
+	aliceClient, resumeToken := ts.connectResumable(t, alice, aliceToken)
+	aliceClient.send(40.7128, -74.0060)
+	ts.loseConnection(t, aliceClient, resumeToken)
+
+	bobClient := ts.resume(t, bob, bobToken, resumeToken, aliceClient.lastSeq)
+	if info := bobClient.expectSessionInfo(); info.Resumed || info.Token == resumeToken {
+		t.Fatalf("bob got session %+v resuming alice's", info)
+	}
+
+	// Alice can still resume her own
+	resumed := ts.resume(t, alice, aliceToken, resumeToken, aliceClient.lastSeq)
+	if info := resumed.expectSessionInfo(); !info.Resumed {
+		t.Fatal("alice couldn't resume after bob tried her token")
+	}
+}
+
+func TestResumeRejectsExpiredToken(t *testing.T) {
+	ts := newTestServer(t, resumeOptions(100*time.Millisecond))
+	alice, aliceToken := ts.createUser(t, "alice", "")
+
+	aliceClient, resumeToken := ts.connectResumable(t, alice, aliceToken)
+	aliceClient.send(40.7128, -74.0060)
+	ts.loseConnection(t, aliceClient, resumeToken)
+	waitFor(t, func() bool { return len(ts.handler.sessions.sessions(alice.ID)) == 0 })
+
+	resumed := ts.resume(t, alice, aliceToken, resumeToken, aliceClient.lastSeq)
+	if info := resumed.expectSessionInfo(); info.Resumed {
+		t.Fatal("resumed a session after its resume window")
+	}
+}
+
+func TestResumeBeyondReplayBufferReloads(t *testing.T) {
+	ts := newTestServer(t, resumeOptions(time.Minute))
+	alice, aliceToken := ts.createUser(t, "alice", "")
+	bob, bobToken := ts.createUser(t, "bob", "")
+	ts.befriend(t, alice, bob)
+
+	aliceClient, resumeToken := ts.connectResumable(t, alice, aliceToken)
+	bobClient := ts.connect(t, bob, bobToken)
+	meet(t, aliceClient, bobClient)
+	firstSeq := aliceClient.lastSeq
+	for i := 0; i <= resumeBufferSize; i++ {
+		bobClient.send(40.7130, -74.0062+float64(i%2)/100000)
+		aliceClient.expectDistance(bob.ID)
+	}
+	ts.loseConnection(t, aliceClient, resumeToken)
+
+	// Alice only read up to where the buffer no longer reaches
+	resumed := ts.resume(t, alice, aliceToken, resumeToken, firstSeq)
+	if info := resumed.expectSessionInfo(); info.Resumed {
+		t.Fatal("resumed past the replay buffer")
+	}
+
+	// The client starts over and loads its friends again
+	resumed.send(40.7128, -74.0060)
+	resumed.expectDistance(bob.ID)
+}
@@ -2,16 +2,21 @@ package server
 
 import (
 	"context"
+	"errors"
+	"expvar"
 	"fmt"
+	"math/rand/v2"
+	"net"
+	"slices"
 	"strconv"
 
 	//"io"
-	"sync"
 	"time"
 
 	//"html/template"
 	//"log"
 	"encoding/json"
+	"nearby-friends/auth"
 	"nearby-friends/cache"
 	"nearby-friends/db"
 	"nearby-friends/types"
@@ -35,16 +40,68 @@ func (i Info) Addr() string {
 	return fmt.Sprintf("%v:%v", i.Host, i.Port)
 }
 
+// Options tunes how the RequestHandler treats locations
+type Options struct {
+	// ApproximateGrid is the size in miles of the grid locations are snapped
+	// to for friends with approximate access
+	ApproximateGrid float64
+	// Distance computes the distances between users
+	Distance types.DistanceFunc
+	// History records every accepted location so users can query where
+	// they have been
+	History bool
+	// HistoryRetention is how long recorded locations are kept, forever
+	// when zero
+	HistoryRetention time.Duration
+	// OutboundQueueSize is how many messages each session queues for a
+	// client before DropPolicy kicks in
+	OutboundQueueSize int
+	// DropPolicy is what sessions do when their outbound queue is full
+	DropPolicy DropPolicy
+	// PingInterval is how often sessions ping their client
+	PingInterval time.Duration
+	// PongTimeout is how long a session waits to hear from its client,
+	// a message or a pong, before ending. It must exceed PingInterval.
+	PongTimeout time.Duration
+	// WriteTimeout bounds every write to a client
+	WriteTimeout time.Duration
+	// ResumeWindow is how long a session whose client lost its connection
+	// is kept for the client to resume it, never when zero
+	ResumeWindow time.Duration
+}
+
+func DefaultOptions() Options {
+	return Options{
+		ApproximateGrid:   1,
+		Distance:          types.Haversine,
+		HistoryRetention:  30 * 24 * time.Hour,
+		OutboundQueueSize: 64,
+		DropPolicy:        DropCoalesce,
+		PingInterval:      30 * time.Second,
+		PongTimeout:       60 * time.Second,
+		WriteTimeout:      10 * time.Second,
+		ResumeWindow:      2 * time.Minute,
+	}
+}
+
 type RequestHandler struct {
 	*mux.Router
 	upgrader websocket.Upgrader
-	wsConnMu sync.Mutex
 
 	userDBHandler     db.DBHandler
 	userCacheHandler  cache.CacheHandlerable
 	userPubSubHandler cache.PubSubHandlerable
 
-	userLocationByID *types.SafeMap
+	sessions *sessionRegistry
+	parked   *parkedSessions
+	settings *settingsCache
+	sharing  *sharingCache
+	shares   *sharesCache
+	roles    *roleCache
+	history  *historyRecorder
+
+	tokens  *auth.TokenIssuer
+	options Options
 
 	log *zap.Logger
 }
@@ -54,33 +111,132 @@ func NewRequestHandler(
 	userDBHandler db.DBHandler,
 	userCacheHandler cache.CacheHandlerable,
 	userPubSubHandler cache.PubSubHandlerable,
+	tokens *auth.TokenIssuer,
+	options Options,
 	log *zap.Logger,
 ) *RequestHandler {
 	handler := &RequestHandler{
-		upgrader:          websocket.Upgrader{}, // use default options
+		upgrader: websocket.Upgrader{
+			Subprotocols: []string{types.ProtocolV1},
+		},
 		userDBHandler:     userDBHandler,
 		userCacheHandler:  userCacheHandler,
 		userPubSubHandler: userPubSubHandler,
-		userLocationByID:  types.NewSafeMap(),
+		sessions:          newSessionRegistry(log),
+		parked:            newParkedSessions(),
+		settings:          newSettingsCache(),
+		sharing:           newSharingCache(),
+		shares:            newSharesCache(),
+		roles:             newRoleCache(),
+		tokens:            tokens,
+		options:           options,
 		log:               log,
 	}
+	if options.History {
+		handler.history = newHistoryRecorder(userDBHandler, options.HistoryRetention, log)
+		handler.history.start(ctx)
+	}
 	router := mux.NewRouter()
 	router.HandleFunc("/health", handler.health())
+	router.Handle("/debug/vars", handler.adminOnly(expvar.Handler().ServeHTTP))
 	userRoutes := router.PathPrefix("/user").Subrouter()
 	userRoutes.Path("/register").Methods(http.MethodPost).HandlerFunc(handler.createUser())
-	userRoutes.Path("/{id}/location").Methods(http.MethodPost).HandlerFunc(handler.updateUserLocation(ctx))
-	// handler.HandleFunc("/user/{id}/location", handler.updateUserLocation(ctx))
+	userRoutes.Path("/login").Methods(http.MethodPost).HandlerFunc(handler.login())
 	userRoutes.Path("/friendship").Methods(http.MethodPost).HandlerFunc(handler.createUserFriendship())
-	// handler.HandleFunc("/user/friendship", handler.createUserFriendship())
-	userRoutes.Path("/{id}/friends").Methods(http.MethodGet).HandlerFunc(handler.listUserFriends())
-	// handler.HandleFunc("/user/{id}/friends", handler.listUserFriends())
-	userRoutes.Path("/{id}/possible-friends").Methods(http.MethodGet).HandlerFunc(handler.listPossibleFriends())
-	// handler.HandleFunc("/user/{id}/possible-friends", handler.listPossibleFriends())
+
+	// Routes acting on the user in the path. Users can only act as
+	// themselves, admins can additionally read any user's data.
+	userRoutes.Path("/{id}/location").Methods(http.MethodGet).
+		HandlerFunc(handler.authorize(selfOnly, handler.updateUserLocation(ctx)))
+	userRoutes.Path("/{id}/history").Methods(http.MethodGet).
+		HandlerFunc(handler.authorize(selfOnly, handler.getLocationHistory()))
+	userRoutes.Path("/{id}/history/export").Methods(http.MethodGet).
+		HandlerFunc(handler.authorize(selfOnly, handler.exportLocationHistory()))
+	userRoutes.Path("/{id}/settings").Methods(http.MethodGet).
+		HandlerFunc(handler.authorize(selfOrAdmin, handler.getUserSettings()))
+	userRoutes.Path("/{id}/settings").Methods(http.MethodPut).
+		HandlerFunc(handler.authorize(selfOnly, handler.updateUserSettings()))
+	userRoutes.Path("/{id}/sharing").Methods(http.MethodGet).
+		HandlerFunc(handler.authorize(selfOrAdmin, handler.listFriendSharing()))
+	userRoutes.Path("/{id}/sharing/{friendID}").Methods(http.MethodPut).
+		HandlerFunc(handler.authorize(selfOnly, handler.setFriendSharing()))
+	userRoutes.Path("/{id}/sharing/{friendID}").Methods(http.MethodDelete).
+		HandlerFunc(handler.authorize(selfOnly, handler.removeFriendSharing()))
+	userRoutes.Path("/{id}/shares").Methods(http.MethodPost).
+		HandlerFunc(handler.authorize(selfOnly, handler.createLocationShares()))
+	userRoutes.Path("/{id}/shares").Methods(http.MethodGet).
+		HandlerFunc(handler.authorize(selfOrAdmin, handler.listLocationShares()))
+	userRoutes.Path("/{id}/shares/{shareID}").Methods(http.MethodDelete).
+		HandlerFunc(handler.authorize(selfOnly, handler.endLocationShare()))
+	userRoutes.Path("/{id}/nearby").Methods(http.MethodGet).
+		HandlerFunc(handler.authorize(selfOnly, handler.listNearbyStrangers()))
+	userRoutes.Path("/{id}/nearby/{strangerID}/friend-request").Methods(http.MethodPost).
+		HandlerFunc(handler.authorize(selfOnly, handler.requestNearbyStranger()))
+	userRoutes.Path("/{id}/friends/nearby").Methods(http.MethodGet).
+		HandlerFunc(handler.authorize(selfOnly, handler.exportNearbyFriends()))
+	userRoutes.Path("/{id}/friends").Methods(http.MethodGet).
+		HandlerFunc(handler.authorize(selfOrAdmin, handler.listUserFriends()))
+	userRoutes.Path("/{id}/friends/{friendID}").Methods(http.MethodDelete).
+		HandlerFunc(handler.authorize(selfOnly, handler.removeUserFriendship()))
+	userRoutes.Path("/{id}/blocked/{blockedID}").Methods(http.MethodPut).
+		HandlerFunc(handler.authorize(selfOnly, handler.blockUser()))
+	userRoutes.Path("/{id}/blocked/{blockedID}").Methods(http.MethodDelete).
+		HandlerFunc(handler.authorize(selfOnly, handler.unblockUser()))
+	userRoutes.Path("/{id}/possible-friends").Methods(http.MethodGet).
+		HandlerFunc(handler.authorize(selfOrAdmin, handler.listPossibleFriends()))
+	userRoutes.Path("/{id}/friend-requests").Methods(http.MethodPost).
+		HandlerFunc(handler.authorize(selfOnly, handler.sendFriendRequest()))
+	userRoutes.Path("/{id}/friend-requests").Methods(http.MethodGet).
+		HandlerFunc(handler.authorize(selfOrAdmin, handler.listFriendRequests()))
+	userRoutes.Path("/{id}/friend-requests/{requestID}/accept").Methods(http.MethodPost).
+		HandlerFunc(handler.authorize(selfOnly, handler.resolveFriendRequest(userDBHandler.AcceptFriendRequest)))
+	userRoutes.Path("/{id}/friend-requests/{requestID}/decline").Methods(http.MethodPost).
+		HandlerFunc(handler.authorize(selfOnly, handler.resolveFriendRequest(userDBHandler.DeclineFriendRequest)))
+	userRoutes.Path("/{id}/friend-requests/{requestID}/cancel").Methods(http.MethodPost).
+		HandlerFunc(handler.authorize(selfOnly, handler.resolveFriendRequest(userDBHandler.CancelFriendRequest)))
 	handler.Router = router
 	return handler
 }
 
+// goingAwayReason is the close reason sent to clients when the server shuts down
+const goingAwayReason = "server shutting down, reconnect"
+
+// maxReconnectJitter bounds the delay clients are told to wait before
+// reconnecting when the server shuts down
+const maxReconnectJitter = 10 * time.Second
+
+// Shutdown drains the handler so the server can stop. New location sockets
+// are refused, every open session is told the server is going away and is
+// closed, and the location history still queued is written. It returns once
+// that is done or ctx is, and must be called after the http.Server stopped
+// accepting connections and before the db, cache and pubsub are closed.
+func (wh *RequestHandler) Shutdown(ctx context.Context) error {
+	sessions := wh.sessions.drain()
+	wh.log.Info("Draining sessions", zap.Int("sessions", len(sessions)))
+	for _, session := range sessions {
+		go func() {
+			session.socket.write(types.MessageGoingAway, types.GoingAway{
+				Reason:     "server shutting down",
+				Reconnect:  true,
+				RetryAfter: rand.N(maxReconnectJitter).Round(time.Millisecond).String(),
+			})
+			session.CloseWith(websocket.CloseGoingAway, goingAwayReason)
+		}()
+	}
+	if err := wh.sessions.wait(ctx); err != nil {
+		return fmt.Errorf("error draining sessions: %v", err)
+	}
+
+	if wh.history != nil {
+		if err := wh.history.stop(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (wh *RequestHandler) WithMiddleware() http.Handler {
+	authenticated := wh.authenticate(wh.Router)
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Log request
 		wh.log.With(
@@ -91,7 +247,7 @@ func (wh *RequestHandler) WithMiddleware() http.Handler {
 
 		// Serve the request
 		start := time.Now()
-		wh.ServeHTTP(w, r)
+		authenticated.ServeHTTP(w, r)
 
 		wh.log.With(
 			zap.Duration("request-duration", time.Since(start)),
@@ -121,15 +277,28 @@ func (wh *RequestHandler) createUser() http.HandlerFunc {
 		//).Info("Request body")
 		//if err := json.Unmarshal(body, &user); err != nil {
 
-		var user types.User
-		if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
+		var credentials types.Credentials
+		if err := json.NewDecoder(r.Body).Decode(&credentials); err != nil {
 			http.Error(w,
 				fmt.Sprintf("Invalid request body: %v", err),
 				http.StatusBadRequest)
 			return
 		}
+		if credentials.Password == "" {
+			http.Error(w, "Invalid request body: a password is required", http.StatusBadRequest)
+			return
+		}
 
-		if err := wh.userDBHandler.CreateUser(&user); err != nil {
+		user := types.User{Name: credentials.Name}
+		if err := user.Validate(); err != nil {
+			writeGenericError(w, err, http.StatusBadRequest)
+			return
+		}
+		if err := wh.userDBHandler.CreateUser(&user, credentials.Password); err != nil {
+			if errors.Is(err, db.ErrUserExists) {
+				writeGenericError(w, err, http.StatusConflict)
+				return
+			}
 			http.Error(w,
 				fmt.Sprintf("internal server error when creating user: %v", err),
 				http.StatusInternalServerError)
@@ -147,6 +316,8 @@ func (wh *RequestHandler) createUser() http.HandlerFunc {
 	}
 }
 
+// createUserFriendship sends a friend request from the user to the friend.
+// The friendship is only established once the friend accepts it.
 func (wh *RequestHandler) createUserFriendship() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Two usernames constitue a friend request
@@ -160,18 +331,18 @@ func (wh *RequestHandler) createUserFriendship() http.HandlerFunc {
 			return
 		}
 
-		if err := wh.userDBHandler.EstablishFriendship(friendRequest); err != nil {
-			// fmt.Println(err)
-			http.Error(w,
-				fmt.Sprintf("Internal server error when creating friendship '%v': %v", friendRequest, err),
-				http.StatusInternalServerError)
+		// The request is always sent by the authenticated user
+		self := principal(r).User()
+		if (friendRequest.User.ID != 0 && friendRequest.User.ID != self.ID) ||
+			(friendRequest.User.Name != "" && friendRequest.User.Name != self.Name) {
+			writeGenericError(w,
+				fmt.Errorf("user is not allowed to send friend requests on behalf of [%v]", &friendRequest.User),
+				http.StatusForbidden)
 			return
 		}
+		friendRequest.User = self
 
-		// Respond with the created user
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusCreated)
-		json.NewEncoder(w).Encode(friendRequest)
+		wh.createFriendRequest(w, friendRequest)
 	}
 }
 
@@ -252,6 +423,26 @@ func (wh *RequestHandler) listPossibleFriends() http.HandlerFunc {
 
 func (wh *RequestHandler) updateUserLocation(ctx context.Context) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := pathParamInt(r, "id")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Clients asking for a protocol version we don't speak would
+		// misread the legacy messages, so refuse them up front
+		if offered := websocket.Subprotocols(r); len(offered) > 0 && !slices.Contains(offered, types.ProtocolV1) {
+			http.Error(w,
+				fmt.Sprintf("Unsupported websocket protocols %v, supported: %v", offered, types.ProtocolV1),
+				http.StatusBadRequest)
+			return
+		}
+
+		if wh.sessions.isDraining() {
+			http.Error(w, "Server is shutting down, reconnect", http.StatusServiceUnavailable)
+			return
+		}
+
 		conn, err := wh.upgrader.Upgrade(w, r, nil)
 		if err != nil {
 			http.Error(w,
@@ -259,25 +450,56 @@ func (wh *RequestHandler) updateUserLocation(ctx context.Context) http.HandlerFu
 				http.StatusInternalServerError)
 			return
 		}
-		defer conn.Close()
+
+		// A client coming back after losing its connection picks its
+		// session up where it left off, without reloading its friends
+		query := r.URL.Query()
+		if token := query.Get("resume"); token != "" {
+			session, err := wh.resumeSession(userID, token, query.Get("lastSeq"), conn)
+			if err == nil {
+				session.socket.write(types.MessageSession, wh.sessionInfo(session, true))
+				wh.serveSession(session)
+				return
+			}
+			wh.log.Sugar().Errorf("error resuming session: %v", err)
+		}
+
+		// Everything started for this connection is torn down with it
+		session := newSession(ctx, userID, conn, wh.options, wh.log)
+		wh.makeResumable(session)
+		if !wh.sessions.track(session) {
+			session.CloseWith(websocket.CloseGoingAway, goingAwayReason)
+			return
+		}
+		closeCode, closeReason := websocket.CloseNormalClosure, ""
+		serving := false
+		defer func() {
+			if !serving {
+				wh.endSession(session, closeCode, closeReason)
+			}
+		}()
+		ctx, socket := session.ctx, session.socket
+		socket.write(types.MessageSession, wh.sessionInfo(session, false))
 
 		// Read initial message from the client.
 		// This should be the first user location. We will setup the initial
 		// UI with this location/userID. After, we will simply listen to further
 		// user location messages and send updates on the pubsub for them.
-		_, p, err := conn.ReadMessage()
+		userLocation, seq, err := socket.readLocation()
+		if errors.Is(err, errInvalidMessage) {
+			socket.writeError(err, http.StatusBadRequest)
+			closeCode, closeReason = websocket.ClosePolicyViolation, "invalid location"
+			return
+		}
 		if err != nil {
-			fmt.Println(err)
+			closeCode, closeReason = readCloseCode(err)
+			wh.log.Sugar().Errorf("error reading first web socket message: %v", err)
 			return
 		}
 
-		// Unmarshal the JSON message (assuming it's a valid JSON message)
-		var userLocation types.UserLocation
-		if err := json.Unmarshal(p, &userLocation); err != nil {
-			err = fmt.Errorf("error when marshaling user location from message '%v': %v", string(p), err)
-			netErr := types.NewGenericError(err, http.StatusInternalServerError)
-			jsonErr, _ := json.Marshal(netErr)
-			conn.WriteMessage(websocket.TextMessage, jsonErr)
+		if err := authorizeLocation(userID, userLocation); err != nil {
+			socket.writeError(err, http.StatusForbidden)
+			closeCode, closeReason = websocket.ClosePolicyViolation, "forbidden"
 			return
 		}
 
@@ -285,129 +507,329 @@ func (wh *RequestHandler) updateUserLocation(ctx context.Context) http.HandlerFu
 		// the current process can get the latest location
 		if err := wh.userCacheHandler.SetUserLocation(ctx, userLocation); err != nil {
 			err = fmt.Errorf("error when caching user location for user %v: %v", userLocation.ID, err)
-			netErr := types.NewGenericError(err, http.StatusInternalServerError)
-			jsonErr, _ := json.Marshal(netErr)
-			conn.WriteMessage(websocket.TextMessage, jsonErr)
+			socket.writeError(err, http.StatusInternalServerError)
+			closeCode, closeReason = websocket.CloseInternalServerErr, "internal error"
 			return
 		}
-		wh.userLocationByID.Set(userLocation.ID, userLocation)
+		session.setLocation(userLocation)
+		wh.recordHistory(userLocation)
 
 		// Process the initial user location.
 		// This includes getting all firends, populating the initial UI,
 		// and subscribing to all friend updates.
-		if err := wh.processUserLocation(ctx, userLocation, conn); err != nil {
+		if err := wh.processUserLocation(session, userLocation); err != nil {
 			err = fmt.Errorf("error when processing user location for user %v: %v", userLocation.ID, err)
-			netErr := types.NewGenericError(err, http.StatusInternalServerError)
-			jsonErr, _ := json.Marshal(netErr)
-			conn.WriteMessage(websocket.TextMessage, jsonErr)
+			socket.writeError(err, http.StatusInternalServerError)
+			closeCode, closeReason = websocket.CloseInternalServerErr, "internal error"
 			return
 		}
+		socket.ack(seq)
+		go wh.sweepOfflineFriends(session)
 
-		// Process subsequent user locations.
-		// This includes caching the updated location and boradcasting
-		// the update to subscribers.
-		if err := wh.readSubsequentMessages(ctx, conn); err != nil {
-			err = fmt.Errorf("error when reading from web socket: %v", err)
-			netErr := types.NewGenericError(err, http.StatusInternalServerError)
-			jsonErr, _ := json.Marshal(netErr)
-			conn.WriteMessage(websocket.TextMessage, jsonErr)
-			return
+		serving = true
+		wh.serveSession(session)
+	}
+}
+
+// serveSession processes the session's location updates until its
+// connection ends. Sessions that lost their connection are parked for the
+// client to resume, all others are ended.
+func (wh *RequestHandler) serveSession(session *Session) {
+	// Process subsequent user locations.
+	// This includes caching the updated location and boradcasting
+	// the update to subscribers.
+	err := wh.readSubsequentMessages(session)
+	if wh.resumable(session, err) {
+		wh.parkSession(session)
+		return
+	}
+
+	closeCode, closeReason := websocket.CloseNormalClosure, ""
+	if err != nil && session.ctx.Err() == nil {
+		closeCode, closeReason = readCloseCode(err)
+		if closeCode != websocket.CloseNormalClosure {
+			wh.log.Sugar().Errorf("error when reading from web socket: %v", err)
 		}
 	}
+	wh.endSession(session, closeCode, closeReason)
 }
 
-func (wh *RequestHandler) readSubsequentMessages(ctx context.Context, wsConn *websocket.Conn) error {
+// readSubsequentMessages processes location updates until the client closes
+// the socket normally, which returns nil, or the connection is lost, fails
+// or times out
+func (wh *RequestHandler) readSubsequentMessages(session *Session) error {
+	ctx, socket, userID, friends := session.ctx, session.socket, session.userID, session.friends
 	for {
-		_, p, err := wsConn.ReadMessage()
-		if err != nil {
-			fmt.Println("error reading web socket message: ", err)
+		userLocation, seq, err := socket.readLocation()
+		if errors.Is(err, errInvalidMessage) {
+			socket.writeError(err, http.StatusBadRequest)
 			continue
 		}
+		if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
 
-		var userLocation types.UserLocation
-		if err := json.Unmarshal(p, &userLocation); err != nil {
-			fmt.Println("error unmarshalling web socket message: ", err)
+		if err := authorizeLocation(userID, userLocation); err != nil {
+			socket.writeError(err, http.StatusForbidden)
 			continue
 		}
 
 		if err := wh.userCacheHandler.SetUserLocation(ctx, userLocation); err != nil {
 			err = fmt.Errorf("error when caching user location for user %v: %v", userLocation.ID, err)
-			netErr := types.NewGenericError(err, http.StatusInternalServerError)
-			jsonErr, _ := json.Marshal(netErr)
-			wsConn.WriteMessage(websocket.TextMessage, jsonErr)
+			socket.writeError(err, http.StatusInternalServerError)
 			continue
 		}
-		wh.userLocationByID.Set(userLocation.ID, userLocation)
+		session.setLocation(userLocation)
+		wh.recordHistory(userLocation)
 
+		// Moving can take the user out of range of friends that stood still
+		stillInRange := func(friendLocation types.UserLocation) bool {
+			return wh.userDistanceIfValid(userLocation, friendLocation) != nil
+		}
+		for _, friend := range friends.leftRange(stillInRange) {
+			if err := socket.writeFriendOutOfRange(friend, types.OutOfRangeDistance); err != nil {
+				wh.log.Sugar().Errorf("error writing friend out of range after location update: %v", err)
+			}
+		}
+
+		// Ghosts keep their own view up to date without telling anyone
+		if settings := wh.userSettings(userID); settings.Ghost {
+			socket.ack(seq)
+			continue
+		}
 		if err := wh.userPubSubHandler.BroadcastLocation(ctx, userLocation); err != nil {
-			fmt.Println("error broadcasting user location to pubsub: ", err)
+			wh.log.Sugar().Errorf("error broadcasting user location to pubsub: %v", err)
 			continue
 		}
+		socket.ack(seq)
 	}
 }
 
-func (wh *RequestHandler) processUserLocation(
-	ctx context.Context,
-	userLoc types.UserLocation,
-	wsConn *websocket.Conn,
-) error {
+// readCloseCode picks the close code and reason sent to a client whose socket
+// could not be read from. Failed connections won't get to read it.
+func readCloseCode(err error) (int, string) {
+	var netErr net.Error
+	var closeErr *websocket.CloseError
+	switch {
+	case errors.As(err, &closeErr):
+		return websocket.CloseNormalClosure, ""
+	case errors.Is(err, websocket.ErrReadLimit):
+		return websocket.CloseMessageTooBig, fmt.Sprintf("messages are limited to %v bytes", maxMessageSize)
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return websocket.CloseGoingAway, "keepalive timeout"
+	default:
+		return websocket.CloseInternalServerErr, "read error"
+	}
+}
+
+// endSession deregisters and closes the session. Once the user's last session
+// is gone their cached location is dropped and friends are told they went
+// offline, so friends and nearby searches stop seeing them right away
+// instead of when it expires, and the data loaded for them is evicted.
+// Friends aren't told while draining, the user is about to reconnect.
+func (wh *RequestHandler) endSession(session *Session, code int, reason string) {
+	defer wh.sessions.untrack(session)
+	wh.sessions.deregister(session)
+	session.CloseWith(code, reason)
+	if len(wh.sessions.sessions(session.userID)) > 0 {
+		return
+	}
+	wh.settings.invalidate(session.userID)
+	wh.sharing.invalidate(session.userID)
+	wh.shares.invalidate(session.userID)
+	if _, ok := session.Location(); !ok {
+		return
+	}
+
+	// The session's context is done by now
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(session.ctx), 5*time.Second)
+	defer cancel()
+	if err := wh.userCacheHandler.RemoveUserLocation(ctx, session.userID); err != nil {
+		wh.log.Sugar().Errorf("error removing cached location of disconnected user %v: %v", session.userID, err)
+	}
+	if wh.sessions.isDraining() {
+		return
+	}
+	event := types.FriendEvent{UserID: session.userID, Kind: types.FriendEventOffline}
+	if err := wh.userPubSubHandler.BroadcastEvent(ctx, event); err != nil {
+		wh.log.Sugar().Errorf("error publishing %v event for user %v: %v", event.Kind, session.userID, err)
+	}
+}
+
+func (wh *RequestHandler) processUserLocation(session *Session, userLoc types.UserLocation) error {
+	ctx, socket, friends := session.ctx, session.socket, session.friends
+
+	// Subscribe and register before listing friends so friendships
+	// established in the meantime are still picked up
+	subscription, err := wh.userPubSubHandler.SubscribeToFriends(ctx, nil, func(subscribedLocation types.UserLocation) {
+		userID := session.userID
+		if location, exists := session.Location(); exists {
+			var userDistance *types.UserDistance
+			sharedLocation, shared := wh.sharedLocation(subscribedLocation, userID)
+			if shared {
+				userDistance = wh.userDistanceIfValid(location, sharedLocation)
+				wh.watchShareExpiry(session, subscribedLocation.ID)
+			}
+			if friends.observe(sharedLocation, userDistance != nil) {
+				reason := types.OutOfRangeDistance
+				if !shared {
+					reason = types.OutOfRangeHidden
+				}
+				if err := socket.writeFriendOutOfRange(subscribedLocation, reason); err != nil {
+					wh.log.Sugar().Errorf("error writing friend out of range after subscription update: %v", err)
+				}
+			}
+			if userDistance != nil {
+				if err := socket.writeUserDistance(*userDistance); err != nil {
+					wh.log.Sugar().Errorf("error writing user distance after subscription update: %v", err)
+				}
+			}
+		}
+	}, func(event types.FriendEvent) {
+		wh.handleFriendEvent(session, event)
+	})
+	if err != nil {
+		return err
+	}
+	// The user's own events tell the session about friendships made on
+	// other servers
+	if err := subscription.AddEvents(ctx, session.userID); err != nil {
+		subscription.Close()
+		return err
+	}
+	session.setSubscription(subscription)
+	wh.sessions.register(session)
+
 	userFriends, err := wh.userDBHandler.ListUserFriends(userLoc.ID)
 	if err != nil {
 		return err
 	}
 
-	userLocations, err := wh.userCacheHandler.GetUserLocations(ctx, userFriends)
+	friendIDs := []int{}
+	for _, friend := range userFriends {
+		friendIDs = append(friendIDs, friend.ID)
+	}
+	if err := subscription.Add(ctx, friendIDs...); err != nil {
+		return err
+	}
+
+	userLocations, err := wh.nearbyFriendLocations(ctx, userLoc, userFriends)
 	if err != nil {
 		return err
 	}
 
 	for _, friendLocation := range userLocations {
-		if userDistance := wh.userDistanceIfValid(userLoc, friendLocation); userDistance != nil {
-			if err := writeUserDistance(wsConn, *userDistance); err != nil {
-				return err
-			}
+		sharedLocation, shared := wh.sharedLocation(friendLocation, userLoc.ID)
+		if !shared {
+			continue
 		}
-	}
-	err = wh.userPubSubHandler.SubscribeToFriends(ctx, userFriends, func(subscribedLocation types.UserLocation) {
-		userID := userLoc.ID
-		if location, exists := wh.userLocationByID.Get(userID); exists {
-			if userDistance := wh.userDistanceIfValid(location, subscribedLocation); userDistance != nil {
-				wh.wsConnMu.Lock()
-				defer wh.wsConnMu.Unlock()
-				if err := writeUserDistance(wsConn, *userDistance); err != nil {
-					fmt.Println("error writing user distance after subscription update: ", err)
-				}
+		wh.watchShareExpiry(session, friendLocation.ID)
+		userDistance := wh.userDistanceIfValid(userLoc, sharedLocation)
+		friends.observe(sharedLocation, userDistance != nil)
+		if userDistance != nil {
+			if err := socket.writeUserDistance(*userDistance); err != nil {
+				return err
 			}
 		}
-	})
-	if err != nil {
-		return err
 	}
 
 	return nil
 }
 
-func writeUserDistance(wsConn *websocket.Conn, distance types.UserDistance) error {
-	message, err := json.Marshal(distance)
+// nearbyFriendLocations returns the cached locations of the friends within
+// the user's radius. Caches without a radius query return every friend's
+// location and leave the filtering to userDistanceIfValid.
+func (wh *RequestHandler) nearbyFriendLocations(
+	ctx context.Context,
+	userLoc types.UserLocation,
+	friends []types.User,
+) ([]types.UserLocation, error) {
+	settings := wh.userSettings(userLoc.ID)
+	nearby, err := wh.userCacheHandler.FindNearby(ctx, userLoc, settings.Unit.ToMiles(settings.Radius))
+	if errors.Is(err, cache.ErrNearbyUnsupported) {
+		return wh.userCacheHandler.GetUserLocations(ctx, friends)
+	}
 	if err != nil {
-		return fmt.Errorf("error marshaling user distance to JSON: %v", err)
+		return nil, err
 	}
 
-	if err := wsConn.WriteMessage(websocket.TextMessage, message); err != nil {
-		return fmt.Errorf("error sending user distance message: %v", err)
+	friendIDs := make(map[int]bool, len(friends))
+	for _, friend := range friends {
+		friendIDs[friend.ID] = true
+	}
+	var friendLocations []types.UserLocation
+	for _, location := range nearby {
+		if friendIDs[location.ID] {
+			friendLocations = append(friendLocations, location)
+		}
+	}
+	return friendLocations, nil
+}
+
+// authorizeLocation only accepts locations for the user the socket was
+// opened by
+func authorizeLocation(userID int, userLocation types.UserLocation) error {
+	if userLocation.User == nil || userLocation.ID != userID {
+		return fmt.Errorf("location updates on this socket must be for user %v", userID)
 	}
 	return nil
 }
 
+// userDistanceIfValid returns the distance to the friend if they are within
+// the user's radius, in the user's unit
 func (wh *RequestHandler) userDistanceIfValid(userLocation, friendLocation types.UserLocation) *types.UserDistance {
-	distance := types.DistanceBetweenUsers(userLocation, friendLocation)
-	if distance <= types.MaxDistanceBetweenUsers {
+	settings := wh.userSettings(userLocation.ID)
+	distance := settings.Unit.FromMiles(wh.options.Distance(userLocation, friendLocation))
+	if distance <= settings.Radius {
 		return &types.UserDistance{
 			Primary:        userLocation.User,
 			Remote:         friendLocation.User,
 			Distance:       distance,
+			Unit:           settings.Unit,
 			LastUpdateTime: time.Now(),
 		}
 	}
 	return nil
 }
+
+// pathParamInt reads a mux path variable as an int
+func pathParamInt(r *http.Request, name string) (int, error) {
+	value, ok := mux.Vars(r)[name]
+	if !ok {
+		return 0, fmt.Errorf("Invalid request: missing path parameter '%v'", name)
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("Path param key %v with value %v is not int convertable: %v", name, value, err)
+	}
+	return i, nil
+}
+
+// dbErrorStatus maps errors from the db to the status code the client
+// should see
+func dbErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, db.ErrInvalidFriendRequest),
+		errors.Is(err, db.ErrInvalidSettings),
+		errors.Is(err, db.ErrInvalidLocationShare):
+		return http.StatusBadRequest
+	case errors.Is(err, db.ErrUserBlocked):
+		return http.StatusForbidden
+	case errors.Is(err, db.ErrUserNotFound),
+		errors.Is(err, db.ErrFriendRequestNotFound),
+		errors.Is(err, db.ErrSharingRuleNotFound),
+		errors.Is(err, db.ErrNotFriends),
+		errors.Is(err, db.ErrNotBlocked),
+		errors.Is(err, db.ErrLocationShareNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, db.ErrAlreadyFriends),
+		errors.Is(err, db.ErrFriendRequestExists),
+		errors.Is(err, db.ErrFriendRequestNotPending):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -0,0 +1,372 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"nearby-friends/auth"
+	"nearby-friends/cache"
+	"nearby-friends/db"
+	"nearby-friends/types"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+)
+
+// testServer is a RequestHandler behind the middleware main uses, backed by
+// an in-memory SQLite database, cache and pubsub
+type testServer struct {
+	*httptest.Server
+	handler *RequestHandler
+	db      db.DBHandler
+	tokens  *auth.TokenIssuer
+	pubsub  cache.PubSubHandlerable
+}
+
+func testOptions() Options {
+	options := DefaultOptions()
+	options.PingInterval = 0
+	options.ResumeWindow = 0
+	return options
+}
+
+func newTestServer(t *testing.T, options Options) *testServer {
+	t.Helper()
+	log := zap.NewNop()
+	dbHandler, err := db.NewDBHandler(db.SQLite, db.ConnInfo{Path: ":memory:"}, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { dbHandler.Close() })
+	pubsub := cache.NewInMemoryPubSubHandler(log)
+	t.Cleanup(func() { pubsub.Close() })
+	return newTestServerWith(t, dbHandler, pubsub, options)
+}
+
+// newTestServerWith starts a server on a database and pubsub shared with
+// other test servers, as replicas behind a load balancer would. Each server
+// has its own cache like each replica has its own memory.
+func newTestServerWith(t *testing.T, dbHandler db.DBHandler, pubsub cache.PubSubHandlerable, options Options) *testServer {
+	t.Helper()
+	log := zap.NewNop()
+	tokens := auth.NewTokenIssuer([]byte("test secret"), time.Hour)
+	ctx, cancel := context.WithCancel(context.Background())
+	handler := NewRequestHandler(ctx, dbHandler, cache.NewInMemoryCacheHandler(options.Distance, log), pubsub, tokens, options, log)
+
+	ts := &testServer{
+		Server:  httptest.NewServer(handler.WithMiddleware()),
+		handler: handler,
+		db:      dbHandler,
+		tokens:  tokens,
+		pubsub:  pubsub,
+	}
+	t.Cleanup(func() {
+		ts.Close()
+		shutdownCtx, done := context.WithTimeout(context.Background(), 5*time.Second)
+		defer done()
+		handler.Shutdown(shutdownCtx)
+		cancel()
+	})
+	return ts
+}
+
+// createUser registers the user and returns it with a token to act as it
+func (ts *testServer) createUser(t *testing.T, name string, role types.Role) (types.User, string) {
+	t.Helper()
+	user := types.User{Name: name}
+	if err := ts.db.CreateUser(&user, "password"); err != nil {
+		t.Fatal(err)
+	}
+	if role != "" {
+		if err := ts.db.SetUserRole(name, role); err != nil {
+			t.Fatal(err)
+		}
+		user.Role = role
+	}
+	token, _, err := ts.tokens.Issue(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user, token
+}
+
+// befriend makes the users friends the way clients do, with an accepted
+// friend request
+func (ts *testServer) befriend(t *testing.T, user, friend types.User) {
+	t.Helper()
+	request := types.FriendRequest{User: user, Friend: friend}
+	if err := ts.db.SendFriendRequest(&request); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ts.db.AcceptFriendRequest(friend.ID, request.ID); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// do sends the request with the token, if any, and returns the response
+// status. A successful response is decoded into out, if given.
+func (ts *testServer) do(t *testing.T, method, path, token string, body any, out ...any) int {
+	t.Helper()
+	var reader io.Reader
+	if body != nil {
+		raw, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = bytes.NewReader(raw)
+	}
+	req, err := http.NewRequest(method, ts.URL+path, reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if len(out) > 0 && resp.StatusCode < 300 {
+		if err := json.NewDecoder(resp.Body).Decode(out[0]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	io.Copy(io.Discard, resp.Body)
+	return resp.StatusCode
+}
+
+// testClient is a ProtocolV1 location socket. Messages are read in the
+// background since a websocket can't be read from again once a read timed
+// out.
+type testClient struct {
+	t        *testing.T
+	conn     *websocket.Conn
+	user     types.User
+	seq      int64
+	messages chan types.Envelope
+	// closed is closed once the server closed the socket
+	closed chan struct{}
+	// pending are the messages read while waiting for an ack
+	pending []types.Envelope
+	// lastSeq is the newest message seq read
+	lastSeq int64
+	// err is why reading stopped, set once closed is
+	err error
+}
+
+// testMessageTimeout is how long a client waits for an expected message
+const testMessageTimeout = 2 * time.Second
+
+// connect opens the user's location socket and reads the session message
+func (ts *testServer) connect(t *testing.T, user types.User, token string) *testClient {
+	t.Helper()
+	client := ts.dial(t, user, token, "", types.ProtocolV1)
+	client.expect(types.MessageSession)
+	return client
+}
+
+// dial opens the user's location socket with the query, speaking the
+// subprotocols offered, none for a legacy client
+func (ts *testServer) dial(t *testing.T, user types.User, token, query string, subprotocols ...string) *testClient {
+	t.Helper()
+	return newTestClient(t, ts.dialConn(t, user, token, query, subprotocols...), user)
+}
+
+// dialConn opens the user's location socket without reading from it
+func (ts *testServer) dialConn(t *testing.T, user types.User, token, query string, subprotocols ...string) *websocket.Conn {
+	t.Helper()
+	dialer := websocket.Dialer{Subprotocols: subprotocols}
+	header := http.Header{"Authorization": []string{"Bearer " + token}}
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/user/" + itoa(user.ID) + "/location" + query
+	conn, _, err := dialer.Dial(url, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// newTestClient reads the messages arriving on conn in the background
+func newTestClient(t *testing.T, conn *websocket.Conn, user types.User) *testClient {
+	client := &testClient{
+		t:        t,
+		conn:     conn,
+		user:     user,
+		messages: make(chan types.Envelope, 256),
+		closed:   make(chan struct{}),
+	}
+	go client.readMessages()
+	return client
+}
+
+func (c *testClient) readMessages() {
+	defer close(c.closed)
+	for {
+		var envelope types.Envelope
+		if err := c.conn.ReadJSON(&envelope); err != nil {
+			c.err = err
+			return
+		}
+		c.messages <- envelope
+	}
+}
+
+func itoa(i int) string {
+	return strconv.Itoa(i)
+}
+
+// send sends the client's location and waits for it to be acknowledged.
+// Messages arriving before the ack are kept for expect.
+func (c *testClient) send(latitude, longitude float64) {
+	c.t.Helper()
+	c.seq++
+	user := c.user
+	envelope, err := types.NewEnvelope(types.MessageLocationUpdate, c.seq, types.UserLocation{
+		User:      &user,
+		Latitude:  latitude,
+		Longitude: longitude,
+	})
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if err := c.conn.WriteJSON(envelope); err != nil {
+		c.t.Fatal(err)
+	}
+	for {
+		received := c.read(testMessageTimeout)
+		var ack types.Ack
+		if received.Type == types.MessageAck && json.Unmarshal(received.Payload, &ack) == nil && ack.Seq == c.seq {
+			return
+		}
+		c.pending = append(c.pending, received)
+	}
+}
+
+// next returns the next message, failing the test if none arrives in time
+func (c *testClient) next() types.Envelope {
+	c.t.Helper()
+	if len(c.pending) > 0 {
+		envelope := c.pending[0]
+		c.pending = c.pending[1:]
+		return envelope
+	}
+	return c.read(testMessageTimeout)
+}
+
+func (c *testClient) read(timeout time.Duration) types.Envelope {
+	c.t.Helper()
+	envelope, ok := c.tryRead(timeout)
+	if !ok {
+		c.t.Fatalf("user %v read no message in %v", c.user.ID, timeout)
+	}
+	return envelope
+}
+
+// tryRead returns the next message read from the socket within timeout
+func (c *testClient) tryRead(timeout time.Duration) (types.Envelope, bool) {
+	select {
+	case envelope := <-c.messages:
+		c.lastSeq = max(c.lastSeq, envelope.Seq)
+		return envelope, true
+	case <-time.After(timeout):
+		return types.Envelope{}, false
+	}
+}
+
+// expect reads messages until one of the type arrives and decodes its
+// payload into payload, if given. Acks are skipped.
+func (c *testClient) expect(messageType types.MessageType, payload ...any) {
+	c.t.Helper()
+	for {
+		envelope := c.next()
+		if envelope.Type == types.MessageAck {
+			continue
+		}
+		if envelope.Type != messageType {
+			c.t.Fatalf("user %v got %v message %s, want %v", c.user.ID, envelope.Type, envelope.Payload, messageType)
+		}
+		if len(payload) > 0 {
+			if err := json.Unmarshal(envelope.Payload, payload[0]); err != nil {
+				c.t.Fatal(err)
+			}
+		}
+		return
+	}
+}
+
+// expectNothing fails the test if a message other than an ack arrives
+// within wait
+func (c *testClient) expectNothing(wait time.Duration) {
+	c.t.Helper()
+	pending := c.pending
+	c.pending = nil
+	deadline := time.After(wait)
+	for {
+		for _, envelope := range pending {
+			if envelope.Type != types.MessageAck {
+				c.t.Fatalf("user %v got unexpected %v message %s", c.user.ID, envelope.Type, envelope.Payload)
+			}
+		}
+		select {
+		case envelope := <-c.messages:
+			pending = []types.Envelope{envelope}
+		case <-deadline:
+			return
+		}
+	}
+}
+
+// expectOutOfRange reads messages until the friend is reported out of range
+// and checks the reason
+func (c *testClient) expectOutOfRange(friendID int, reason types.OutOfRangeReason) {
+	c.t.Helper()
+	var outOfRange types.FriendOutOfRange
+	c.expect(types.MessageFriendOutOfRange, &outOfRange)
+	if outOfRange.Friend == nil || outOfRange.Friend.ID != friendID || outOfRange.Reason != reason {
+		c.t.Fatalf("user %v got %+v out of range, want friend %v for %v", c.user.ID, outOfRange, friendID, reason)
+	}
+}
+
+// expectDistance reads messages until the friend's distance arrives
+func (c *testClient) expectDistance(friendID int) types.UserDistance {
+	c.t.Helper()
+	var distance types.UserDistance
+	c.expect(types.MessageFriendDistance, &distance)
+	if distance.Remote == nil || distance.Remote.ID != friendID {
+		c.t.Fatalf("user %v got distance %+v, want one to friend %v", c.user.ID, distance, friendID)
+	}
+	return distance
+}
+
+// drain discards every message arriving until none did for wait
+func (c *testClient) drain(wait time.Duration) {
+	c.pending = nil
+	for {
+		if _, ok := c.tryRead(wait); !ok {
+			return
+		}
+	}
+}
+
+// meet puts the clients next to each other and waits until each was shown
+// the other's distance. A client's first location isn't broadcast, only
+// looked up by friends connecting later, so both send another.
+func meet(t *testing.T, client, friend *testClient) {
+	t.Helper()
+	client.send(40.7128, -74.0060)
+	friend.send(40.7130, -74.0062)
+	friend.send(40.7130, -74.0062)
+	client.expectDistance(friend.user.ID)
+	client.send(40.7128, -74.0060)
+	friend.expectDistance(client.user.ID)
+	client.drain(50 * time.Millisecond)
+	friend.drain(50 * time.Millisecond)
+}
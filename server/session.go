@@ -0,0 +1,158 @@
+package server
+
+import (
+	"context"
+	"nearby-friends/cache"
+	"nearby-friends/types"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+)
+
+var sessionIDs atomic.Uint64
+
+// Session is one location websocket connection and everything that lives
+// as long as it does: the socket and its write lock, the user's latest
+// location, the pubsub subscription to their friends and the friends in
+// range. Nothing a session holds is shared with other connections, so a
+// slow client only ever holds up its own writes.
+// A session whose client loses its connection can be parked and resumed on
+// a new one, see parkedSessions.
+type Session struct {
+	id     uint64
+	userID int
+	// token lets the client resume the session after losing its
+	// connection. Only ProtocolV1 sessions have one.
+	token string
+
+	socket   *locationSocket
+	friends  *friendRange
+	expiries *shareExpiries
+
+	ctx       context.Context
+	cancel    context.CancelFunc
+	closeOnce sync.Once
+	closeErr  error
+
+	mu           sync.RWMutex
+	location     types.UserLocation
+	hasLocation  bool
+	subscription cache.Subscription
+}
+
+// newSession starts a session for the user on the connection. The session
+// ends when ctx is done or Close is called.
+func newSession(ctx context.Context, userID int, conn *websocket.Conn, options Options, log *zap.Logger) *Session {
+	ctx, cancel := context.WithCancel(ctx)
+	session := &Session{
+		id:       sessionIDs.Add(1),
+		userID:   userID,
+		socket:   newLocationSocket(conn, options, log.With(zap.Int("user", userID))),
+		friends:  newFriendRange(),
+		expiries: newShareExpiries(ctx),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+	session.socket.start()
+	if options.PingInterval > 0 {
+		go session.keepalive(options.PingInterval)
+	}
+	return session
+}
+
+// keepalive pings the client every interval until the session ends. A client
+// that stops answering is caught by the socket's read deadline. Pings fail
+// while the session is parked and pick up again once it is resumed.
+func (s *Session) keepalive(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			s.socket.ping()
+		}
+	}
+}
+
+func (s *Session) ID() uint64 {
+	return s.id
+}
+
+func (s *Session) UserID() int {
+	return s.userID
+}
+
+// Location returns the latest location accepted on the session, if any
+func (s *Session) Location() (types.UserLocation, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.location, s.hasLocation
+}
+
+func (s *Session) setLocation(location types.UserLocation) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.location, s.hasLocation = location, true
+}
+
+func (s *Session) Subscription() cache.Subscription {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.subscription
+}
+
+func (s *Session) setSubscription(subscription cache.Subscription) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.subscription = subscription
+}
+
+// hideFriend stops showing the friend to the client, telling it why if the
+// friend was in range
+func (s *Session) hideFriend(friendID int, reason types.OutOfRangeReason) error {
+	location, wasInRange := s.friends.remove(friendID)
+	if !wasInRange {
+		return nil
+	}
+	return s.socket.writeFriendOutOfRange(location, reason)
+}
+
+// dropFriend stops following a user that is no longer a friend
+func (s *Session) dropFriend(ctx context.Context, friendID int) error {
+	if err := s.Subscription().Remove(ctx, friendID); err != nil {
+		return err
+	}
+	return s.hideFriend(friendID, types.OutOfRangeHidden)
+}
+
+// Done is closed once the session ended
+func (s *Session) Done() <-chan struct{} {
+	return s.ctx.Done()
+}
+
+// Close ends the session normally, see CloseWith
+func (s *Session) Close() error {
+	return s.CloseWith(websocket.CloseNormalClosure, "")
+}
+
+// CloseWith ends the session, stopping everything started for it and closing
+// its subscription. Messages already queued are flushed before the client is
+// sent a close frame with the code and reason and the connection is closed.
+// It is safe to call more than once, only the first call's code is sent.
+func (s *Session) CloseWith(code int, reason string) error {
+	s.closeOnce.Do(func() {
+		s.cancel()
+		if subscription := s.Subscription(); subscription != nil {
+			subscription.Close()
+		}
+		s.socket.close(code, reason)
+		conn, _ := s.socket.connection()
+		s.closeErr = conn.Close()
+	})
+	return s.closeErr
+}
@@ -0,0 +1,292 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"nearby-friends/types"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestDisconnectTellsFriendsOffline(t *testing.T) {
+	ts := newTestServer(t, testOptions())
+	other := newTestServerWith(t, ts.db, ts.pubsub, testOptions())
+	alice, aliceToken := ts.createUser(t, "alice", "")
+	bob, bobToken := ts.createUser(t, "bob", "")
+	carol, carolToken := ts.createUser(t, "carol", "")
+	ts.befriend(t, alice, bob)
+	ts.befriend(t, alice, carol)
+
+	first := ts.connect(t, alice, aliceToken)
+	second := ts.connect(t, alice, aliceToken)
+	second.send(40.7128, -74.0060)
+	bobClient := ts.connect(t, bob, bobToken)
+	meet(t, first, bobClient)
+	// Carol is served by another replica
+	carolClient := other.connect(t, carol, carolToken)
+	meet(t, first, carolClient)
+	bobClient.drain(50 * time.Millisecond)
+
+	// Alice is still online through her other session
+	first.conn.Close()
+	bobClient.expectNothing(100 * time.Millisecond)
+	carolClient.expectNothing(100 * time.Millisecond)
+
+	second.conn.Close()
+	bobClient.expectOutOfRange(alice.ID, types.OutOfRangeOffline)
+	carolClient.expectOutOfRange(alice.ID, types.OutOfRangeOffline)
+}
+
+func TestUnresponsiveClientTimesOut(t *testing.T) {
+	options := testOptions()
+	options.PingInterval = 20 * time.Millisecond
+	options.PongTimeout = 150 * time.Millisecond
+	ts := newTestServer(t, options)
+	alice, aliceToken := ts.createUser(t, "alice", "")
+	bob, bobToken := ts.createUser(t, "bob", "")
+	ts.befriend(t, alice, bob)
+
+	// Bob answers pings until he goes silent
+	var silent atomic.Bool
+	conn := ts.dialConn(t, bob, bobToken, "", types.ProtocolV1)
+	conn.SetPingHandler(func(data string) error {
+		if silent.Load() {
+			return nil
+		}
+		return conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+	})
+	bobClient := newTestClient(t, conn, bob)
+	bobClient.expect(types.MessageSession)
+	aliceClient := ts.connect(t, alice, aliceToken)
+	meet(t, aliceClient, bobClient)
+
+	// Pongs keep a quiet client connected past the timeout
+	select {
+	case <-bobClient.closed:
+		t.Fatal("a client answering pings was disconnected")
+	case <-time.After(2 * options.PongTimeout):
+	}
+
+	silent.Store(true)
+	select {
+	case <-bobClient.closed:
+	case <-time.After(testMessageTimeout):
+		t.Fatal("a client that stopped answering pings is still connected")
+	}
+	aliceClient.expectOutOfRange(bob.ID, types.OutOfRangeOffline)
+	waitFor(t, func() bool { return len(ts.handler.sessions.sessions(bob.ID)) == 0 })
+}
+
+func TestSessionsDontShareState(t *testing.T) {
+	ts := newTestServer(t, testOptions())
+	alice, aliceToken := ts.createUser(t, "alice", "")
+	bob, bobToken := ts.createUser(t, "bob", "")
+	carol, carolToken := ts.createUser(t, "carol", "")
+	ts.befriend(t, alice, bob)
+
+	bobClient := ts.connect(t, bob, bobToken)
+	bobClient.send(40.7130, -74.0062)
+	// Alice is in New York on one device and in London on the other
+	nearby := ts.connect(t, alice, aliceToken)
+	nearby.send(40.7128, -74.0060)
+	nearby.expectDistance(bob.ID)
+	away := ts.connect(t, alice, aliceToken)
+	away.send(51.5074, -0.1278)
+	// Carol is next to Bob but isn't his friend
+	carolClient := ts.connect(t, carol, carolToken)
+	carolClient.send(40.7130, -74.0062)
+	nearby.drain(50 * time.Millisecond)
+	away.drain(50 * time.Millisecond)
+	bobClient.drain(50 * time.Millisecond)
+
+	bobClient.send(40.7131, -74.0063)
+	nearby.expectDistance(bob.ID)
+	away.expectNothing(100 * time.Millisecond)
+	carolClient.expectNothing(100 * time.Millisecond)
+
+	sessions := ts.handler.sessions.sessions(alice.ID)
+	if len(sessions) != 2 {
+		t.Fatalf("%v sessions registered for alice, want 2", len(sessions))
+	}
+	if sessions[0].Subscription() == sessions[1].Subscription() {
+		t.Fatal("alice's sessions share a subscription")
+	}
+	latitudes := map[float64]bool{}
+	for _, session := range sessions {
+		location, ok := session.Location()
+		if !ok {
+			t.Fatal("session of alice has no location")
+		}
+		latitudes[location.Latitude] = true
+	}
+	if !latitudes[40.7128] || !latitudes[51.5074] {
+		t.Fatalf("alice's sessions are at latitudes %v, want each at its own", latitudes)
+	}
+}
+
+func TestBlockedSessionDoesntHoldUpOthers(t *testing.T) {
+	options := testOptions()
+	options.OutboundQueueSize = 4
+	options.DropPolicy = DropOldest
+	ts := newTestServer(t, options)
+	alice, aliceToken := ts.createUser(t, "alice", "")
+	bob, bobToken := ts.createUser(t, "bob", "")
+	carol, carolToken := ts.createUser(t, "carol", "")
+	ts.befriend(t, alice, bob)
+	ts.befriend(t, alice, carol)
+
+	aliceClient := ts.connect(t, alice, aliceToken)
+	bobClient := ts.connect(t, bob, bobToken)
+	meet(t, aliceClient, bobClient)
+	carolClient := ts.connect(t, carol, carolToken)
+	meet(t, aliceClient, carolClient)
+	bobClient.drain(50 * time.Millisecond)
+
+	// Bob's writer gets stuck writing his next message, as it would on a
+	// client that stopped reading
+	bobSession := ts.handler.sessions.sessions(bob.ID)[0]
+	bobSession.socket.mu.Lock()
+	released := false
+	release := func() {
+		if !released {
+			released = true
+			bobSession.socket.mu.Unlock()
+		}
+	}
+	defer release()
+
+	for i := 0; i < 20; i++ {
+		aliceClient.send(40.7128, -74.0060+float64(i)/100000)
+		carolClient.expectDistance(alice.ID)
+	}
+	if bobSession.socket.queue.droppedCount() == 0 {
+		t.Fatal("bob's queue never filled up, his session wasn't blocked")
+	}
+
+	release()
+	bobClient.expectDistance(alice.ID)
+}
+
+func TestDisconnectEndsOnlyThatSession(t *testing.T) {
+	ts := newTestServer(t, testOptions())
+	alice, aliceToken := ts.createUser(t, "alice", "")
+	bob, bobToken := ts.createUser(t, "bob", "")
+	ts.befriend(t, alice, bob)
+
+	first := ts.connect(t, alice, aliceToken)
+	first.send(40.7128, -74.0060)
+	second := ts.connect(t, alice, aliceToken)
+	bobClient := ts.connect(t, bob, bobToken)
+	meet(t, second, bobClient)
+	first.drain(50 * time.Millisecond)
+
+	sessions := ts.handler.sessions.sessions(alice.ID)
+	if len(sessions) != 2 {
+		t.Fatalf("%v sessions registered for alice, want 2", len(sessions))
+	}
+	closed, kept := sessions[0], sessions[1]
+	if closed.ID() > kept.ID() {
+		closed, kept = kept, closed
+	}
+	bobSession := ts.handler.sessions.sessions(bob.ID)[0]
+
+	first.conn.Close()
+	waitFor(t, func() bool { return len(ts.handler.sessions.sessions(alice.ID)) == 1 })
+	if remaining := ts.handler.sessions.sessions(alice.ID)[0]; remaining != kept {
+		t.Fatal("alice's other session was deregistered")
+	}
+	if remaining := ts.handler.sessions.sessions(bob.ID); len(remaining) != 1 || remaining[0] != bobSession {
+		t.Fatal("bob's session was deregistered")
+	}
+	waitFor(t, func() bool {
+		ts.handler.sessions.mu.RLock()
+		defer ts.handler.sessions.mu.RUnlock()
+		_, tracked := ts.handler.sessions.live[closed]
+		return !tracked
+	})
+	ts.handler.sessions.mu.RLock()
+	_, keptTracked := ts.handler.sessions.live[kept]
+	_, bobTracked := ts.handler.sessions.live[bobSession]
+	ts.handler.sessions.mu.RUnlock()
+	if !keptTracked || !bobTracked {
+		t.Fatalf("alice's other session tracked %v, bob's %v, want both still tracked", keptTracked, bobTracked)
+	}
+
+	bobClient.send(40.7131, -74.0063)
+	second.expectDistance(bob.ID)
+}
+
+// expectClosed waits for the server to close the socket with the code and
+// reason
+func (c *testClient) expectClosed(code int, reason string) {
+	c.t.Helper()
+	select {
+	case <-c.closed:
+	case <-time.After(testMessageTimeout):
+		c.t.Fatal("socket is still open")
+	}
+	var closeErr *websocket.CloseError
+	if !errors.As(c.err, &closeErr) || closeErr.Code != code || closeErr.Text != reason {
+		c.t.Fatalf("socket closed with %v, want close code %v %q", c.err, code, reason)
+	}
+}
+
+func TestShutdownDrainsSessions(t *testing.T) {
+	options := testOptions()
+	options.History = true
+	ts := newTestServer(t, options)
+	alice, aliceToken := ts.createUser(t, "alice", "")
+	bob, bobToken := ts.createUser(t, "bob", "")
+	ts.befriend(t, alice, bob)
+
+	aliceClient := ts.connect(t, alice, aliceToken)
+	bobClient := ts.connect(t, bob, bobToken)
+	meet(t, aliceClient, bobClient)
+	// Still queued for the history when the server shuts down
+	bobClient.send(40.7135, -74.0065)
+	aliceClient.expectDistance(bob.ID)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := ts.handler.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, client := range []*testClient{aliceClient, bobClient} {
+		var goingAway types.GoingAway
+		client.expect(types.MessageGoingAway, &goingAway)
+		if !goingAway.Reconnect || goingAway.RetryAfter == "" {
+			t.Fatalf("got %+v, want the client told when to reconnect", goingAway)
+		}
+		client.expectClosed(websocket.CloseGoingAway, goingAwayReason)
+	}
+	if sessions := ts.handler.sessions.sessions(bob.ID); len(sessions) != 0 {
+		t.Fatalf("%v sessions of bob outlived the shutdown", len(sessions))
+	}
+
+	// The history was written before Shutdown returned, while the db is open
+	points, err := ts.db.ListLocationHistory(bob.ID, time.Time{}, time.Now().Add(time.Minute), maxHistoryPoints)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) == 0 || points[len(points)-1].Latitude != 40.7135 {
+		t.Fatalf("bob's history is %+v, want it to end with his last location", points)
+	}
+
+	// Sockets opened while draining are turned away
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/user/" + itoa(alice.ID) + "/location"
+	header := http.Header{"Authorization": []string{"Bearer " + aliceToken}}
+	conn, resp, err := websocket.DefaultDialer.Dial(url, header)
+	if err == nil {
+		conn.Close()
+		t.Fatal("opened a location socket on a server shutting down")
+	}
+	if resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("got %v opening a location socket while draining, want %v", err, http.StatusServiceUnavailable)
+	}
+}
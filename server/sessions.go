@@ -0,0 +1,151 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// sessionRegistry indexes the live sessions by the user holding them so
+// their subscriptions can follow friendship changes while the user is
+// connected. A user may have more than one session open. It also tracks
+// every session from the moment it starts, registered or not, so they can
+// all be drained when the server shuts down.
+type sessionRegistry struct {
+	mu       sync.RWMutex
+	byUser   map[int]map[*Session]struct{}
+	live     map[*Session]struct{}
+	ended    sync.WaitGroup
+	draining bool
+	log      *zap.Logger
+}
+
+func newSessionRegistry(log *zap.Logger) *sessionRegistry {
+	return &sessionRegistry{
+		byUser: make(map[int]map[*Session]struct{}),
+		live:   make(map[*Session]struct{}),
+		log:    log,
+	}
+}
+
+// track records a session that just started. It reports false once the
+// registry is draining, in which case the session must be closed right away.
+func (r *sessionRegistry) track(session *Session) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.draining {
+		return false
+	}
+	r.live[session] = struct{}{}
+	r.ended.Add(1)
+	return true
+}
+
+// untrack records a tracked session has ended and cleaned up after itself
+func (r *sessionRegistry) untrack(session *Session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.live[session]; !ok {
+		return
+	}
+	delete(r.live, session)
+	r.ended.Done()
+}
+
+func (r *sessionRegistry) isDraining() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.draining
+}
+
+// drain stops new sessions from being tracked and returns the live ones
+func (r *sessionRegistry) drain() []*Session {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.draining = true
+	sessions := make([]*Session, 0, len(r.live))
+	for session := range r.live {
+		sessions = append(sessions, session)
+	}
+	return sessions
+}
+
+// wait blocks until every tracked session ended or ctx is done
+func (r *sessionRegistry) wait(ctx context.Context) error {
+	ended := make(chan struct{})
+	go func() {
+		r.ended.Wait()
+		close(ended)
+	}()
+	select {
+	case <-ended:
+		return nil
+	case <-ctx.Done():
+		r.mu.RLock()
+		defer r.mu.RUnlock()
+		return fmt.Errorf("%v sessions still open: %v", len(r.live), ctx.Err())
+	}
+}
+
+func (r *sessionRegistry) register(session *Session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.byUser[session.userID]; !ok {
+		r.byUser[session.userID] = make(map[*Session]struct{})
+	}
+	r.byUser[session.userID][session] = struct{}{}
+}
+
+func (r *sessionRegistry) deregister(session *Session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.byUser[session.userID], session)
+	if len(r.byUser[session.userID]) == 0 {
+		delete(r.byUser, session.userID)
+	}
+}
+
+// sessions returns the sessions userID has open
+func (r *sessionRegistry) sessions(userID int) []*Session {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	sessions := make([]*Session, 0, len(r.byUser[userID]))
+	for session := range r.byUser[userID] {
+		sessions = append(sessions, session)
+	}
+	return sessions
+}
+
+// subscribe starts delivering updates from the friends to every session
+// userID has open
+func (r *sessionRegistry) subscribe(ctx context.Context, userID int, friendIDs ...int) {
+	for _, session := range r.sessions(userID) {
+		if err := session.Subscription().Add(ctx, friendIDs...); err != nil {
+			r.log.Sugar().Errorf("error subscribing user %v to friends %v: %v", userID, friendIDs, err)
+		}
+	}
+}
+
+// establishFriendship subscribes both users to each other
+func (r *sessionRegistry) establishFriendship(ctx context.Context, userID, friendID int) {
+	r.subscribe(ctx, userID, friendID)
+	r.subscribe(ctx, friendID, userID)
+}
+
+// severFriendship tears down the subscriptions both users hold on each other
+// and takes them out of each other's range
+func (r *sessionRegistry) severFriendship(ctx context.Context, userID, friendID int) {
+	r.dropFriend(ctx, userID, friendID)
+	r.dropFriend(ctx, friendID, userID)
+}
+
+// dropFriend has every session userID has open stop following the friend
+func (r *sessionRegistry) dropFriend(ctx context.Context, userID, friendID int) {
+	for _, session := range r.sessions(userID) {
+		if err := session.dropFriend(ctx, friendID); err != nil {
+			r.log.Sugar().Errorf("error dropping friend %v from user %v: %v", friendID, userID, err)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"nearby-friends/types"
+	"net/http"
+
+	"go.uber.org/zap"
+)
+
+// settingsCache holds the settings of users seen by this server so
+// distances can be filtered without a db round trip per location update
+type settingsCache = userCache[types.UserSettings]
+
+func newSettingsCache() *settingsCache {
+	return newUserCache[types.UserSettings]()
+}
+
+// userSettings returns the settings distances are filtered and reported by
+// for the user. The defaults are used if they can't be loaded.
+func (wh *RequestHandler) userSettings(userID int) types.UserSettings {
+	settings, err := wh.loadUserSettings(userID)
+	if err != nil {
+		wh.log.Sugar().Errorf("error loading settings for user %v, using defaults: %v", userID, err)
+		return types.DefaultUserSettings()
+	}
+	return settings
+}
+
+func (wh *RequestHandler) loadUserSettings(userID int) (types.UserSettings, error) {
+	if settings, ok := wh.settings.get(userID); ok {
+		return settings, nil
+	}
+	settings, err := wh.userDBHandler.GetUserSettings(userID)
+	if err != nil {
+		return types.UserSettings{}, err
+	}
+	wh.settings.set(userID, *settings)
+	return *settings, nil
+}
+
+func (wh *RequestHandler) getUserSettings() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := pathParamInt(r, "id")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		settings, err := wh.userDBHandler.GetUserSettings(userID)
+		if err != nil {
+			http.Error(w,
+				fmt.Sprintf("error getting settings for user %v: %v", userID, err),
+				http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(settings)
+	}
+}
+
+// updateUserSettings saves the settings in the request body. Fields left
+// out of the body keep their current value.
+func (wh *RequestHandler) updateUserSettings() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := pathParamInt(r, "id")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		settings, err := wh.userDBHandler.GetUserSettings(userID)
+		if err != nil {
+			http.Error(w,
+				fmt.Sprintf("error getting settings for user %v: %v", userID, err),
+				http.StatusInternalServerError)
+			return
+		}
+		previous := *settings
+		if err := json.NewDecoder(r.Body).Decode(settings); err != nil {
+			http.Error(w,
+				fmt.Sprintf("Invalid request body: %v", err),
+				http.StatusBadRequest)
+			return
+		}
+
+		if err := wh.userDBHandler.UpdateUserSettings(userID, *settings); err != nil {
+			writeGenericError(w, err, dbErrorStatus(err))
+			return
+		}
+		wh.settings.set(userID, *settings)
+		if settings.Ghost && !previous.Ghost || settings.Sharing != previous.Sharing {
+			wh.visibilityChanged(r.Context(), userID)
+		}
+		wh.log.With(
+			zap.Int("user", userID),
+			zap.Float64("radius", settings.Radius),
+			zap.String("unit", string(settings.Unit)),
+		).Info("Updated user settings")
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(settings)
+	}
+}
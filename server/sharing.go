@@ -0,0 +1,205 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"nearby-friends/geo"
+	"nearby-friends/types"
+	"net/http"
+
+	"go.uber.org/zap"
+)
+
+// sharingCache holds the per friend sharing levels of users seen by this
+// server so they don't have to be loaded for every location update
+type sharingCache = userCache[map[int]types.SharingLevel]
+
+func newSharingCache() *sharingCache {
+	return newUserCache[map[int]types.SharingLevel]()
+}
+
+func (wh *RequestHandler) loadFriendSharing(userID int) (map[int]types.SharingLevel, error) {
+	if levels, ok := wh.sharing.get(userID); ok {
+		return levels, nil
+	}
+	rules, err := wh.userDBHandler.ListFriendSharing(userID)
+	if err != nil {
+		return nil, err
+	}
+	levels := make(map[int]types.SharingLevel, len(rules))
+	for _, rule := range rules {
+		levels[rule.Friend.ID] = rule.Level
+	}
+	wh.sharing.set(userID, levels)
+	return levels, nil
+}
+
+// sharingLevel is how much of the sharer's location the viewer gets to see.
+// An active location share raises the level for its duration, but ghost
+// mode hides the sharer regardless. The location is hidden if the sharer's
+// rules can't be loaded.
+func (wh *RequestHandler) sharingLevel(sharerID, viewerID int) types.SharingLevel {
+	settings, err := wh.loadUserSettings(sharerID)
+	if err != nil {
+		wh.log.Sugar().Errorf("error loading settings for user %v, hiding their location: %v", sharerID, err)
+		return types.SharingOff
+	}
+	if settings.Ghost {
+		return types.SharingOff
+	}
+
+	levels, err := wh.loadFriendSharing(sharerID)
+	if err != nil {
+		wh.log.Sugar().Errorf("error loading friend sharing for user %v, hiding their location: %v", sharerID, err)
+		return types.SharingOff
+	}
+	level, ok := levels[viewerID]
+	if !ok {
+		level = settings.Sharing
+	}
+
+	share, err := wh.activeShare(sharerID, viewerID)
+	if err != nil {
+		wh.log.Sugar().Errorf("error loading location shares for user %v: %v", sharerID, err)
+		return level
+	}
+	if share != nil && sharingRank(share.Level) > sharingRank(level) {
+		return share.Level
+	}
+	return level
+}
+
+// sharedLocation returns the sharer's location the way the viewer is allowed
+// to see it. Approximate locations are snapped to the server's grid before
+// any distance is computed from them.
+func (wh *RequestHandler) sharedLocation(location types.UserLocation, viewerID int) (types.UserLocation, bool) {
+	switch wh.sharingLevel(location.ID, viewerID) {
+	case types.SharingPrecise:
+		return location, true
+	case types.SharingApproximate:
+		location.Latitude, location.Longitude = geo.Snap(location.Latitude, location.Longitude, wh.options.ApproximateGrid)
+		return location, true
+	default:
+		return location, false
+	}
+}
+
+// visibilityChanged tells the sessions of the viewers, every friend when
+// none are given, that the user may have stopped sharing their location
+// with them so they hide the user right away rather than once their last
+// location goes stale
+func (wh *RequestHandler) visibilityChanged(ctx context.Context, userID int, viewerIDs ...int) {
+	event := types.FriendEvent{UserID: userID, Kind: types.FriendEventVisibility, Viewers: viewerIDs}
+	if err := wh.userPubSubHandler.BroadcastEvent(ctx, event); err != nil {
+		wh.log.Sugar().Errorf("error publishing %v event for user %v: %v", event.Kind, userID, err)
+	}
+}
+
+// recheckVisibility hides the sharer from the session if they no longer
+// share their location with its user
+func (wh *RequestHandler) recheckVisibility(session *Session, sharerID int) {
+	// The server the change was made on only invalidated its own caches
+	wh.settings.invalidate(sharerID)
+	wh.sharing.invalidate(sharerID)
+	wh.shares.invalidate(sharerID)
+	if wh.sharingLevel(sharerID, session.userID) != types.SharingOff {
+		return
+	}
+	if err := session.hideFriend(sharerID, types.OutOfRangeHidden); err != nil {
+		wh.log.Sugar().Errorf("error hiding user %v from user %v: %v", sharerID, session.userID, err)
+	}
+}
+
+func (wh *RequestHandler) listFriendSharing() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := pathParamInt(r, "id")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		rules, err := wh.userDBHandler.ListFriendSharing(userID)
+		if err != nil {
+			http.Error(w,
+				fmt.Sprintf("error listing friend sharing for user %v: %v", userID, err),
+				http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(rules)
+	}
+}
+
+func (wh *RequestHandler) setFriendSharing() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := pathParamInt(r, "id")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		friendID, err := pathParamInt(r, "friendID")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var rule types.FriendSharing
+		if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+			http.Error(w,
+				fmt.Sprintf("Invalid request body: %v", err),
+				http.StatusBadRequest)
+			return
+		}
+		rule.Friend = types.User{ID: friendID}
+
+		if err := wh.userDBHandler.SetFriendSharing(userID, friendID, rule.Level); err != nil {
+			writeGenericError(w, err, dbErrorStatus(err))
+			return
+		}
+		wh.sharing.invalidate(userID)
+		if rule.Level == types.SharingOff {
+			wh.visibilityChanged(r.Context(), userID, friendID)
+		}
+		wh.log.With(
+			zap.Int("user", userID),
+			zap.Int("friend", friendID),
+			zap.String("level", string(rule.Level)),
+		).Info("Set friend sharing level")
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(rule)
+	}
+}
+
+func (wh *RequestHandler) removeFriendSharing() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := pathParamInt(r, "id")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		friendID, err := pathParamInt(r, "friendID")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := wh.userDBHandler.RemoveFriendSharing(userID, friendID); err != nil {
+			writeGenericError(w, err, dbErrorStatus(err))
+			return
+		}
+		wh.sharing.invalidate(userID)
+		// The friend falls back to the user's default level, which may be off
+		wh.visibilityChanged(r.Context(), userID, friendID)
+		wh.log.With(
+			zap.Int("user", userID),
+			zap.Int("friend", friendID),
+		).Info("Removed friend sharing level")
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
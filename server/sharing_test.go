@@ -0,0 +1,67 @@
+package server
+
+import (
+	"nearby-friends/types"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestGhostModeHidesUserFromFriends(t *testing.T) {
+	ts := newTestServer(t, testOptions())
+	other := newTestServerWith(t, ts.db, ts.pubsub, testOptions())
+	alice, aliceToken := ts.createUser(t, "alice", "")
+	bob, bobToken := ts.createUser(t, "bob", "")
+	carol, carolToken := ts.createUser(t, "carol", "")
+	ts.befriend(t, alice, bob)
+	ts.befriend(t, alice, carol)
+
+	aliceClient := ts.connect(t, alice, aliceToken)
+	bobClient := ts.connect(t, bob, bobToken)
+	meet(t, aliceClient, bobClient)
+	// Carol is served by another replica, which has alice's settings cached
+	carolClient := other.connect(t, carol, carolToken)
+	meet(t, aliceClient, carolClient)
+	bobClient.drain(50 * time.Millisecond)
+
+	status := ts.do(t, http.MethodPut, "/user/"+itoa(alice.ID)+"/settings", aliceToken, map[string]any{"ghost": true})
+	if status != http.StatusOK {
+		t.Fatalf("got status %v, want %v", status, http.StatusOK)
+	}
+	bobClient.expectOutOfRange(alice.ID, types.OutOfRangeHidden)
+	carolClient.expectOutOfRange(alice.ID, types.OutOfRangeHidden)
+
+	// Ghosts still see their friends
+	bobClient.send(40.7130, -74.0062)
+	aliceClient.expectDistance(bob.ID)
+	aliceClient.send(40.7128, -74.0060)
+	bobClient.expectNothing(100 * time.Millisecond)
+	carolClient.expectNothing(100 * time.Millisecond)
+}
+
+func TestSharingOffHidesUserFromFriend(t *testing.T) {
+	ts := newTestServer(t, testOptions())
+	alice, aliceToken := ts.createUser(t, "alice", "")
+	bob, bobToken := ts.createUser(t, "bob", "")
+	carol, carolToken := ts.createUser(t, "carol", "")
+	ts.befriend(t, alice, bob)
+	ts.befriend(t, alice, carol)
+
+	aliceClient := ts.connect(t, alice, aliceToken)
+	bobClient := ts.connect(t, bob, bobToken)
+	carolClient := ts.connect(t, carol, carolToken)
+	meet(t, aliceClient, bobClient)
+	meet(t, aliceClient, carolClient)
+	bobClient.drain(50 * time.Millisecond)
+
+	path := "/user/" + itoa(alice.ID) + "/sharing/" + itoa(bob.ID)
+	if status := ts.do(t, http.MethodPut, path, aliceToken, types.FriendSharing{Level: types.SharingOff}); status != http.StatusOK {
+		t.Fatalf("got status %v, want %v", status, http.StatusOK)
+	}
+	bobClient.expectOutOfRange(alice.ID, types.OutOfRangeHidden)
+	// Only bob is hidden from
+	carolClient.expectNothing(100 * time.Millisecond)
+	aliceClient.send(40.7128, -74.0060)
+	carolClient.expectDistance(alice.ID)
+	bobClient.expectNothing(100 * time.Millisecond)
+}
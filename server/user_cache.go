@@ -0,0 +1,88 @@
+package server
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// userCacheTTL is how long data loaded for a user is kept. Invalidation only
+// reaches the server a change was made on and the sessions following the
+// user, so this also bounds how long other servers can be stale.
+const userCacheTTL = time.Minute
+
+type userCacheEntry[T any] struct {
+	userID    int
+	value     T
+	expiresAt time.Time
+}
+
+// userCache holds a value per user for userCacheTTL. Entries are kept in the
+// order they expire in so the expired ones are dropped without scanning the
+// rest, and the cache only grows with the users seen in the last TTL.
+type userCache[T any] struct {
+	mu     sync.Mutex
+	byUser map[int]*list.Element
+	expiry *list.List
+	ttl    time.Duration
+	now    func() time.Time
+}
+
+func newUserCache[T any]() *userCache[T] {
+	return &userCache[T]{
+		byUser: make(map[int]*list.Element),
+		expiry: list.New(),
+		ttl:    userCacheTTL,
+		now:    time.Now,
+	}
+}
+
+func (c *userCache[T]) get(userID int) (T, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sweep()
+	element, ok := c.byUser[userID]
+	if !ok {
+		var zero T
+		return zero, false
+	}
+	return element.Value.(*userCacheEntry[T]).value, true
+}
+
+func (c *userCache[T]) set(userID int, value T) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sweep()
+	entry := &userCacheEntry[T]{userID: userID, value: value, expiresAt: c.now().Add(c.ttl)}
+	if element, ok := c.byUser[userID]; ok {
+		element.Value = entry
+		c.expiry.MoveToBack(element)
+		return
+	}
+	c.byUser[userID] = c.expiry.PushBack(entry)
+}
+
+// invalidate drops the users' values so they are reloaded on next use
+func (c *userCache[T]) invalidate(userIDs ...int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, userID := range userIDs {
+		if element, ok := c.byUser[userID]; ok {
+			c.expiry.Remove(element)
+			delete(c.byUser, userID)
+		}
+	}
+}
+
+// sweep drops the expired entries, which are all at the front
+func (c *userCache[T]) sweep() {
+	now := c.now()
+	for element := c.expiry.Front(); element != nil; element = c.expiry.Front() {
+		entry := element.Value.(*userCacheEntry[T])
+		if now.Before(entry.expiresAt) {
+			return
+		}
+		c.expiry.Remove(element)
+		delete(c.byUser, entry.userID)
+	}
+}
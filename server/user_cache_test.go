@@ -0,0 +1,126 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestUserCache() (*userCache[int], *time.Time) {
+	clock := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := newUserCache[int]()
+	c.now = func() time.Time { return clock }
+	return c, &clock
+}
+
+func TestUserCacheExpires(t *testing.T) {
+	c, clock := newTestUserCache()
+	c.set(1, 10)
+	*clock = clock.Add(c.ttl / 2)
+	c.set(2, 20)
+
+	if value, ok := c.get(1); !ok || value != 10 {
+		t.Fatalf("got %v, %v for user 1, want 10", value, ok)
+	}
+	*clock = clock.Add(c.ttl / 2)
+	if _, ok := c.get(1); ok {
+		t.Fatal("user 1 is still cached after the TTL")
+	}
+	if value, ok := c.get(2); !ok || value != 20 {
+		t.Fatalf("got %v, %v for user 2, want 20", value, ok)
+	}
+}
+
+func TestUserCacheSetRefreshes(t *testing.T) {
+	c, clock := newTestUserCache()
+	c.set(1, 10)
+	c.set(2, 20)
+	*clock = clock.Add(c.ttl - time.Second)
+	c.set(1, 11)
+	*clock = clock.Add(2 * time.Second)
+
+	if value, ok := c.get(1); !ok || value != 11 {
+		t.Fatalf("got %v, %v for the refreshed user 1, want 11", value, ok)
+	}
+	if _, ok := c.get(2); ok {
+		t.Fatal("user 2 is still cached after the TTL")
+	}
+}
+
+func TestUserCacheOnlyHoldsRecentUsers(t *testing.T) {
+	c, clock := newTestUserCache()
+	for userID := 0; userID < 1000; userID++ {
+		c.set(userID, userID)
+		*clock = clock.Add(c.ttl / 100)
+	}
+	if len(c.byUser) > 100 || c.expiry.Len() != len(c.byUser) {
+		t.Fatalf("%v users and %v expiries cached, want at most the 100 seen in the last TTL",
+			len(c.byUser), c.expiry.Len())
+	}
+}
+
+func TestUserCacheInvalidate(t *testing.T) {
+	c, _ := newTestUserCache()
+	c.set(1, 10)
+	c.set(2, 20)
+	c.invalidate(1, 3)
+	if _, ok := c.get(1); ok {
+		t.Fatal("user 1 is still cached after invalidating it")
+	}
+	if _, ok := c.get(2); !ok {
+		t.Fatal("user 2 was invalidated with user 1")
+	}
+	if c.expiry.Len() != 1 {
+		t.Fatalf("%v expiries tracked for 1 user", c.expiry.Len())
+	}
+}
+
+func TestEndingLastSessionEvictsUser(t *testing.T) {
+	ts := newTestServer(t, testOptions())
+	alice, aliceToken := ts.createUser(t, "alice", "")
+	bob, bobToken := ts.createUser(t, "bob", "")
+	ts.befriend(t, alice, bob)
+
+	first := ts.connect(t, alice, aliceToken)
+	first.send(40.7128, -74.0060)
+	second := ts.connect(t, alice, aliceToken)
+	second.send(40.7128, -74.0060)
+	bobClient := ts.connect(t, bob, bobToken)
+	meet(t, first, bobClient)
+	ts.handler.sharingLevel(alice.ID, bob.ID)
+
+	cached := func() bool {
+		_, settings := ts.handler.settings.get(alice.ID)
+		_, sharing := ts.handler.sharing.get(alice.ID)
+		_, shares := ts.handler.shares.get(alice.ID)
+		return settings || sharing || shares
+	}
+	if !cached() {
+		t.Fatal("nothing was cached for alice while she's connected")
+	}
+
+	first.conn.Close()
+	<-first.closed
+	waitFor(t, func() bool { return len(ts.handler.sessions.sessions(alice.ID)) == 1 })
+	if !cached() {
+		t.Fatal("alice was evicted while she still has a session")
+	}
+
+	second.conn.Close()
+	waitFor(t, func() bool { return !cached() })
+	if _, ok := ts.handler.settings.get(bob.ID); !ok {
+		t.Fatalf("bob was evicted with alice")
+	}
+}
+
+// waitFor polls until the condition holds, failing the test if it doesn't
+// in time
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(testMessageTimeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition never held")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
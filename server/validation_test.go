@@ -0,0 +1,75 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"nearby-friends/types"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func expectFields(t *testing.T, genericErr types.GenericError, fields ...string) {
+	t.Helper()
+	if len(genericErr.Fields) != len(fields) {
+		t.Fatalf("got field errors %+v, want %v", genericErr.Fields, fields)
+	}
+	for i, field := range fields {
+		if genericErr.Fields[i].Field != field || genericErr.Fields[i].Message == "" {
+			t.Fatalf("got field errors %+v, want %v", genericErr.Fields, fields)
+		}
+	}
+}
+
+func TestRegisterReturnsFieldErrors(t *testing.T) {
+	ts := newTestServer(t, testOptions())
+	body, err := json.Marshal(types.Credentials{Name: strings.Repeat("a", types.MaxUsernameLength+1), Password: "password"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Post(ts.URL+"/user/register", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("got status %v, want %v", resp.StatusCode, http.StatusBadRequest)
+	}
+	var genericErr types.GenericError
+	if err := json.NewDecoder(resp.Body).Decode(&genericErr); err != nil {
+		t.Fatal(err)
+	}
+	if genericErr.Code != http.StatusBadRequest {
+		t.Fatalf("got code %v, want %v", genericErr.Code, http.StatusBadRequest)
+	}
+	expectFields(t, genericErr, "name")
+}
+
+func TestInvalidLocationReturnsFieldErrors(t *testing.T) {
+	ts := newTestServer(t, testOptions())
+	alice, aliceToken := ts.createUser(t, "alice", "")
+
+	client := ts.connect(t, alice, aliceToken)
+	client.send(40.7128, -74.0060)
+	envelope, err := types.NewEnvelope(types.MessageLocationUpdate, client.seq+1, types.UserLocation{
+		User:      &alice,
+		Latitude:  91,
+		Longitude: -181,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.conn.WriteJSON(envelope); err != nil {
+		t.Fatal(err)
+	}
+	var genericErr types.GenericError
+	client.expect(types.MessageError, &genericErr)
+	if genericErr.Code != http.StatusBadRequest {
+		t.Fatalf("got code %v, want %v", genericErr.Code, http.StatusBadRequest)
+	}
+	expectFields(t, genericErr, "latitude", "longitude")
+
+	// The socket stays open for valid locations
+	client.seq++
+	client.send(40.7129, -74.0061)
+}
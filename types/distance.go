@@ -0,0 +1,148 @@
+package types
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// DistanceFunc returns the distance in miles between two locations
+type DistanceFunc func(primary, secondary UserLocation) float64
+
+// DistanceFuncs are the algorithms that can be selected by name
+var DistanceFuncs = map[string]DistanceFunc{
+	"haversine":       Haversine,
+	"vincenty":        Vincenty,
+	"equirectangular": Equirectangular,
+	"cosines":         SphericalLawOfCosines,
+}
+
+// ParseDistanceFunc looks up one of DistanceFuncs by name
+func ParseDistanceFunc(name string) (DistanceFunc, error) {
+	distance, ok := DistanceFuncs[name]
+	if !ok {
+		names := make([]string, 0, len(DistanceFuncs))
+		for name := range DistanceFuncs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown distance algorithm '%v', expected one of %v", name, strings.Join(names, "|"))
+	}
+	return distance, nil
+}
+
+// EarthRadiusMiles is the mean radius of the earth used by the spherical
+// algorithms
+const EarthRadiusMiles = 3958.7613
+
+// WGS-84 ellipsoid
+const (
+	wgs84SemiMajorMiles = 6378137 / 1609.344
+	wgs84Flattening     = 1 / 298.257223563
+	wgs84SemiMinorMiles = wgs84SemiMajorMiles * (1 - wgs84Flattening)
+)
+
+// vincentyIterations bounds the iterations before Vincenty gives up on
+// converging, which only happens for nearly antipodal points
+const vincentyIterations = 200
+
+func radians(degrees float64) float64 {
+	return degrees * math.Pi / 180
+}
+
+// Haversine is the great circle distance on a sphere. It stays accurate at
+// the short distances nearby friends are usually at, with errors up to
+// about 0.5% from treating the earth as a sphere.
+func Haversine(primary, secondary UserLocation) float64 {
+	lat1, lat2 := radians(primary.Latitude), radians(secondary.Latitude)
+	dLat := lat2 - lat1
+	dLon := radians(secondary.Longitude - primary.Longitude)
+
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * EarthRadiusMiles * math.Asin(math.Sqrt(math.Min(1, a)))
+}
+
+// Equirectangular projects both points onto a plane. It is the cheapest of
+// the algorithms and close to Haversine over a few miles, but drifts over
+// long distances and near the poles.
+func Equirectangular(primary, secondary UserLocation) float64 {
+	lat1, lat2 := radians(primary.Latitude), radians(secondary.Latitude)
+	dLon := math.Remainder(secondary.Longitude-primary.Longitude, 360)
+	x := radians(dLon) * math.Cos((lat1+lat2)/2)
+	y := lat2 - lat1
+	return EarthRadiusMiles * math.Hypot(x, y)
+}
+
+// Vincenty is the distance on the WGS-84 ellipsoid, accurate to under a
+// millimeter. It iterates, so it is the most expensive of the algorithms,
+// and falls back to Haversine for nearly antipodal points it can't
+// converge on.
+func Vincenty(primary, secondary UserLocation) float64 {
+	const a, b, f = wgs84SemiMajorMiles, wgs84SemiMinorMiles, wgs84Flattening
+
+	L := radians(secondary.Longitude - primary.Longitude)
+	U1 := math.Atan((1 - f) * math.Tan(radians(primary.Latitude)))
+	U2 := math.Atan((1 - f) * math.Tan(radians(secondary.Latitude)))
+	sinU1, cosU1 := math.Sincos(U1)
+	sinU2, cosU2 := math.Sincos(U2)
+
+	lambda := L
+	for i := 0; i < vincentyIterations; i++ {
+		sinLambda, cosLambda := math.Sincos(lambda)
+		sinSigma := math.Sqrt(math.Pow(cosU2*sinLambda, 2) +
+			math.Pow(cosU1*sinU2-sinU1*cosU2*cosLambda, 2))
+		if sinSigma == 0 {
+			return 0
+		}
+		cosSigma := sinU1*sinU2 + cosU1*cosU2*cosLambda
+		sigma := math.Atan2(sinSigma, cosSigma)
+		sinAlpha := cosU1 * cosU2 * sinLambda / sinSigma
+		cosSqAlpha := 1 - sinAlpha*sinAlpha
+		// Both points on the equator
+		cos2SigmaM := 0.0
+		if cosSqAlpha != 0 {
+			cos2SigmaM = cosSigma - 2*sinU1*sinU2/cosSqAlpha
+		}
+		C := f / 16 * cosSqAlpha * (4 + f*(4-3*cosSqAlpha))
+
+		previous := lambda
+		lambda = L + (1-C)*f*sinAlpha*
+			(sigma+C*sinSigma*(cos2SigmaM+C*cosSigma*(-1+2*cos2SigmaM*cos2SigmaM)))
+		if math.Abs(lambda-previous) > 1e-12 {
+			continue
+		}
+
+		uSq := cosSqAlpha * (a*a - b*b) / (b * b)
+		A := 1 + uSq/16384*(4096+uSq*(-768+uSq*(320-175*uSq)))
+		B := uSq / 1024 * (256 + uSq*(-128+uSq*(74-47*uSq)))
+		deltaSigma := B * sinSigma * (cos2SigmaM + B/4*(cosSigma*(-1+2*cos2SigmaM*cos2SigmaM)-
+			B/6*cos2SigmaM*(-3+4*sinSigma*sinSigma)*(-3+4*cos2SigmaM*cos2SigmaM)))
+		return b * A * (sigma - deltaSigma)
+	}
+	return Haversine(primary, secondary)
+}
+
+// SphericalLawOfCosines is the original distance calculation. Rounding in
+// the cosine of tiny angles makes it lose precision at short distances.
+func SphericalLawOfCosines(primary, secondary UserLocation) float64 {
+	theta := theta(primary, secondary)
+	radtheta := float64(math.Pi * theta / 180)
+
+	dist := math.Sin(primary.radialLatitude())*
+		math.Sin(secondary.radialLatitude()) +
+		math.Cos(primary.radialLatitude())*
+			math.Cos(secondary.radialLatitude())*
+			math.Cos(radtheta)
+
+	if dist > 1 {
+		dist = 1
+	}
+
+	dist = math.Acos(dist)
+	dist = dist * 180 / math.Pi
+	dist = dist * 60 * 1.1515
+
+	return dist
+}
@@ -0,0 +1,132 @@
+package types
+
+import (
+	"math"
+	"testing"
+)
+
+func at(lat, lon float64) UserLocation {
+	return UserLocation{Latitude: lat, Longitude: lon}
+}
+
+// distanceCases are pairs of points the algorithms are compared on
+var distanceCases = []struct {
+	name               string
+	primary, secondary UserLocation
+	// far is set for cases beyond the few miles nearby friends are usually at
+	far bool
+	// polar is set for cases close enough to a pole to distort projections
+	polar bool
+}{
+	{name: "same point", primary: at(40.7128, -74.0060), secondary: at(40.7128, -74.0060)},
+	{name: "across the street", primary: at(40.7128, -74.0060), secondary: at(40.7129, -74.0061)},
+	{name: "across town", primary: at(40.7128, -74.0060), secondary: at(40.7306, -73.9352)},
+	{name: "equator", primary: at(0, 10), secondary: at(0, 10.05)},
+	{name: "antimeridian", primary: at(-17.7, 179.99), secondary: at(-17.7, -179.99)},
+	{name: "near the pole", primary: at(89.9, 0), secondary: at(89.9, 90), polar: true},
+	{name: "southern hemisphere", primary: at(-33.8688, 151.2093), secondary: at(-33.9, 151.25)},
+	{name: "new york to los angeles", primary: at(40.7128, -74.0060), secondary: at(34.0522, -118.2437), far: true},
+	{name: "london to sydney", primary: at(51.5074, -0.1278), secondary: at(-33.8688, 151.2093), far: true},
+}
+
+// Known distances from the WGS-84 reference, in miles
+func TestVincentyKnownDistances(t *testing.T) {
+	for _, tc := range []struct {
+		name               string
+		primary, secondary UserLocation
+		miles              float64
+	}{
+		// Flinders Peak to Buninyong, Vincenty's own test line: 54972.271 m
+		{"flinders peak to buninyong", at(-37.95103341666667, 144.42486788888888), at(-37.65282113888889, 143.92649552777777), 54972.271 / 1609.344},
+		// A degree of longitude along the equator: 111319.491 m
+		{"degree along the equator", at(0, 0), at(0, 1), 111319.491 / 1609.344},
+	} {
+		if got := Vincenty(tc.primary, tc.secondary); math.Abs(got-tc.miles) > 0.001 {
+			t.Errorf("%v: got %v miles, want %v", tc.name, got, tc.miles)
+		}
+	}
+}
+
+func TestDistanceFuncsAgainstVincenty(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		distance DistanceFunc
+		// relative is the documented error bound relative to Vincenty
+		relative float64
+		// absolute is the error in miles tolerated at short distances, where
+		// a relative bound is too tight
+		absolute float64
+		// nearOnly algorithms are only accurate over short distances away
+		// from the poles
+		nearOnly bool
+	}{
+		// Treating the earth as a sphere is off by up to about 0.5%
+		{name: "haversine", distance: Haversine, relative: 0.005, absolute: 1e-6},
+		// Close to Haversine over a few miles, drifting near the poles
+		{name: "equirectangular", distance: Equirectangular, relative: 0.005, absolute: 1e-6, nearOnly: true},
+		// Rounding the cosine of tiny angles loses a few meters
+		{name: "cosines", distance: SphericalLawOfCosines, relative: 0.005, absolute: 0.005},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, c := range distanceCases {
+				if tc.nearOnly && (c.far || c.polar) {
+					continue
+				}
+				want := Vincenty(c.primary, c.secondary)
+				got := tc.distance(c.primary, c.secondary)
+				bound := math.Max(tc.relative*want, tc.absolute)
+				if math.Abs(got-want) > bound {
+					t.Errorf("%v: got %v miles, Vincenty %v, off by %v, more than %v",
+						c.name, got, want, math.Abs(got-want), bound)
+				}
+			}
+		})
+	}
+}
+
+func TestDistanceFuncsAreSymmetric(t *testing.T) {
+	for name, distance := range DistanceFuncs {
+		for _, c := range distanceCases {
+			there, back := distance(c.primary, c.secondary), distance(c.secondary, c.primary)
+			if math.Abs(there-back) > 1e-6 {
+				t.Errorf("%v %v: %v miles there, %v back", name, c.name, there, back)
+			}
+		}
+	}
+}
+
+func TestVincentyNearlyAntipodal(t *testing.T) {
+	primary, secondary := at(0, 0), at(0.5, 179.7)
+	got := Vincenty(primary, secondary)
+	if math.IsNaN(got) || got <= 0 {
+		t.Fatalf("got %v miles between nearly antipodal points", got)
+	}
+	if want := Haversine(primary, secondary); math.Abs(got-want) > 0.005*want {
+		t.Fatalf("got %v miles, Haversine %v", got, want)
+	}
+}
+
+func TestParseDistanceFunc(t *testing.T) {
+	for name := range DistanceFuncs {
+		if _, err := ParseDistanceFunc(name); err != nil {
+			t.Errorf("%v: %v", name, err)
+		}
+	}
+	if _, err := ParseDistanceFunc("manhattan"); err == nil {
+		t.Error("parsed an unknown algorithm")
+	}
+}
+
+var benchmarkDistance float64
+
+func benchmarkDistanceFunc(b *testing.B, distance DistanceFunc) {
+	primary, secondary := at(40.7128, -74.0060), at(40.7306, -73.9352)
+	for i := 0; i < b.N; i++ {
+		benchmarkDistance = distance(primary, secondary)
+	}
+}
+
+func BenchmarkHaversine(b *testing.B)       { benchmarkDistanceFunc(b, Haversine) }
+func BenchmarkVincenty(b *testing.B)        { benchmarkDistanceFunc(b, Vincenty) }
+func BenchmarkEquirectangular(b *testing.B) { benchmarkDistanceFunc(b, Equirectangular) }
+func BenchmarkCosines(b *testing.B)         { benchmarkDistanceFunc(b, SphericalLawOfCosines) }
@@ -0,0 +1,90 @@
+package types
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// ProtocolV1 is the websocket subprotocol for the enveloped location
+// protocol. Clients that don't negotiate it get the legacy raw JSON messages.
+const ProtocolV1 = "nearby-friends.v1"
+
+// MessageType discriminates the payload carried by an Envelope
+type MessageType string
+
+const (
+	// Client -> server
+	MessageLocationUpdate MessageType = "location_update"
+
+	// Server -> client
+	MessageFriendDistance   MessageType = "friend_distance"
+	MessageFriendOutOfRange MessageType = "friend_out_of_range"
+	MessageShareExpired     MessageType = "share_expired"
+	MessageError            MessageType = "error"
+	MessageAck              MessageType = "ack"
+	MessageGoingAway        MessageType = "going_away"
+	MessageSession          MessageType = "session"
+)
+
+// Envelope frames every message on a ProtocolV1 socket. Seq is assigned by
+// the sender and increases by one for every message it sends.
+type Envelope struct {
+	Type    MessageType     `json:"type"`
+	Seq     int64           `json:"seq"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+func NewEnvelope(messageType MessageType, seq int64, payload any) (*Envelope, error) {
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling %v payload: %v", messageType, err)
+	}
+	return &Envelope{Type: messageType, Seq: seq, Payload: raw}, nil
+}
+
+// Ack acknowledges the client message with the given Seq was applied
+type Ack struct {
+	Seq int64 `json:"seq"`
+}
+
+// OutOfRangeReason says why a friend is no longer shown to the user
+type OutOfRangeReason string
+
+const (
+	// The friend, or the user, moved beyond MaxDistanceBetweenUsers
+	OutOfRangeDistance OutOfRangeReason = "distance"
+	// The friend's location expired without an update
+	OutOfRangeOffline OutOfRangeReason = "offline"
+	// The friend stopped sharing their location with the user
+	OutOfRangeHidden OutOfRangeReason = "hidden"
+)
+
+// FriendOutOfRange tells the client a friend it was shown a distance for
+// is no longer in range and should be removed
+type FriendOutOfRange struct {
+	Friend         *User            `json:"friend"`
+	Reason         OutOfRangeReason `json:"reason"`
+	LastUpdateTime time.Time        `json:"lastUpdateTime"`
+}
+
+// GoingAway is the last message of a socket the server is closing while
+// shutting down. The client should reconnect, possibly to another server.
+type GoingAway struct {
+	Reason    string `json:"reason"`
+	Reconnect bool   `json:"reconnect"`
+	// RetryAfter spreads reconnects out so every client of a server that
+	// is shutting down doesn't reconnect at once
+	RetryAfter string `json:"retryAfter,omitempty"`
+}
+
+// SessionInfo is the first message of a session. A client that loses its
+// connection can reconnect with ?resume=<Token>&lastSeq=<seq> within
+// ResumeWindow and is replayed the messages after seq instead of starting
+// over. Resumed is false when a requested resume wasn't possible, in which
+// case the client sends its location as on any new session.
+type SessionInfo struct {
+	Token        string `json:"token,omitempty"`
+	Resumed      bool   `json:"resumed"`
+	ResumeWindow string `json:"resumeWindow,omitempty"`
+}
@@ -2,22 +2,31 @@ package types
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"math"
-	"sync"
+	"slices"
 	"time"
 )
 
 type GenericError struct {
-	Code    int    `json:"code"`
-	Message string `json:"message"`
+	Code    int          `json:"code"`
+	Message string       `json:"message"`
+	Fields  []FieldError `json:"fields,omitempty"`
 }
 
+// NewGenericError wraps err for the client. The invalid fields of a
+// ValidationError are listed individually.
 func NewGenericError(err error, code int) error {
-	return &GenericError{
+	genericErr := &GenericError{
 		Message: err.Error(),
 		Code:    code,
 	}
+	var validationErr *ValidationError
+	if errors.As(err, &validationErr) {
+		genericErr.Fields = validationErr.Fields
+	}
+	return genericErr
 }
 
 // Error implements the error interface for HTTPError.
@@ -30,21 +39,58 @@ func (e *GenericError) MarshalJSON() ([]byte, error) {
 	return json.Marshal(*e)
 }
 
+// Role is what a User is allowed to do on the system
+type Role string
+
+const (
+	RoleUser  Role = "user"
+	RoleAdmin Role = "admin"
+)
+
 // User represents a user on the system
 type User struct {
 	ID   int    `json:"id,omitempty"`
 	Name string `json:"name"`
+	Role Role   `json:"role,omitempty"`
 }
 
 func (u *User) String() string {
 	return fmt.Sprintf("%v - %v", u.ID, u.Name)
 }
 
+// Credentials are what a user registers and logs in with
+type Credentials struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+}
+
+// AuthToken is a signed bearer token issued to a User on login
+type AuthToken struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	User      User      `json:"user"`
+}
+
+// FriendRequestStatus is where a FriendRequest is in its lifecycle
+type FriendRequestStatus string
+
+const (
+	FriendRequestPending   FriendRequestStatus = "pending"
+	FriendRequestAccepted  FriendRequestStatus = "accepted"
+	FriendRequestDeclined  FriendRequestStatus = "declined"
+	FriendRequestCancelled FriendRequestStatus = "cancelled"
+)
+
 // FriendRequest is a request for a User
-// to establish a firendship with a Friend
+// to establish a firendship with a Friend.
+// The friendship only exists once the Friend accepts.
 type FriendRequest struct {
-	User   User `json:"user"`
-	Friend User `json:"friend"`
+	ID        int                 `json:"id,omitempty"`
+	User      User                `json:"user"`
+	Friend    User                `json:"friend"`
+	Status    FriendRequestStatus `json:"status,omitempty"`
+	CreatedAt time.Time           `json:"createdAt,omitempty"`
+	UpdatedAt time.Time           `json:"updatedAt,omitempty"`
 }
 
 // UserLocation represents a possible location a User is at.
@@ -56,6 +102,42 @@ type UserLocation struct {
 	LastUpdateTime time.Time `json:"lastUpdateTime"`
 }
 
+// FriendEventKind is what changed about the user a FriendEvent is about
+type FriendEventKind string
+
+const (
+	// The friendship between the user and the viewers ended
+	FriendEventUnfriended FriendEventKind = "unfriended"
+	// The user may have stopped sharing their location with the viewers
+	FriendEventVisibility FriendEventKind = "visibility"
+	// The user ended the location share ShareID with the viewers early
+	FriendEventShareEnded FriendEventKind = "share_ended"
+	// The user's last session ended
+	FriendEventOffline FriendEventKind = "offline"
+	// The user became friends with FriendID. Published on the user's own
+	// channel, which their sessions listen on, since they don't follow the
+	// new friend yet.
+	FriendEventFriended FriendEventKind = "friended"
+)
+
+// FriendEvent tells the sessions following a user about a change other than
+// a location update, on every server
+type FriendEvent struct {
+	UserID int             `json:"userId"`
+	Kind   FriendEventKind `json:"kind"`
+	// Viewers are the users whose sessions the event is for, every session
+	// following the user when empty
+	Viewers []int `json:"viewers,omitempty"`
+	ShareID int   `json:"shareId,omitempty"`
+	// FriendID is the new friend on friended events
+	FriendID int `json:"friendId,omitempty"`
+}
+
+// For reports whether the event is meant for the viewer's sessions
+func (e FriendEvent) For(viewerID int) bool {
+	return len(e.Viewers) == 0 || slices.Contains(e.Viewers, viewerID)
+}
+
 func (u UserLocation) radialLatitude() float64 {
 	return float64(math.Pi * u.Latitude / 180)
 }
@@ -64,58 +146,139 @@ func theta(user1, user2 UserLocation) float64 {
 	return user1.Longitude - user2.Longitude
 }
 
+// MaxDistanceBetweenUsers is the default nearby radius in miles for users
+// that haven't chosen their own
 var MaxDistanceBetweenUsers float64 = 5
 
-// DistanceBetweenUsers calculates the distance between the primary user
-// (assuming thats 'our' location) and the secondary user (assuming that the 'remote' location)
-func DistanceBetweenUsers(primary, secondary UserLocation) float64 {
-	theta := theta(primary, secondary)
-	radtheta := float64(math.Pi * theta / 180)
+// DistanceUnit is the unit distances are shown to a user in
+type DistanceUnit string
+
+const (
+	Miles      DistanceUnit = "mi"
+	Kilometers DistanceUnit = "km"
+)
 
-	dist := math.Sin(primary.radialLatitude())*
-		math.Sin(secondary.radialLatitude()) +
-		math.Cos(primary.radialLatitude())*
-			math.Cos(secondary.radialLatitude())*
-			math.Cos(radtheta)
+const kilometersPerMile = 1.609344
+
+// Valid reports whether the unit is one we can convert to
+func (u DistanceUnit) Valid() bool {
+	return u == Miles || u == Kilometers
+}
 
-	if dist > 1 {
-		dist = 1
+// FromMiles converts a distance in miles to the unit
+func (u DistanceUnit) FromMiles(miles float64) float64 {
+	if u == Kilometers {
+		return miles * kilometersPerMile
 	}
+	return miles
+}
+
+// ToMiles converts a distance in the unit to miles
+func (u DistanceUnit) ToMiles(distance float64) float64 {
+	if u == Kilometers {
+		return distance / kilometersPerMile
+	}
+	return distance
+}
+
+// SharingLevel is how much of a user's location a friend gets to see
+type SharingLevel string
 
-	dist = math.Acos(dist)
-	dist = dist * 180 / math.Pi
-	dist = dist * 60 * 1.1515
+const (
+	SharingOff         SharingLevel = "off"
+	SharingApproximate SharingLevel = "approximate"
+	SharingPrecise     SharingLevel = "precise"
+)
 
-	return dist
+func (l SharingLevel) Valid() bool {
+	return l == SharingOff || l == SharingApproximate || l == SharingPrecise
 }
 
-type UserDistance struct {
-	Primary        *User     `json:"primary"`
-	Remote         *User     `json:"remote"`
-	Distance       float64   `json:"distance"`
-	LastUpdateTime time.Time `json:"lastUpdateTime"`
+// UserSettings are the user's preferences for who counts as nearby and who
+// gets to see them. Radius is in Unit. Discoverable users can see, and be
+// seen by, nearby users that aren't their friends. Sharing applies to every
+// friend without a FriendSharing rule of their own. Ghost users share their
+// location with nobody.
+type UserSettings struct {
+	Radius       float64      `json:"radius"`
+	Unit         DistanceUnit `json:"unit"`
+	Discoverable bool         `json:"discoverable"`
+	Sharing      SharingLevel `json:"sharing"`
+	Ghost        bool         `json:"ghost"`
 }
 
-type SafeMap struct {
-	mu sync.RWMutex
-	m  map[int]UserLocation
+// DefaultUserSettings are used until a user saves their own
+func DefaultUserSettings() UserSettings {
+	return UserSettings{Radius: MaxDistanceBetweenUsers, Unit: Miles, Sharing: SharingPrecise}
 }
 
-func NewSafeMap() *SafeMap {
-	return &SafeMap{
-		m: make(map[int]UserLocation),
-	}
+// FriendSharing overrides how much of the user's location one friend sees
+type FriendSharing struct {
+	Friend User         `json:"friend"`
+	Level  SharingLevel `json:"level"`
+}
+
+// LocationShare lets Friend see User's location at Level until ExpiresAt,
+// even if User doesn't otherwise share it with them
+type LocationShare struct {
+	ID        int          `json:"id"`
+	User      User         `json:"user"`
+	Friend    User         `json:"friend"`
+	Level     SharingLevel `json:"level"`
+	CreatedAt time.Time    `json:"createdAt"`
+	ExpiresAt time.Time    `json:"expiresAt"`
 }
 
-func (s *SafeMap) Set(key int, value UserLocation) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	s.m[key] = value
+// Active reports whether the share is still in its window
+func (s LocationShare) Active(now time.Time) bool {
+	return now.Before(s.ExpiresAt)
 }
 
-func (s *SafeMap) Get(key int) (UserLocation, bool) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-	value, ok := s.m[key]
-	return value, ok
+// LocationShareRequest shares the user's location with one or more friends
+// for Duration, e.g. "1h". Level defaults to precise.
+type LocationShareRequest struct {
+	Friends  []User       `json:"friends"`
+	Duration string       `json:"duration"`
+	Level    SharingLevel `json:"level,omitempty"`
+}
+
+// LocationPoint is one recorded location in a user's history
+type LocationPoint struct {
+	Longitude  float64   `json:"longitude"`
+	Latitude   float64   `json:"latitude"`
+	RecordedAt time.Time `json:"recordedAt"`
+}
+
+// LocationTrack is the user's location history between From and To, oldest
+// point first. Truncated is set when there were more points than returned.
+type LocationTrack struct {
+	UserID    int             `json:"userId"`
+	From      time.Time       `json:"from"`
+	To        time.Time       `json:"to"`
+	Points    []LocationPoint `json:"points"`
+	Truncated bool            `json:"truncated"`
+}
+
+// DiscoveryRadius is how far in miles discoverable users can see each other
+var DiscoveryRadius float64 = 1
+
+// NearbyStranger is a discoverable user near the user that isn't their
+// friend. Only a coarse location and distance are shared.
+type NearbyStranger struct {
+	User      User         `json:"user"`
+	Longitude float64      `json:"longitude"`
+	Latitude  float64      `json:"latitude"`
+	Distance  float64      `json:"distance"`
+	Unit      DistanceUnit `json:"unit"`
+	// FriendRequestPath is where to POST to send the stranger a friend
+	// request
+	FriendRequestPath string `json:"friendRequestPath"`
+}
+
+type UserDistance struct {
+	Primary        *User        `json:"primary"`
+	Remote         *User        `json:"remote"`
+	Distance       float64      `json:"distance"`
+	Unit           DistanceUnit `json:"unit"`
+	LastUpdateTime time.Time    `json:"lastUpdateTime"`
 }
@@ -0,0 +1,127 @@
+package types
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// MaxUsernameLength is the longest username, in characters, a user can
+// register with
+const MaxUsernameLength = 64
+
+// MaxClockSkew is how far ahead of the server a client's clock can be
+// before its location timestamps are rejected
+const MaxClockSkew = time.Minute
+
+// FieldError is why one field of a payload is invalid
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError holds every invalid field of a payload
+type ValidationError struct {
+	Fields []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	messages := make([]string, 0, len(e.Fields))
+	for _, field := range e.Fields {
+		messages = append(messages, fmt.Sprintf("%v: %v", field.Field, field.Message))
+	}
+	return "invalid " + strings.Join(messages, "; ")
+}
+
+func (e *ValidationError) add(field, format string, args ...any) {
+	e.Fields = append(e.Fields, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// err returns the error if any field was invalid, nil otherwise
+func (e *ValidationError) err() error {
+	if len(e.Fields) == 0 {
+		return nil
+	}
+	return e
+}
+
+func validateUsername(errs *ValidationError, field, name string) {
+	switch {
+	case !utf8.ValidString(name):
+		errs.add(field, "must be valid UTF-8")
+	case strings.TrimSpace(name) != name:
+		errs.add(field, "must not start or end with whitespace")
+	case utf8.RuneCountInString(name) > MaxUsernameLength:
+		errs.add(field, "must be at most %v characters", MaxUsernameLength)
+	case strings.IndexFunc(name, unicode.IsControl) >= 0:
+		errs.add(field, "must not contain control characters")
+	}
+}
+
+// validateUserRef checks a user referred to by ID or name
+func validateUserRef(errs *ValidationError, field string, user User) {
+	if user.ID < 0 {
+		errs.add(field+".id", "must be positive")
+	}
+	if user.ID == 0 && user.Name == "" {
+		errs.add(field, "must have an id or a name")
+	}
+	if user.Name != "" {
+		validateUsername(errs, field+".name", user.Name)
+	}
+}
+
+// Validate checks a user about to be registered
+func (u User) Validate() error {
+	errs := &ValidationError{}
+	if u.ID < 0 {
+		errs.add("id", "must be positive")
+	}
+	if u.Name == "" {
+		errs.add("name", "is required")
+	} else {
+		validateUsername(errs, "name", u.Name)
+	}
+	if u.Role != "" && u.Role != RoleUser && u.Role != RoleAdmin {
+		errs.add("role", "unknown role '%v'", u.Role)
+	}
+	return errs.err()
+}
+
+// Validate checks a location sent by a client. The location must be for a
+// user ID, on the globe, and not timestamped in the future.
+func (u UserLocation) Validate() error {
+	errs := &ValidationError{}
+	if u.User == nil || u.ID == 0 {
+		errs.add("id", "is required")
+	} else {
+		if u.ID < 0 {
+			errs.add("id", "must be positive")
+		}
+		if u.Name != "" {
+			validateUsername(errs, "name", u.Name)
+		}
+	}
+	if math.IsNaN(u.Latitude) || u.Latitude < -90 || u.Latitude > 90 {
+		errs.add("latitude", "must be between -90 and 90")
+	}
+	if math.IsNaN(u.Longitude) || u.Longitude < -180 || u.Longitude > 180 {
+		errs.add("longitude", "must be between -180 and 180")
+	}
+	if u.LastUpdateTime.After(time.Now().Add(MaxClockSkew)) {
+		errs.add("lastUpdateTime", "must not be in the future")
+	}
+	return errs.err()
+}
+
+// Validate checks a friend request sent by a client. Both users must be
+// referred to by ID or name.
+func (r FriendRequest) Validate() error {
+	errs := &ValidationError{}
+	validateUserRef(errs, "user", r.User)
+	validateUserRef(errs, "friend", r.Friend)
+	return errs.err()
+}
@@ -0,0 +1,140 @@
+package types
+
+import (
+	"errors"
+	"math"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// invalidFields returns the fields err says are invalid, none when err is nil
+func invalidFields(t *testing.T, err error) []string {
+	t.Helper()
+	if err == nil {
+		return nil
+	}
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) {
+		t.Fatalf("got %T %v, want a ValidationError", err, err)
+	}
+	fields := make([]string, 0, len(validationErr.Fields))
+	for _, field := range validationErr.Fields {
+		fields = append(fields, field.Field)
+	}
+	return fields
+}
+
+func TestValidateUser(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		user User
+		want []string
+	}{
+		{name: "valid", user: User{Name: "alice"}},
+		{name: "unicode", user: User{Name: "zoë 🌍"}},
+		{name: "longest name", user: User{Name: strings.Repeat("é", MaxUsernameLength)}},
+		{name: "admin", user: User{Name: "alice", Role: RoleAdmin}},
+		{name: "empty name", user: User{}, want: []string{"name"}},
+		{name: "oversized name", user: User{Name: strings.Repeat("a", MaxUsernameLength+1)}, want: []string{"name"}},
+		{name: "padded name", user: User{Name: " alice"}, want: []string{"name"}},
+		{name: "control characters", user: User{Name: "ali\x00ce"}, want: []string{"name"}},
+		{name: "invalid UTF-8", user: User{Name: "ali\xffce"}, want: []string{"name"}},
+		{name: "negative id", user: User{ID: -1, Name: "alice"}, want: []string{"id"}},
+		{name: "unknown role", user: User{Name: "alice", Role: "root"}, want: []string{"role"}},
+		{name: "every field", user: User{ID: -1, Role: "root"}, want: []string{"id", "name", "role"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := invalidFields(t, tc.user.Validate()); !slices.Equal(got, tc.want) {
+				t.Fatalf("got invalid fields %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestValidateUserLocation(t *testing.T) {
+	located := func(id int, lat, lon float64) UserLocation {
+		return UserLocation{User: &User{ID: id}, Latitude: lat, Longitude: lon}
+	}
+	at := func(location UserLocation, updated time.Time) UserLocation {
+		location.LastUpdateTime = updated
+		return location
+	}
+	for _, tc := range []struct {
+		name     string
+		location UserLocation
+		want     []string
+	}{
+		{name: "valid", location: located(1, 40.7128, -74.0060)},
+		{name: "poles and antimeridian", location: located(1, 90, 180)},
+		{name: "south west corner", location: located(1, -90, -180)},
+		{name: "now", location: at(located(1, 0, 0), time.Now())},
+		{name: "within clock skew", location: at(located(1, 0, 0), time.Now().Add(MaxClockSkew/2))},
+		{name: "no user", location: UserLocation{Latitude: 1, Longitude: 1}, want: []string{"id"}},
+		{name: "zero id", location: located(0, 1, 1), want: []string{"id"}},
+		{name: "negative id", location: located(-1, 1, 1), want: []string{"id"}},
+		{name: "invalid name", location: UserLocation{User: &User{ID: 1, Name: " a"}}, want: []string{"name"}},
+		{name: "latitude above 90", location: located(1, 90.0001, 0), want: []string{"latitude"}},
+		{name: "latitude below -90", location: located(1, -91, 0), want: []string{"latitude"}},
+		{name: "longitude above 180", location: located(1, 0, 180.0001), want: []string{"longitude"}},
+		{name: "longitude below -180", location: located(1, 0, -181), want: []string{"longitude"}},
+		{name: "NaN latitude", location: located(1, math.NaN(), 0), want: []string{"latitude"}},
+		{name: "NaN longitude", location: located(1, 0, math.NaN()), want: []string{"longitude"}},
+		{name: "infinite", location: located(1, math.Inf(1), math.Inf(-1)), want: []string{"latitude", "longitude"}},
+		{
+			name:     "future",
+			location: at(located(1, 0, 0), time.Now().Add(2*MaxClockSkew)),
+			want:     []string{"lastUpdateTime"},
+		},
+		{
+			name:     "every field",
+			location: at(located(0, 100, 200), time.Now().Add(time.Hour)),
+			want:     []string{"id", "latitude", "longitude", "lastUpdateTime"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := invalidFields(t, tc.location.Validate()); !slices.Equal(got, tc.want) {
+				t.Fatalf("got invalid fields %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestValidateFriendRequest(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		request FriendRequest
+		want    []string
+	}{
+		{name: "by id", request: FriendRequest{User: User{ID: 1}, Friend: User{ID: 2}}},
+		{name: "by name", request: FriendRequest{User: User{Name: "alice"}, Friend: User{Name: "bob"}}},
+		{name: "no friend", request: FriendRequest{User: User{ID: 1}}, want: []string{"friend"}},
+		{name: "negative id", request: FriendRequest{User: User{ID: -1}, Friend: User{ID: 2}}, want: []string{"user.id"}},
+		{
+			name:    "oversized name",
+			request: FriendRequest{User: User{ID: 1}, Friend: User{Name: strings.Repeat("b", MaxUsernameLength+1)}},
+			want:    []string{"friend.name"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := invalidFields(t, tc.request.Validate()); !slices.Equal(got, tc.want) {
+				t.Fatalf("got invalid fields %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestGenericErrorListsFields(t *testing.T) {
+	err := User{}.Validate()
+	var genericErr *GenericError
+	if !errors.As(NewGenericError(err, 400), &genericErr) {
+		t.Fatal("NewGenericError didn't return a GenericError")
+	}
+	if len(genericErr.Fields) != 1 || genericErr.Fields[0].Field != "name" || genericErr.Code != 400 {
+		t.Fatalf("got %+v, want the name field listed", genericErr)
+	}
+	if !errors.As(NewGenericError(errors.New("plain"), 500), &genericErr) || genericErr.Fields != nil {
+		t.Fatalf("got fields %+v for an error that isn't a ValidationError", genericErr.Fields)
+	}
+}